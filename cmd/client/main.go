@@ -6,11 +6,9 @@ import (
 	"flag"
 	"log"
 	"net"
-	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
-	"time"
 
 	"github.com/google/martian/v3"
 	"github.com/google/martian/v3/h2"
@@ -36,6 +34,10 @@ var (
 	listenAddr = flag.String("addr", ":8080", "host:port of the proxy")
 	serverAddr = flag.String("server-addr", "", "proxy server address")
 
+	minWindow      = flag.Int("min-window", common.DefaultMinWindow, "lower bound of h2 request body windows tuned by the tunnel's bandwidth-delay product")
+	maxWindow      = flag.Int("max-window", common.DefaultMaxWindow, "upper bound of h2 request body windows tuned by the tunnel's bandwidth-delay product")
+	tunnelEncoding = flag.String("tunnel-encoding", common.TunnelEncodingZstd, "tunnel encodings offered to the server for uncompressed responses, zstd or empty to disable")
+
 	// maxMuxConnections = flag.Int("max-mux-connections", 1, "max tcp connections for each internal")
 )
 
@@ -64,18 +66,18 @@ func main() {
 
 	log.Printf("starting proxy on %s", l.Addr().String())
 
-	tr := &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: time.Second,
-		TLSClientConfig:       &tls.Config{
-			// InsecureSkipVerify: false,
-		},
+	bdp, err := common.NewBDPEstimator(common.BDPOptions{
+		MinWindow: int32(*minWindow),
+		MaxWindow: int32(*maxWindow),
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
-	p.SetRoundTripper(tr)
+	lp := internal.NewLocalProxy(*serverAddr, bdp, *tunnelEncoding)
+	l = lp.WrapListener(l)
+
+	// HTTP/1.1 requests are relayed over h2 as well
+	p.SetRoundTripper(lp)
 
 	var x509c *x509.Certificate
 	var priv interface{}
@@ -103,7 +105,6 @@ func main() {
 		mc.UnsafeUseSameCertificate = *unsafe
 
 		// dialFn := internal.NewMuxServerConnDialer(*serverAddr, "smux", 1).DialNormalStream
-		lp := internal.NewLocalProxy(*serverAddr)
 
 		h2Config := &h2.Config{
 			AllowedHostsFilter: func(_ string) bool { return true },
@@ -114,10 +115,6 @@ func main() {
 		}
 		mc.SetH2Config(h2Config)
 
-		// for http/1.1
-		p.SetDial(func(network, host string) (net.Conn, error) {
-			return lp.DialNormalStream(host)
-		})
 		p.SetMITM(mc)
 	}
 
@@ -12,6 +12,9 @@ import (
 	M "github.com/sagernet/sing/common/metadata"
 	"github.com/zckevin/http2-mitm-proxy/common"
 	"github.com/zckevin/http2-mitm-proxy/internal"
+	"github.com/zckevin/http2-mitm-proxy/prefetch"
+	htmlparser "github.com/zckevin/http2-mitm-proxy/prefetch/html_parser"
+	"github.com/zckevin/http2-mitm-proxy/resolver"
 	"github.com/zckevin/http2-mitm-proxy/tracing"
 	"go.opentelemetry.io/otel"
 )
@@ -24,12 +27,35 @@ var (
 
 	listenAddr = flag.String("listen-addr", ":20001", "listen address")
 	relayType  = flag.String("relay-type", "h2", "relay type")
+
+	utlsProfiles            = flag.String("utls-profiles", "", "comma separated host=profile rules to dial origins with a browser TLS fingerprint, profile: auto,chrome,firefox,edge,safari,ios,randomized")
+	dnsUpstreams            = flag.String("dns", "", "comma separated dns upstreams for origins, e.g. https://1.1.1.1/dns-query,tls://8.8.8.8,9.9.9.9, system resolver if empty")
+	dnsHosts                = flag.String("dns-hosts", "", "comma separated static host=ip overrides, e.g. example.com=127.0.0.1,*.lan=10.0.0.1")
+	dnsPrefer               = flag.String("dns-prefer", "", "prefer ipv4 or ipv6 when dialing origins, upstream order if empty")
+	insecureSkipVerifyHosts = flag.String("insecure-skip-verify-hosts", "", "comma separated hosts to skip upstream certificate verification, e.g. a.com,*.b.com")
+	minWindow               = flag.Int("min-window", common.DefaultMinWindow, "lower bound of h2 request body windows tuned by the tunnel's bandwidth-delay product")
+	maxWindow               = flag.Int("max-window", common.DefaultMaxWindow, "upper bound of h2 request body windows tuned by the tunnel's bandwidth-delay product")
+	dataSaver               = flag.String("data-saver", "", "comma separated host=quality rules to recompress large images at JPEG quality 1-100, first match wins, e.g. *.example.com=85,*=60, disabled if empty")
+	maxPushes               = flag.Int("max-pushes", prefetch.DefaultPushBudget.MaxPushes, "pushes in progress per tunnel conn, 0 for unlimited")
+	maxPushesPerPage        = flag.Int("max-pushes-per-page", prefetch.DefaultPushBudget.MaxPushesPerPage, "pushes in progress per document, 0 for unlimited")
+	maxPushBytesInFlight    = flag.Int64("max-push-bytes-in-flight", prefetch.DefaultPushBudget.MaxBytesInFlight, "response bytes of the pushes in progress per tunnel conn, 0 for unlimited")
+	maxPushBytesPerPage     = flag.Int64("max-push-bytes-per-page", prefetch.DefaultPushBudget.MaxBytesPerPage, "bytes pushed per document in total, 0 for unlimited")
+	prefetchTypes           = flag.String("prefetch-types", "script,style,modulepreload,font", "comma separated types of document resources to prefetch: script,style,modulepreload,font,image,icon,importmap, image also covers the backgrounds of stylesheets and predicted images")
+	predictionStore         = flag.String("prediction-store", "", "file to keep the learned subresources of documents in, prediction is disabled if empty")
+	predictionWindow        = flag.Duration("prediction-window", prefetch.DefaultPredictionWindow, "requests up to this long after a document are learned as its subresources")
+	predictionConfidence    = flag.Float64("prediction-confidence", prefetch.DefaultPredictionConfidence, "share of visits a learned subresource must have been requested in to be prefetched")
+	predictionMinVisits     = flag.Int("prediction-min-visits", prefetch.DefaultPredictionMinVisits, "visits of a document pattern before its subresources are predicted")
+	moduleDepth             = flag.Int("module-depth", prefetch.DefaultModuleDepth, "how deep imports of documents' ES modules are prefetched, 0 to disable")
+	moduleBytesPerPage      = flag.Int64("module-bytes-per-page", prefetch.DefaultModuleBytesPerPage, "source bytes of a document's ES modules parsed for imports, 0 for unlimited")
+	earlyHints              = flag.Bool("early-hints", false, "send documents' subresources as 103 Early Hints while the origin responds, those predicted and those found in the latest document of the same pattern")
+	preconnect              = flag.Bool("preconnect", true, "dial the other origins documents hint at with rel=preconnect or use ahead of the browser's requests")
+	tunnelEncoding          = flag.String("tunnel-encoding", common.TunnelEncodingZstd, "compress uncompressed text responses over the tunnel if the client supports it, zstd or empty to disable")
 )
 
-func demuxConn(conn net.Conn) {
+func demuxConn(conn net.Conn, opts internal.MuxHandlerOptions) {
 	logger := common.NewLogger("server")
-	muxHandler := internal.NewMuxHandler(*relayType)
-	err := mux.HandleConnection(context.TODO(), muxHandler, logger, conn, M.Metadata{})
+	muxHandler := internal.NewMuxHandler(opts)
+	err := mux.HandleConnection(context.TODO(), muxHandler, logger, muxHandler.WrapConn(conn), M.Metadata{})
 	if err != nil {
 		logger.Error("demuxConn err: ", err)
 	}
@@ -42,12 +68,75 @@ func listener() {
 		slog.Fatal(err)
 	}
 	defer l.Close()
+
+	dnsResolver, err := resolver.New(resolver.Options{
+		Upstreams: *dnsUpstreams,
+		Hosts:     *dnsHosts,
+		Prefer:    *dnsPrefer,
+	})
+	if err != nil {
+		slog.Fatal(err)
+	}
+	httpClient, err := common.NewAutoFallbackClient(common.AutoFallbackClientOptions{
+		InsecureSkipVerifyHosts: *insecureSkipVerifyHosts,
+		UTLSProfiles:            *utlsProfiles,
+		DialContext:             dnsResolver.DialContext,
+	})
+	if err != nil {
+		slog.Fatal(err)
+	}
+	bdp, err := common.NewBDPEstimator(common.BDPOptions{
+		MinWindow: int32(*minWindow),
+		MaxWindow: int32(*maxWindow),
+	})
+	if err != nil {
+		slog.Fatal(err)
+	}
+	ds, err := common.NewDataSaver(*dataSaver)
+	if err != nil {
+		slog.Fatal(err)
+	}
+	resourceTypes, err := htmlparser.ParseResourceTypes(*prefetchTypes)
+	if err != nil {
+		slog.Fatal(err)
+	}
+	predictor, err := prefetch.NewPredictor(prefetch.PredictorOptions{
+		StorePath:     *predictionStore,
+		Window:        *predictionWindow,
+		MinConfidence: *predictionConfidence,
+		MinVisits:     *predictionMinVisits,
+	})
+	if err != nil {
+		slog.Fatal(err)
+	}
+	opts := internal.MuxHandlerOptions{
+		RelayType:      *relayType,
+		HTTPClient:     httpClient,
+		BDP:            bdp,
+		TunnelEncoding: *tunnelEncoding,
+		DataSaver:      ds,
+		Prefetch: prefetch.PrefetchServerOptions{
+			Budget: prefetch.PushBudget{
+				MaxPushes:        *maxPushes,
+				MaxPushesPerPage: *maxPushesPerPage,
+				MaxBytesInFlight: *maxPushBytesInFlight,
+				MaxBytesPerPage:  *maxPushBytesPerPage,
+			},
+			Predictor:     predictor,
+			ResourceTypes: resourceTypes,
+
+			ModuleDepth:        *moduleDepth,
+			ModuleBytesPerPage: *moduleBytesPerPage,
+			EarlyHints:         *earlyHints,
+			Preconnect:         *preconnect,
+		},
+	}
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			slog.Fatal(err)
 		}
-		go demuxConn(conn)
+		go demuxConn(bdp.WrapConn(conn), opts)
 	}
 }
 
@@ -1,56 +1,427 @@
 package common
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sagernet/sing-box/log"
 	"golang.org/x/net/http2"
 )
 
-// use http2 first and fallback to http1.1 if failed
+const (
+	// how long a host stays on HTTP/1.1 after its h2 connection misbehaved
+	h1FallbackTTL = 10 * time.Minute
+)
+
+// AutoFallbackClient speaks whatever protocol the origin picks in TLS ALPN,
+// over one shared connection pool. If an h2 request fails before anything
+// was sent (or the origin asks for HTTP_1_1_REQUIRED), it's retried on a
+// HTTP/1.1 only transport and the host is remembered for h1FallbackTTL.
 type AutoFallbackClient struct {
 	logger log.ContextLogger
 
+	// negotiates h2 or http/1.1 by ALPN
+	client *http.Client
+	// http/1.1 only, for hosts with broken h2
 	h1Client *http.Client
-	h2Client *http.Client
 
-	h1Hosts sync.Map
+	h1Hosts *TTLCache
+
+	insecureHosts *HostMatcher
+	// nil for the system roots
+	rootCAs     *x509.CertPool
+	dialContext DialContextFunc
+	// the origin conns open, pooled or busy
+	conns *liveConns
+
+	// browser-like TLS fingerprint for hosts in utlsProfiles
+	utlsClient   *http.Client
+	utlsProfiles *HostRules[string]
 }
 
-func NewAutoFallbackClient() *AutoFallbackClient {
-	tr1 := &http.Transport{
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type AutoFallbackClientOptions struct {
+	// comma separated hosts whose certificates are not verified,
+	// e.g. "self-signed.lan,*.internal.example.com"
+	InsecureSkipVerifyHosts string
+
+	// comma separated "host=profile" rules for dialing with a uTLS
+	// fingerprint, profile is one of auto/chrome/firefox/edge/safari/ios/randomized,
+	// e.g. "*.cloudflare.com=auto,example.com=firefox"
+	UTLSProfiles string
+
+	// dials all origin conns, e.g. through a custom resolver,
+	// net.Dialer is used if nil
+	DialContext DialContextFunc
+
+	// roots origin certificates are verified against, the system's if nil
+	RootCAs *x509.CertPool
+}
+
+// UpstreamCertificateError is returned when an origin's certificate fails
+// verification, so the proxy can tell the browser instead of a generic error.
+type UpstreamCertificateError struct {
+	Host string
+	Err  error
+}
+
+func (e *UpstreamCertificateError) Error() string {
+	return fmt.Sprintf("upstream certificate verification failed for %s: %v", e.Host, e.Err)
+}
+
+func (e *UpstreamCertificateError) Unwrap() error {
+	return e.Err
+}
+
+func NewAutoFallbackClient(opts AutoFallbackClientOptions) (*AutoFallbackClient, error) {
+	utlsProfiles, err := ParseHostRules(opts.UTLSProfiles, ParseUTLSProfile)
+	if err != nil {
+		return nil, err
+	}
+	cl := &AutoFallbackClient{
+		logger:        NewLogger("AutoFallbackClient"),
+		h1Hosts:       NewTTLCache(h1FallbackTTL, time.Minute),
+		insecureHosts: NewHostMatcher(opts.InsecureSkipVerifyHosts),
+		utlsProfiles:  utlsProfiles,
+		rootCAs:       opts.RootCAs,
+		conns:         &liveConns{count: make(map[string]int)},
+	}
+	dial := opts.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	cl.dialContext = cl.conns.dialer(dial)
+
+	// TLS is dialed by us so the dialed host is known when verifying, the
+	// transports still trace the handshakes and pick h2 by ALPN
+	tr := &http.Transport{
 		ReadBufferSize: 1 << 16,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
+		DialContext:    cl.dialContext,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return cl.DialTLSContext(ctx, network, addr, []string{http2.NextProtoTLS, "http/1.1"})
 		},
 	}
-	h1Client := NewHttpClient(tr1)
-	tr2 := &http2.Transport{
-		TLSClientConfig: tr1.TLSClientConfig,
+	// takes over the conn if ALPN picks h2
+	if _, err := http2.ConfigureTransports(tr); err != nil {
+		panic(err)
 	}
-	h2Client := NewHttpClient(tr2)
-	cl := &AutoFallbackClient{
-		logger:   NewLogger("AutoFallbackClient"),
-		h1Client: h1Client,
-		h2Client: h2Client,
+
+	h1Tr := &http.Transport{
+		ReadBufferSize: 1 << 16,
+		DialContext:    cl.dialContext,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return cl.DialTLSContext(ctx, network, addr, []string{"http/1.1"})
+		},
+		// non-nil empty map disables h2
+		TLSNextProto: make(map[string]func(string, *tls.Conn) http.RoundTripper),
+	}
+
+	cl.client = NewHttpClient(tr)
+	cl.h1Client = NewHttpClient(h1Tr)
+	cl.utlsClient = NewHttpClient(newUTLSTransport(cl.dialContext, cl.verifyPeer))
+	return cl, nil
+}
+
+func (c *AutoFallbackClient) tlsConfig(host string, nextProtos []string) *tls.Config {
+	return &tls.Config{
+		ServerName: host,
+		NextProtos: nextProtos,
+		// crypto/tls can't skip verification per host, so we turn the default
+		// verification off and do the same checks in VerifyConnection. It
+		// checks the dialed host, the conn's ServerName is empty for IPs.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return c.verifyPeer(host, cs.PeerCertificates)
+		},
+	}
+}
+
+// DialContext dials a raw conn to an origin, for relays that don't go
+// through http.
+func (c *AutoFallbackClient) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return c.dialContext(ctx, network, addr)
+}
+
+// DialTLSContext dials an origin with TLS, verified the same way as
+// requests made by the client.
+func (c *AutoFallbackClient) DialTLSContext(ctx context.Context, network, addr string, nextProtos []string) (*tls.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := c.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, c.tlsConfig(host, nextProtos))
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Preconnect dials origin, e.g. "https://cdn.example.com", into the pool
+// ahead of its first request, so that one doesn't pay for the handshakes.
+// Transports can't be asked for a conn alone, so it starts a request and
+// cancels it once the conn is up. An h1 request on a pooled conn can't be
+// canceled before it's sent, so nothing is done if there's a conn to
+// origin already, only one pooled since the check gets an OPTIONS *.
+func (c *AutoFallbackClient) Preconnect(ctx context.Context, origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	if c.conns.has(net.JoinHostPort(u.Hostname(), port)) {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var connected atomic.Bool
+	ready := func() {
+		connected.Store(true)
+		cancel()
+	}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		// before h2 takes the conn over, a canceled dial is still pooled
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				ready()
+			}
+		},
+		// reused, or dialed by a custom DialTLS
+		GotConn: func(info httptrace.GotConnInfo) {
+			// canceling on an idle HTTP/1.1 conn would close it, let the
+			// request go instead
+			if tc, ok := info.Conn.(*tls.Conn); info.Reused &&
+				(!ok || tc.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS) {
+				connected.Store(true)
+				return
+			}
+			ready()
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, u.Scheme+"://"+u.Host, nil)
+	if err != nil {
+		return err
+	}
+	req.URL.Opaque = "*"
+	resp, err := c.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		return nil
+	}
+	if connected.Load() {
+		return nil
+	}
+	return err
+}
+
+// liveConns counts the open conns per dialed address.
+type liveConns struct {
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func (l *liveConns) dialer(dial DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		l.mu.Lock()
+		l.count[addr]++
+		l.mu.Unlock()
+		return &liveConn{Conn: conn, closed: func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.count[addr]--; l.count[addr] == 0 {
+				delete(l.count, addr)
+			}
+		}}, nil
 	}
-	return cl
+}
+
+func (l *liveConns) has(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count[addr] > 0
+}
+
+type liveConn struct {
+	net.Conn
+	once   sync.Once
+	closed func()
+}
+
+func (c *liveConn) Close() error {
+	c.once.Do(c.closed)
+	return c.Conn.Close()
+}
+
+// InsecureSkipVerify reports whether host is exempted from certificate
+// verification by AutoFallbackClientOptions.InsecureSkipVerifyHosts.
+func (c *AutoFallbackClient) InsecureSkipVerify(host string) bool {
+	return c.insecureHosts.Match(host)
+}
+
+// verifyPeer verifies certs for host, a name or an IP.
+func (c *AutoFallbackClient) verifyPeer(host string, certs []*x509.Certificate) error {
+	if c.InsecureSkipVerify(host) {
+		return nil
+	}
+	if len(certs) == 0 {
+		return &UpstreamCertificateError{Host: host, Err: errors.New("no peer certificates")}
+	}
+	if host == "" {
+		// x509 would skip the host check
+		return &UpstreamCertificateError{Host: host, Err: errors.New("no host to verify")}
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         c.rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	// nil Roots means system roots
+	if _, err := certs[0].Verify(opts); err != nil {
+		return &UpstreamCertificateError{Host: host, Err: err}
+	}
+	return nil
+}
+
+// attempt records what happened on the wire during a single request.
+type attempt struct {
+	mu           sync.Mutex
+	proto        string
+	wroteHeaders bool
+}
+
+func (a *attempt) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if err == nil {
+				a.proto = cs.NegotiatedProtocol
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			if tc, ok := info.Conn.(*tls.Conn); ok {
+				a.proto = tc.ConnectionState().NegotiatedProtocol
+			}
+		},
+		WroteHeaders: func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.wroteHeaders = true
+		},
+	}
+}
+
+func isHTTP11RequiredError(err error) bool {
+	var se http2.StreamError
+	if errors.As(err, &se) {
+		return se.Code == http2.ErrCodeHTTP11Required
+	}
+	var ga http2.GoAwayError
+	if errors.As(err, &ga) {
+		return ga.ErrCode == http2.ErrCodeHTTP11Required
+	}
+	return false
+}
+
+// fallbackRequest returns the request to replay on HTTP/1.1, or false if
+// replaying it is not safe, e.g. a POST whose body was already sent.
+func (c *AutoFallbackClient) fallbackRequest(req *http.Request, a *attempt, err error) (*http.Request, bool) {
+	if IsNetCancelError(err) {
+		return nil, false
+	}
+
+	a.mu.Lock()
+	proto, wroteHeaders := a.proto, a.wroteHeaders
+	a.mu.Unlock()
+
+	// ALPN already picked h1, or we never got a conn at all
+	if proto != http2.NextProtoTLS {
+		return nil, false
+	}
+	if !wroteHeaders {
+		// nothing left our side, body is untouched
+		return req, true
+	}
+	if !isHTTP11RequiredError(err) {
+		return nil, false
+	}
+	// the origin refused to process it, but the body may be half consumed
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, gerr := req.GetBody()
+	if gerr != nil {
+		return nil, false
+	}
+	req = req.Clone(req.Context())
+	req.Body = body
+	return req, true
 }
 
 func (c *AutoFallbackClient) Do(req *http.Request) (*http.Response, error) {
-	host := req.URL.Hostname()
-	if _, ok := c.h1Hosts.Load(host); ok {
+	host := req.URL.Host
+	// don't speak h2 to origins the browser would only talk h1 to,
+	// some of them serve different content by ALPN.
+	if hints, ok := ClientHelloHintsFor(req.Context(), req.URL.Hostname()); ok && !hints.OffersH2() {
 		return c.h1Client.Do(req)
 	}
-	resp, err := c.h2Client.Do(req)
-	if err != nil && !IsNetCancelError(err) {
-		c.logger.Debug("Fallback: Use HTTP/1.1 for ", host, ", reason:", err)
-		c.h1Hosts.Store(host, true)
-		resp, err = c.h1Client.Do(req)
+	if profile, ok := c.utlsProfiles.Lookup(host); ok {
+		return c.utlsClient.Do(WithUTLSProfile(req, profile))
+	}
+	if _, ok := c.h1Hosts.Get(host); ok {
+		return c.h1Client.Do(req)
+	}
+
+	a := &attempt{}
+	traced := req.WithContext(httptrace.WithClientTrace(req.Context(), a.clientTrace()))
+	resp, err := c.client.Do(traced)
+	if err == nil {
+		return resp, nil
+	}
+
+	fallbackReq, ok := c.fallbackRequest(req, a, err)
+	if !ok {
+		return nil, err
 	}
-	return resp, err
+	c.logger.Debug("Fallback: Use HTTP/1.1 for ", host, ", reason:", err)
+	c.h1Hosts.Set(host, struct{}{})
+	return c.h1Client.Do(fallbackReq)
 }
 
 func (c *AutoFallbackClient) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -0,0 +1,327 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+)
+
+// testCA issues certificates for test servers.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for hosts, names or IPs.
+func (ca *testCA) issue(hosts ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).To(BeNil())
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// fallbackServer refuses every h2 stream with HTTP_1_1_REQUIRED and
+// answers http/1.1 requests with their body.
+type fallbackServer struct {
+	ln         net.Listener
+	h2Streams  atomic.Int32
+	h1Requests atomic.Int32
+}
+
+func startFallbackServer(cert tls.Certificate) *fallbackServer {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+	})
+	Expect(err).To(BeNil())
+	s := &fallbackServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn.(*tls.Conn))
+		}
+	}()
+	return s
+}
+
+func (s *fallbackServer) serve(conn *tls.Conn) {
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	if conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(conn, preface); err != nil {
+			return
+		}
+		fr := http2.NewFramer(conn, conn)
+		fr.WriteSettings()
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *http2.SettingsFrame:
+				if !f.IsAck() {
+					fr.WriteSettingsAck()
+				}
+			case *http2.HeadersFrame:
+				s.h2Streams.Add(1)
+				fr.WriteRSTStream(f.StreamID, http2.ErrCodeHTTP11Required)
+			}
+		}
+	}
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		s.h1Requests.Add(1)
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	}
+}
+
+func (s *fallbackServer) Close() {
+	s.ln.Close()
+}
+
+// newTestClient returns a client dialing every origin at addr.
+func newTestClient(addr string, opts AutoFallbackClientOptions) *AutoFallbackClient {
+	opts.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	c, err := NewAutoFallbackClient(opts)
+	Expect(err).To(BeNil())
+	return c
+}
+
+var _ = Describe("AutoFallbackClient", func() {
+	DescribeTable("should preconnect into the pool",
+		func(enableHTTP2 bool, proto string, preconnectActive int32) {
+			var conns, active atomic.Int32
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.EnableHTTP2 = enableHTTP2
+			srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+				switch s {
+				case http.StateNew:
+					conns.Add(1)
+				case http.StateActive:
+					// an h1 conn is once per request, OPTIONS * included
+					active.Add(1)
+				}
+			}
+			srv.StartTLS()
+			defer srv.Close()
+
+			// the test certificate is for example.com
+			addr := srv.Listener.Addr().String()
+			_, port, _ := net.SplitHostPort(addr)
+			origin := "https://example.com:" + port
+			c := newTestClient(addr, AutoFallbackClientOptions{InsecureSkipVerifyHosts: "example.com"})
+
+			// the later ones find the conn pooled and keep it
+			for i := 0; i < 3; i++ {
+				Expect(c.Preconnect(context.Background(), origin)).To(BeNil())
+			}
+			Expect(conns.Load()).To(Equal(int32(1)))
+			Eventually(active.Load).Should(Equal(preconnectActive))
+			Consistently(active.Load, "100ms").Should(Equal(preconnectActive))
+
+			req, _ := http.NewRequest(http.MethodGet, origin+"/a.js", nil)
+			resp, err := c.Do(req)
+			Expect(err).To(BeNil())
+			resp.Body.Close()
+			Expect(resp.Proto).To(Equal(proto))
+			Expect(conns.Load()).To(Equal(int32(1)))
+		},
+		// h2 conns are active from the preface on
+		Entry("h2", true, "HTTP/2.0", int32(1)),
+		Entry("http/1.1", false, "HTTP/1.1", int32(0)),
+	)
+
+	Describe("fallbackRequest", func() {
+		c := &AutoFallbackClient{}
+		resetErr := http2.StreamError{Code: http2.ErrCodeInternal}
+		http11Required := http2.StreamError{Code: http2.ErrCodeHTTP11Required}
+
+		It("should replay requests nothing of which was sent", func() {
+			req, _ := http.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader("payload"))
+			replay, ok := c.fallbackRequest(req, &attempt{proto: http2.NextProtoTLS}, resetErr)
+			Expect(ok).To(BeTrue())
+			Expect(replay).To(BeIdenticalTo(req))
+		})
+
+		It("should not fall back after headers were written", func() {
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+			_, ok := c.fallbackRequest(req, &attempt{proto: http2.NextProtoTLS, wroteHeaders: true}, resetErr)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should not fall back when ALPN picked http/1.1 or on cancel", func() {
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+			_, ok := c.fallbackRequest(req, &attempt{proto: "http/1.1"}, resetErr)
+			Expect(ok).To(BeFalse())
+			_, ok = c.fallbackRequest(req, &attempt{proto: http2.NextProtoTLS}, context.Canceled)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should replay bodies on HTTP_1_1_REQUIRED if they can be", func() {
+			req, _ := http.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader("payload"))
+			// half sent before the stream was reset
+			io.CopyN(io.Discard, req.Body, 3)
+			sent := &attempt{proto: http2.NextProtoTLS, wroteHeaders: true}
+			replay, ok := c.fallbackRequest(req, sent, fmt.Errorf("wrapped: %w", http11Required))
+			Expect(ok).To(BeTrue())
+			body, _ := io.ReadAll(replay.Body)
+			Expect(string(body)).To(Equal("payload"))
+
+			streamed, _ := http.NewRequest(http.MethodPost, "https://example.com/", io.NopCloser(strings.NewReader("payload")))
+			streamed.GetBody = nil
+			_, ok = c.fallbackRequest(streamed, sent, http11Required)
+			Expect(ok).To(BeFalse())
+
+			_, ok = c.fallbackRequest(req, sent, http2.GoAwayError{ErrCode: http2.ErrCodeHTTP11Required})
+			Expect(ok).To(BeTrue())
+			_, ok = c.fallbackRequest(req, sent, errors.New("unexpected EOF"))
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("certificate verification", func() {
+		ca := newTestCA()
+		get := func(cert tls.Certificate, host string) error {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+			srv.StartTLS()
+			defer srv.Close()
+			_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+			c := newTestClient(srv.Listener.Addr().String(), AutoFallbackClientOptions{RootCAs: ca.pool})
+			req, _ := http.NewRequest(http.MethodGet, "https://"+net.JoinHostPort(host, port)+"/", nil)
+			resp, err := c.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}
+
+		It("should accept certificates for the host", func() {
+			Expect(get(ca.issue("example.com"), "example.com")).To(BeNil())
+			Expect(get(ca.issue("127.0.0.1"), "127.0.0.1")).To(BeNil())
+		})
+
+		It("should reject certificates for other names, IP hosts too", func() {
+			var certErr *UpstreamCertificateError
+			err := get(ca.issue("example.com"), "example.org")
+			Expect(errors.As(err, &certErr)).To(BeTrue())
+			Expect(certErr.Host).To(Equal("example.org"))
+
+			// there's no SNI for IPs, the conn's ServerName is empty
+			err = get(ca.issue("example.com"), "127.0.0.1")
+			Expect(errors.As(err, &certErr)).To(BeTrue())
+			Expect(certErr.Host).To(Equal("127.0.0.1"))
+		})
+
+		It("should reject certificates of unknown roots", func() {
+			var certErr *UpstreamCertificateError
+			err := get(newTestCA().issue("example.com"), "example.com")
+			Expect(errors.As(err, &certErr)).To(BeTrue())
+		})
+	})
+
+	It("should stay on http/1.1 for a while after HTTP_1_1_REQUIRED", func() {
+		ca := newTestCA()
+		srv := startFallbackServer(ca.issue("example.com"))
+		defer srv.Close()
+		_, port, _ := net.SplitHostPort(srv.ln.Addr().String())
+		origin := "https://example.com:" + port
+		c := newTestClient(srv.ln.Addr().String(), AutoFallbackClientOptions{InsecureSkipVerifyHosts: "example.com"})
+		c.h1Hosts = NewTTLCache(200*time.Millisecond, 0)
+
+		post := func() {
+			req, _ := http.NewRequest(http.MethodPost, origin+"/", strings.NewReader("payload"))
+			resp, err := c.Do(req)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			Expect(resp.Proto).To(Equal("HTTP/1.1"))
+			body, _ := io.ReadAll(resp.Body)
+			Expect(string(body)).To(Equal("payload"))
+		}
+
+		post()
+		Expect(srv.h2Streams.Load()).To(Equal(int32(1)))
+		Expect(srv.h1Requests.Load()).To(Equal(int32(1)))
+
+		// remembered, h2 isn't tried again
+		post()
+		Expect(srv.h2Streams.Load()).To(Equal(int32(1)))
+		Expect(srv.h1Requests.Load()).To(Equal(int32(2)))
+
+		time.Sleep(300 * time.Millisecond)
+		post()
+		Expect(srv.h2Streams.Load()).To(Equal(int32(2)))
+		Expect(srv.h1Requests.Load()).To(Equal(int32(3)))
+	})
+})
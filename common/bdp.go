@@ -0,0 +1,194 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	bdpSampleInterval = 100 * time.Millisecond
+	// max filters over the last samples, so idle periods don't drag the
+	// estimate down
+	bdpSamples = 32
+
+	// with windows this large default 16KB frames mean a lot of frame
+	// headers and window updates
+	tunedMaxFrameSize = 256 << 10
+
+	// RFC 7540 initial window, smaller ones can't be advertised
+	initialWindowSize = 65535
+
+	DefaultMinWindow = 1 << 20
+	DefaultMaxWindow = 32 << 20
+)
+
+type BDPOptions struct {
+	// bounds of the h2 servers' stream windows, the connection window is 4x
+	MinWindow int32
+	MaxWindow int32
+}
+
+// BDPEstimator estimates the bandwidth-delay product of the tunnel from the
+// delivery rate and RTT of its TCP conns, so h2 flow control windows can be
+// sized to keep the long link full. A nil *BDPEstimator leaves defaults.
+//
+// The server side relay's h2 server windows are sized for request bodies,
+// and the client side relay's transport conn for responses, see
+// WrapTransportConn. smux keeps its 4MB receive buffer, sing-mux doesn't
+// expose it, but with protocol version 1 it's no window the other side
+// waits on: it only stops reading the tunnel conn once that much is
+// unread, and the relays read their streams right away.
+type BDPEstimator struct {
+	opts BDPOptions
+
+	mu   sync.Mutex
+	next int
+	// bytes per second
+	rates [bdpSamples]float64
+	rtts  [bdpSamples]time.Duration
+}
+
+func NewBDPEstimator(opts BDPOptions) (*BDPEstimator, error) {
+	if opts.MinWindow < initialWindowSize || opts.MaxWindow < opts.MinWindow {
+		return nil, fmt.Errorf("invalid window bounds [%d, %d]", opts.MinWindow, opts.MaxWindow)
+	}
+	return &BDPEstimator{opts: opts}, nil
+}
+
+// AddSample records that n bytes arrived during interval, rtt is zero if
+// unknown.
+func (e *BDPEstimator) AddSample(n int64, interval, rtt time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rates[e.next] = float64(n) / interval.Seconds()
+	e.rtts[e.next] = rtt
+	e.next = (e.next + 1) % bdpSamples
+}
+
+// BDP is max delivery rate times min RTT over recent samples in bytes, 0 if
+// there are no samples yet.
+func (e *BDPEstimator) BDP() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var (
+		rate   float64
+		minRTT time.Duration
+	)
+	for i := range e.rates {
+		rate = math.Max(rate, e.rates[i])
+		if rtt := e.rtts[i]; rtt > 0 && (minRTT == 0 || rtt < minRTT) {
+			minRTT = rtt
+		}
+	}
+	return int64(rate * minRTT.Seconds())
+}
+
+// Window is the stream window to advertise, twice the BDP so window updates
+// have a round trip to arrive, clamped to the configured bounds.
+func (e *BDPEstimator) Window() int32 {
+	w := 2 * e.BDP()
+	if w < int64(e.opts.MinWindow) {
+		return e.opts.MinWindow
+	}
+	if w > int64(e.opts.MaxWindow) {
+		return e.opts.MaxWindow
+	}
+	return int32(w)
+}
+
+// ConfigureServer sizes s's receive windows for a new relay conn, from the
+// estimate at the time: x/net can't resize them for the conn's lifetime.
+func (e *BDPEstimator) ConfigureServer(s *http2.Server) {
+	if e == nil {
+		return
+	}
+	w := e.Window()
+	s.MaxUploadBufferPerStream = w
+	conn := 4 * int64(w)
+	if conn > math.MaxInt32 {
+		conn = math.MaxInt32
+	}
+	s.MaxUploadBufferPerConnection = int32(conn)
+	s.MaxReadFrameSize = tunedMaxFrameSize
+}
+
+// ConfigureTransport lets t read large frames, its windows are sized by
+// wrapping its conns with WrapTransportConn.
+func (e *BDPEstimator) ConfigureTransport(t *http2.Transport) {
+	if e == nil {
+		return
+	}
+	t.MaxReadFrameSize = tunedMaxFrameSize
+}
+
+// WrapTransportConn sizes the receive windows of the x/net h2 transport
+// using conn from the estimate at the time: the server may send Window per
+// stream, 4x that per conn, rather than the transport's fixed 4MB per
+// stream. It's conn if that's more already.
+func (e *BDPEstimator) WrapTransportConn(conn net.Conn) net.Conn {
+	if e == nil {
+		return conn
+	}
+	w := e.Window()
+	if w <= transportStreamWindow {
+		return conn
+	}
+	return newWindowExtendingConn(conn, w)
+}
+
+// WrapConn samples the traffic of the tunnel conn.
+func (e *BDPEstimator) WrapConn(conn net.Conn) net.Conn {
+	if e == nil {
+		return conn
+	}
+	return &measuredConn{Conn: conn, e: e, start: time.Now()}
+}
+
+type measuredConn struct {
+	net.Conn
+	e *BDPEstimator
+
+	mu    sync.Mutex
+	start time.Time
+	// bytes read and written since start
+	read, written int64
+}
+
+func (c *measuredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.count(int64(n), 0)
+	return n, err
+}
+
+func (c *measuredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.count(0, int64(n))
+	return n, err
+}
+
+// count samples the busier direction of each interval, that's the link's
+// rate whichever side measures it. The server mostly writes responses and
+// reads uploads held back by the very windows being sized.
+func (c *measuredConn) count(read, written int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read += read
+	c.written += written
+	if elapsed := time.Since(c.start); elapsed >= bdpSampleInterval {
+		n := c.read
+		if c.written > n {
+			n = c.written
+		}
+		rtt, _ := tcpRTT(c.Conn)
+		c.e.AddSample(n, elapsed, rtt)
+		c.start, c.read, c.written = time.Now(), 0, 0
+	}
+}
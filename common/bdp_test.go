@@ -0,0 +1,276 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+)
+
+var _ = Describe("BDPEstimator", func() {
+	opts := BDPOptions{MinWindow: DefaultMinWindow, MaxWindow: DefaultMaxWindow}
+
+	It("should use min window without samples", func() {
+		e, err := NewBDPEstimator(opts)
+		Expect(err).To(BeNil())
+		Expect(e.Window()).To(Equal(opts.MinWindow))
+	})
+
+	It("should size window to twice max rate times min rtt", func() {
+		e, _ := NewBDPEstimator(opts)
+		// 10MB/s over a 200ms link
+		e.AddSample(1<<20, 100*time.Millisecond, 300*time.Millisecond)
+		e.AddSample(10<<20, time.Second, 200*time.Millisecond)
+		Expect(e.BDP()).To(Equal(int64(2 << 20)))
+		Expect(e.Window()).To(Equal(int32(4 << 20)))
+
+		e.AddSample(1<<30, time.Second, 200*time.Millisecond)
+		Expect(e.Window()).To(Equal(opts.MaxWindow))
+	})
+
+	It("should reject invalid bounds", func() {
+		_, err := NewBDPEstimator(BDPOptions{MinWindow: 1 << 20, MaxWindow: 1 << 10})
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should sample the busier direction of the conn", func() {
+		e, _ := NewBDPEstimator(opts)
+		c, peer := net.Pipe()
+		defer peer.Close()
+		go io.Copy(io.Discard, peer)
+		conn := e.WrapConn(c)
+		defer conn.Close()
+
+		conn.Write(make([]byte, 1<<20))
+		time.Sleep(bdpSampleInterval)
+		conn.Write(make([]byte, 1))
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		// about 1MB over a bit more than the sample interval
+		Expect(e.rates[0]).To(BeNumerically(">", float64(1<<20)))
+		Expect(e.rates[0]).To(BeNumerically("<=", float64(10<<20)))
+	})
+
+	Describe("window extending conn", func() {
+		const window = 16 << 20
+
+		// serve starts an h2 server on one end of a pipe and a transport on
+		// the other, the transport's windows extended to window.
+		serve := func(handler http.HandlerFunc) *http2.ClientConn {
+			cc, sc := net.Pipe()
+			go (&http2.Server{}).ServeConn(sc, &http2.ServeConnOpts{Handler: handler})
+			client, err := (&http2.Transport{}).NewClientConn(newWindowExtendingConn(cc, window))
+			Expect(err).To(BeNil())
+			DeferCleanup(client.Close)
+			return client
+		}
+		get := func(client *http2.ClientConn, path string) *http.Response {
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com"+path, nil)
+			resp, err := client.RoundTrip(req)
+			Expect(err).To(BeNil())
+			return resp
+		}
+		body := bytes.Repeat([]byte("0123456789abcdef"), 12<<20/16)
+
+		It("should let the server send a window past the transport's", func() {
+			written := make(chan string, 2)
+			client := serve(func(w http.ResponseWriter, r *http.Request) {
+				shift, _ := strconv.Atoi(r.URL.Query().Get("shift"))
+				w.Write(body[:len(body)>>shift])
+				w.(http.Flusher).Flush()
+				written <- r.URL.Path
+			})
+
+			// more than the transport's 4MB is written before it's read
+			held := get(client, "/held?shift=0")
+			Eventually(written).Should(Receive(Equal("/held")))
+			// and doesn't hold up other streams
+			small := get(client, "/small?shift=4")
+			Eventually(written).Should(Receive(Equal("/small")))
+			Expect(io.ReadAll(small.Body)).To(HaveLen(len(body) >> 4))
+			Expect(io.ReadAll(held.Body)).To(Equal(body))
+		})
+
+		It("should keep trailers after their stream's held DATA", func() {
+			client := serve(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "X-Sum")
+				w.Write(body)
+				w.Header().Set("X-Sum", r.URL.Path)
+			})
+			// the second's frames pass the first's held trailers, its own
+			// trailers wait for them
+			first, second := get(client, "/first"), get(client, "/second")
+			Expect(io.ReadAll(first.Body)).To(Equal(body))
+			Expect(first.Trailer.Get("X-Sum")).To(Equal("/first"))
+			Expect(io.ReadAll(second.Body)).To(Equal(body))
+			Expect(second.Trailer.Get("X-Sum")).To(Equal("/second"))
+		})
+
+		It("should give the conn window of reset streams back", func() {
+			client := serve(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(body)
+				w.(http.Flusher).Flush()
+				if r.URL.Path == "/abort" {
+					panic(http.ErrAbortHandler)
+				}
+			})
+			// 12MB a time, past the conn's 4 windows if any was kept
+			for i := 0; i < 8; i++ {
+				resp := get(client, "/abort")
+				time.Sleep(10 * time.Millisecond)
+				resp.Body.Close()
+				resp = get(client, "/close")
+				time.Sleep(10 * time.Millisecond)
+				resp.Body.Close()
+			}
+			resp := get(client, "/read")
+			defer resp.Body.Close()
+			Expect(io.ReadAll(resp.Body)).To(Equal(body))
+		})
+
+		It("should only wrap when it's more than the transport's", func() {
+			e, _ := NewBDPEstimator(opts)
+			c, peer := net.Pipe()
+			defer peer.Close()
+			Expect(e.WrapTransportConn(c)).To(Equal(c))
+			e.AddSample(1<<30, time.Second, 200*time.Millisecond)
+			conn := e.WrapTransportConn(c)
+			defer conn.Close()
+			Expect(conn).To(BeAssignableToTypeOf(&windowExtendingConn{}))
+		})
+	})
+
+	It("should leave defaults when nil", func() {
+		var e *BDPEstimator
+		s := &http2.Server{}
+		e.ConfigureServer(s)
+		Expect(s.MaxUploadBufferPerStream).To(BeZero())
+	})
+})
+
+// delayedPipe is a net.Pipe with delay each way, like a long link with
+// unlimited bandwidth.
+func delayedPipe(delay time.Duration) (net.Conn, net.Conn) {
+	c1, p1 := net.Pipe()
+	p2, c2 := net.Pipe()
+	forward := func(dst, src net.Conn) {
+		type chunk struct {
+			at   time.Time
+			data []byte
+		}
+		ch := make(chan chunk, 4096)
+		go func() {
+			defer close(ch)
+			for {
+				buf := make([]byte, 32<<10)
+				n, err := src.Read(buf)
+				if err != nil {
+					return
+				}
+				ch <- chunk{time.Now().Add(delay), buf[:n]}
+			}
+		}()
+		go func() {
+			defer dst.Close()
+			for c := range ch {
+				time.Sleep(time.Until(c.at))
+				if _, err := dst.Write(c.data); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	forward(p2, p1)
+	forward(p1, p2)
+	return c1, c2
+}
+
+func benchmarkH2Upload(b *testing.B, bdp *BDPEstimator) {
+	const size = 8 << 20
+	cc, sc := delayedPipe(25 * time.Millisecond)
+	server := &http2.Server{}
+	bdp.ConfigureServer(server)
+	go server.ServeConn(sc, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+		}),
+	})
+	tr := &http2.Transport{}
+	bdp.ConfigureTransport(tr)
+	client, err := tr.NewClientConn(cc)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	body := make([]byte, size)
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "https://example.com/", bytes.NewReader(body))
+		resp, err := client.RoundTrip(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func benchmarkH2Download(b *testing.B, bdp *BDPEstimator) {
+	const size = 16 << 20
+	cc, sc := delayedPipe(25 * time.Millisecond)
+	body := make([]byte, size)
+	go (&http2.Server{}).ServeConn(sc, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(body)
+		}),
+	})
+	tr := &http2.Transport{}
+	bdp.ConfigureTransport(tr)
+	client, err := tr.NewClientConn(bdp.WrapTransportConn(cc))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		resp, err := client.RoundTrip(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func BenchmarkH2DownloadDefaultWindow(b *testing.B) {
+	benchmarkH2Download(b, nil)
+}
+
+func BenchmarkH2DownloadTunedWindow(b *testing.B) {
+	bdp, _ := NewBDPEstimator(BDPOptions{MinWindow: DefaultMinWindow, MaxWindow: DefaultMaxWindow})
+	// a 50ms link that moved 200MB/s
+	bdp.AddSample(200<<20, time.Second, 50*time.Millisecond)
+	benchmarkH2Download(b, bdp)
+}
+
+func BenchmarkH2UploadDefaultWindow(b *testing.B) {
+	benchmarkH2Upload(b, nil)
+}
+
+func BenchmarkH2UploadTunedWindow(b *testing.B) {
+	bdp, _ := NewBDPEstimator(BDPOptions{MinWindow: DefaultMinWindow, MaxWindow: DefaultMaxWindow})
+	// a 50ms link that moved 200MB/s
+	bdp.AddSample(200<<20, time.Second, 50*time.Millisecond)
+	benchmarkH2Upload(b, bdp)
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kelindar/binary"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	clientHelloHintsKey = "client_hello_hints"
+
+	// carries ClientHelloHints from the client relay to the server, since
+	// one relay conn is shared by many browser connections
+	ClientHelloHeader = "X-Proxy-Client-Hello"
+)
+
+var (
+	errClientHelloCaptured = errors.New("client hello captured")
+)
+
+// ClientHelloHints are the parts of the browser's ClientHello that affect
+// how the server should talk to the origin.
+type ClientHelloHints struct {
+	ServerName        string
+	ALPN              []string
+	SupportedGroups   []uint16
+	SupportedVersions []uint16
+}
+
+func (h *ClientHelloHints) IsEmpty() bool {
+	return h == nil || (h.ServerName == "" && len(h.ALPN) == 0)
+}
+
+// OffersH2 reports whether the browser offered h2 in ALPN.
+func (h *ClientHelloHints) OffersH2() bool {
+	return slices.Contains(h.ALPN, "h2")
+}
+
+// Encode serializes the hints for ClientHelloHeader.
+func (h *ClientHelloHints) Encode() (string, error) {
+	buf, err := binary.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func DecodeClientHelloHints(s string) (*ClientHelloHints, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var h ClientHelloHints
+	if err := binary.Unmarshal(buf, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func WithClientHelloHints(ctx context.Context, hints *ClientHelloHints) context.Context {
+	return context.WithValue(ctx, clientHelloHintsKey, hints)
+}
+
+func GetClientHelloHints(ctx context.Context) (*ClientHelloHints, bool) {
+	return GetValueFromContext[*ClientHelloHints](ctx, clientHelloHintsKey)
+}
+
+// ClientHelloHintsFor returns the hints in ctx if the browser sent them to
+// host. A browser conn may carry requests for other hosts, coalesced or
+// unsafe ones, and requests made on behalf of a document, e.g. prefetches,
+// may be for other origins, none of those got its ClientHello.
+func ClientHelloHintsFor(ctx context.Context, host string) (*ClientHelloHints, bool) {
+	hints, ok := GetClientHelloHints(ctx)
+	if !ok || hints == nil || !strings.EqualFold(hints.ServerName, host) {
+		return nil, false
+	}
+	return hints, true
+}
+
+// WithoutClientHelloHints returns ctx without the hints, for requests
+// derived from a browser's that it didn't send.
+func WithoutClientHelloHints(ctx context.Context) context.Context {
+	return context.WithValue(ctx, clientHelloHintsKey, nil)
+}
+
+// ParseClientHello parses a TLS ClientHello record by feeding it to
+// crypto/tls and bailing out once GetConfigForClient sees the hello.
+func ParseClientHello(record []byte) (*ClientHelloHints, error) {
+	var hints *ClientHelloHints
+	conn := &readOnlyConn{r: bytes.NewReader(record)}
+	err := tls.Server(conn, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			hints = &ClientHelloHints{
+				ServerName:        hello.ServerName,
+				ALPN:              slices.Clone(hello.SupportedProtos),
+				SupportedVersions: slices.Clone(hello.SupportedVersions),
+			}
+			for _, curve := range hello.SupportedCurves {
+				hints.SupportedGroups = append(hints.SupportedGroups, uint16(curve))
+			}
+			return nil, errClientHelloCaptured
+		},
+	}).Handshake()
+	if hints == nil {
+		return nil, err
+	}
+	return hints, nil
+}
+
+// readOnlyConn lets crypto/tls read a recorded handshake and drops
+// whatever it tries to write back.
+type readOnlyConn struct {
+	r *bytes.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(_ time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(_ time.Time) error { return nil }
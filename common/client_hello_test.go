@@ -0,0 +1,75 @@
+package common
+
+import (
+	"crypto/tls"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ClientHello", func() {
+	recordClientHello := func(cfg *tls.Config) []byte {
+		cc, sc := net.Pipe()
+		defer sc.Close()
+		go func() {
+			tls.Client(cc, cfg).Handshake()
+		}()
+
+		// record header, then the rest of the record
+		buf := make([]byte, 5)
+		_, err := sc.Read(buf)
+		Expect(err).To(BeNil())
+		recordLen := int(buf[3])<<8 | int(buf[4])
+		body := make([]byte, recordLen)
+		for n := 0; n < recordLen; {
+			m, err := sc.Read(body[n:])
+			Expect(err).To(BeNil())
+			n += m
+		}
+		cc.Close()
+		return append(buf, body...)
+	}
+
+	It("should parse SNI and ALPN", func() {
+		record := recordClientHello(&tls.Config{
+			ServerName: "example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		})
+		hints, err := ParseClientHello(record)
+		Expect(err).To(BeNil())
+		Expect(hints.ServerName).To(Equal("example.com"))
+		Expect(hints.ALPN).To(Equal([]string{"h2", "http/1.1"}))
+		Expect(hints.OffersH2()).To(BeTrue())
+		Expect(hints.SupportedGroups).NotTo(BeEmpty())
+	})
+
+	It("should tell h1 only browsers", func() {
+		record := recordClientHello(&tls.Config{
+			ServerName: "example.com",
+			NextProtos: []string{"http/1.1"},
+		})
+		hints, err := ParseClientHello(record)
+		Expect(err).To(BeNil())
+		Expect(hints.OffersH2()).To(BeFalse())
+	})
+
+	It("should round trip through the relay header", func() {
+		record := recordClientHello(&tls.Config{
+			ServerName: "example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		})
+		hints, err := ParseClientHello(record)
+		Expect(err).To(BeNil())
+		s, err := hints.Encode()
+		Expect(err).To(BeNil())
+		decoded, err := DecodeClientHelloHints(s)
+		Expect(err).To(BeNil())
+		Expect(decoded).To(Equal(hints))
+	})
+
+	It("should fail on garbage", func() {
+		_, err := ParseClientHello([]byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n"))
+		Expect(err).NotTo(BeNil())
+	})
+})
@@ -1,6 +1,9 @@
 package common
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 func GetValueFromContext[T any](ctx context.Context, key string) (ret T, ok bool) {
 	v := ctx.Value(key)
@@ -12,3 +15,18 @@ func GetValueFromContext[T any](ctx context.Context, key string) (ret T, ok bool
 	}
 	return
 }
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// DetachContext keeps ctx's values (e.g. tracing spans) but not its
+// cancellation, for work that may outlive the request that started it.
+func DetachContext(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
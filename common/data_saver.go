@@ -0,0 +1,283 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"runtime"
+	"strconv"
+)
+
+const (
+	// "off" makes the server relay the original image, e.g. for a page
+	// where quality matters, the origin never sees it
+	DataSaverHeader = "X-Proxy-Data-Saver"
+
+	// smaller images aren't worth decoding
+	minDataSaverLength = 32 << 10
+	// larger ones are relayed as is instead of being held in memory
+	maxDataSaverLength = 16 << 20
+	// and so are those decoding to more pixels, a few KB of PNG can claim
+	// gigapixels
+	maxDataSaverPixels = 16 << 20
+)
+
+// DataSaver re-encodes large JPEG/PNG responses at reduced quality for
+// metered links, re-encoding also drops EXIF and other metadata so JPEGs
+// that need rotating and images with a color profile are left alone. A nil
+// *DataSaver is disabled.
+type DataSaver struct {
+	// JPEG quality per host
+	rules *HostRules[int]
+	// a slot per image being decoded, each holds tens of MB
+	decodes chan struct{}
+}
+
+// NewDataSaver parses "pattern=quality" rules, e.g. "*.example.com=85,*=60",
+// nil if rules is empty.
+func NewDataSaver(rules string) (*DataSaver, error) {
+	if rules == "" {
+		return nil, nil
+	}
+	hostRules, err := ParseHostRules(rules, func(s string) (int, error) {
+		quality, err := strconv.Atoi(s)
+		if err != nil || quality < 1 || quality > 100 {
+			return 0, fmt.Errorf("invalid data saver quality: %s", s)
+		}
+		return quality, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DataSaver{
+		rules:   hostRules,
+		decodes: make(chan struct{}, runtime.GOMAXPROCS(0)),
+	}, nil
+}
+
+// Quality removes the bypass header from r and returns the JPEG quality
+// to recompress its response at, 0 to leave it alone.
+func (ds *DataSaver) Quality(r *http.Request) int {
+	bypass := r.Header.Get(DataSaverHeader) == "off"
+	r.Header.Del(DataSaverHeader)
+	if ds == nil || bypass {
+		return 0
+	}
+	quality, _ := ds.rules.Lookup(r.URL.Host)
+	return quality
+}
+
+func dataSaverImageType(resp *http.Response) string {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return ""
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minDataSaverLength {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "image/jpeg", "image/png":
+		return mediaType
+	}
+	return ""
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// walkJPEGSegments calls fn with the marker and body of the segments of
+// JPEG b before the scan, until fn returns false.
+func walkJPEGSegments(b []byte, fn func(marker byte, seg []byte) bool) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return
+		}
+		marker := b[i+1]
+		switch marker {
+		case 0xff:
+			// fill byte
+			i++
+			continue
+		case 0xda, 0xd9:
+			// metadata comes before the scan
+			return
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		if length < 2 || i+2+length > len(b) {
+			return
+		}
+		if !fn(marker, b[i+4:i+2+length]) {
+			return
+		}
+		i += 2 + length
+	}
+}
+
+// jpegOrientation returns the EXIF orientation of JPEG b, 1 (upright) if it
+// has none.
+func jpegOrientation(b []byte) int {
+	orientation := 1
+	walkJPEGSegments(b, func(marker byte, seg []byte) bool {
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			orientation = exifOrientation(seg[6:])
+			return false
+		}
+		return true
+	})
+	return orientation
+}
+
+// hasICCProfile tells if image b embeds a color profile, an APP2 segment of
+// a JPEG or an iCCP chunk of a PNG. Re-encoding drops it and e.g. wide
+// gamut photos would show washed out.
+func hasICCProfile(b []byte, mediaType string) bool {
+	found := false
+	switch mediaType {
+	case "image/jpeg":
+		walkJPEGSegments(b, func(marker byte, seg []byte) bool {
+			found = marker == 0xe2 && bytes.HasPrefix(seg, []byte("ICC_PROFILE\x00"))
+			return !found
+		})
+	case "image/png":
+		// it comes before the image data
+		for i := 8; i+8 <= len(b); {
+			length := int(binary.BigEndian.Uint32(b[i:]))
+			switch string(b[i+4 : i+8]) {
+			case "iCCP":
+				return true
+			case "IDAT", "IEND":
+				return false
+			}
+			// the length, type and CRC around the data
+			i += 12 + length
+		}
+	}
+	return found
+}
+
+// exifOrientation returns the orientation tag of IFD0 in tiff, the body
+// of an Exif segment.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int64(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > int64(len(tiff)) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := int(ifd) + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		// a SHORT, stored in the first bytes of the value field
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
+
+// Recompress replaces resp's body with a smaller re-encoding at quality,
+// it leaves resp as is if it's not a large image or nothing is saved.
+func (ds *DataSaver) Recompress(resp *http.Response, quality int) error {
+	mediaType := dataSaverImageType(resp)
+	if quality == 0 || mediaType == "" {
+		return nil
+	}
+
+	orig, err := io.ReadAll(io.LimitReader(resp.Body, maxDataSaverLength+1))
+	if err != nil {
+		return err
+	}
+	if len(orig) > maxDataSaverLength || len(orig) < minDataSaverLength {
+		resp.Body = &readCloser{
+			Reader:  io.MultiReader(bytes.NewReader(orig), resp.Body),
+			closers: []io.Closer{resp.Body},
+		}
+		return nil
+	}
+	// from here on the original is in memory
+	resp.Body = io.NopCloser(bytes.NewReader(orig))
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(orig))
+	if err != nil {
+		return err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxDataSaverPixels {
+		return nil
+	}
+	if mediaType == "image/jpeg" && jpegOrientation(orig) != 1 {
+		return nil
+	}
+	if hasICCProfile(orig, mediaType) {
+		return nil
+	}
+
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+	}
+	// decoded images are large, concurrent ones could exhaust memory
+	select {
+	case ds.decodes <- struct{}{}:
+		defer func() { <-ds.decodes }()
+	case <-ctx.Done():
+		return nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(orig))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	switch {
+	case mediaType == "image/jpeg" || isOpaque(img):
+		// PNG photos without transparency shrink a lot as JPEG
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		mediaType = "image/jpeg"
+	default:
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil {
+		return err
+	}
+	if buf.Len() >= len(orig) {
+		return nil
+	}
+
+	DataSaverBytesSaved.Add(int64(len(orig) - buf.Len()))
+	resp.Body = io.NopCloser(&buf)
+	resp.ContentLength = int64(buf.Len())
+	resp.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	resp.Header.Set("Content-Type", mediaType)
+	resp.Header.Set(DataSaverHeader, strconv.Itoa(len(orig))+"->"+strconv.Itoa(buf.Len()))
+	// the representation changed, the origin's validators don't apply anymore
+	resp.Header.Del("ETag")
+	resp.Header.Del("Last-Modified")
+	resp.Header.Del("Content-MD5")
+	return nil
+}
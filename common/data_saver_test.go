@@ -0,0 +1,186 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DataSaver", func() {
+	// a noisy photo-like image, large enough to be worth recompressing
+	newJPEG := func() []byte {
+		rnd := rand.New(rand.NewSource(1))
+		img := image.NewRGBA(image.Rect(0, 0, 512, 512))
+		for y := 0; y < 512; y++ {
+			for x := 0; x < 512; x++ {
+				img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(rnd.Intn(256)), 0xff})
+			}
+		}
+		var buf bytes.Buffer
+		Expect(jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100})).To(BeNil())
+		return buf.Bytes()
+	}
+
+	newResponse := func(body []byte, contentType string) *http.Response {
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {contentType}, "Etag": {`"v1"`}},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+		}
+	}
+
+	It("should pick quality by host rules", func() {
+		ds, err := NewDataSaver("*.example.com=85,*=60")
+		Expect(err).To(BeNil())
+		Expect(ds.Quality(httptest.NewRequest(http.MethodGet, "https://img.example.com/a.jpg", nil))).To(Equal(85))
+		Expect(ds.Quality(httptest.NewRequest(http.MethodGet, "https://foo.com/a.jpg", nil))).To(Equal(60))
+	})
+
+	It("should be bypassed by request header", func() {
+		ds, _ := NewDataSaver("*=60")
+		r := httptest.NewRequest(http.MethodGet, "https://foo.com/a.jpg", nil)
+		r.Header.Set(DataSaverHeader, "off")
+		Expect(ds.Quality(r)).To(BeZero())
+		Expect(r.Header.Get(DataSaverHeader)).To(BeEmpty())
+	})
+
+	It("should be disabled without rules", func() {
+		ds, err := NewDataSaver("")
+		Expect(err).To(BeNil())
+		Expect(ds.Quality(httptest.NewRequest(http.MethodGet, "https://foo.com/a.jpg", nil))).To(BeZero())
+		_, err = NewDataSaver("*=101")
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should recompress large jpegs", func() {
+		ds, _ := NewDataSaver("*=40")
+		orig := newJPEG()
+		resp := newResponse(orig, "image/jpeg")
+		Expect(ds.Recompress(resp, 40)).To(BeNil())
+
+		buf, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(len(buf)).To(BeNumerically("<", len(orig)))
+		Expect(resp.ContentLength).To(Equal(int64(len(buf))))
+		Expect(resp.Header.Get("Content-Length")).To(Equal(strconv.Itoa(len(buf))))
+		Expect(resp.Header.Get("Etag")).To(BeEmpty())
+		_, err = jpeg.Decode(bytes.NewReader(buf))
+		Expect(err).To(BeNil())
+	})
+
+	It("should leave rotated jpegs alone", func() {
+		// an Exif segment with orientation 6, rotate 90° clockwise
+		exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" +
+			"\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00" +
+			"\x00\x00\x00\x00")
+		app1 := append([]byte{0xff, 0xe1, 0, byte(2 + len(exif))}, exif...)
+		jpg := newJPEG()
+		rotated := append(append(append([]byte{}, jpg[:2]...), app1...), jpg[2:]...)
+		Expect(jpegOrientation(rotated)).To(Equal(6))
+		Expect(jpegOrientation(jpg)).To(Equal(1))
+
+		ds, _ := NewDataSaver("*=40")
+		resp := newResponse(rotated, "image/jpeg")
+		Expect(ds.Recompress(resp, 40)).To(BeNil())
+		buf, _ := io.ReadAll(resp.Body)
+		Expect(buf).To(Equal(rotated))
+	})
+
+	It("should leave images with a color profile alone", func() {
+		icc := append([]byte("ICC_PROFILE\x00\x01\x01"), make([]byte, 128)...)
+		app2 := append([]byte{0xff, 0xe2, 0, byte(2 + len(icc))}, icc...)
+		jpg := newJPEG()
+		profiled := append(append(append([]byte{}, jpg[:2]...), app2...), jpg[2:]...)
+		Expect(hasICCProfile(profiled, "image/jpeg")).To(BeTrue())
+		Expect(hasICCProfile(jpg, "image/jpeg")).To(BeFalse())
+
+		ds, _ := NewDataSaver("*=40")
+		resp := newResponse(profiled, "image/jpeg")
+		Expect(ds.Recompress(resp, 40)).To(BeNil())
+		buf, _ := io.ReadAll(resp.Body)
+		Expect(buf).To(Equal(profiled))
+
+		var pngBuf bytes.Buffer
+		Expect(png.Encode(&pngBuf, image.NewGray(image.Rect(0, 0, 8, 8)))).To(BeNil())
+		plain := pngBuf.Bytes()
+		// after the signature and IHDR
+		iccp := []byte("\x00\x00\x00\x04iCCPsRGB\x00\x00\x00\x00")
+		withICCP := append(append(append([]byte{}, plain[:33]...), iccp...), plain[33:]...)
+		Expect(hasICCProfile(withICCP, "image/png")).To(BeTrue())
+		Expect(hasICCProfile(plain, "image/png")).To(BeFalse())
+	})
+
+	It("should bound concurrent decodes", func() {
+		ds, _ := NewDataSaver("*=40")
+		for i := 0; i < cap(ds.decodes); i++ {
+			ds.decodes <- struct{}{}
+		}
+		orig := newJPEG()
+		ctx, cancel := context.WithCancel(context.Background())
+		resp := newResponse(orig, "image/jpeg")
+		resp.Request = httptest.NewRequest(http.MethodGet, "https://foo.com/a.jpg", nil).WithContext(ctx)
+		done := make(chan error)
+		go func() { done <- ds.Recompress(resp, 40) }()
+		Consistently(done).ShouldNot(Receive())
+
+		// relayed as is once the request is gone
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+		buf, _ := io.ReadAll(resp.Body)
+		Expect(buf).To(Equal(orig))
+
+		<-ds.decodes
+		resp = newResponse(orig, "image/jpeg")
+		Expect(ds.Recompress(resp, 40)).To(BeNil())
+		Expect(resp.ContentLength).To(BeNumerically("<", len(orig)))
+		Expect(ds.decodes).To(HaveLen(cap(ds.decodes) - 1))
+	})
+
+	It("should not decode images claiming too many pixels", func() {
+		// a PNG header claiming 100000x100000 pixels, padded to look large
+		ihdr := make([]byte, 4+13)
+		copy(ihdr, "IHDR")
+		binary.BigEndian.PutUint32(ihdr[4:], 100000)
+		binary.BigEndian.PutUint32(ihdr[8:], 100000)
+		ihdr[12], ihdr[13] = 8, 2
+		bomb := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+		bomb = append(bomb, ihdr...)
+		bomb = binary.BigEndian.AppendUint32(bomb, crc32.ChecksumIEEE(ihdr))
+		bomb = append(bomb, make([]byte, 64<<10)...)
+
+		ds, _ := NewDataSaver("*=40")
+		resp := newResponse(bomb, "image/png")
+		Expect(ds.Recompress(resp, 40)).To(BeNil())
+		buf, _ := io.ReadAll(resp.Body)
+		Expect(buf).To(Equal(bomb))
+	})
+
+	It("should leave other responses alone", func() {
+		ds, _ := NewDataSaver("*=40")
+		orig := newJPEG()
+		resp := newResponse(orig, "image/webp")
+		Expect(ds.Recompress(resp, 40)).To(BeNil())
+		buf, _ := io.ReadAll(resp.Body)
+		Expect(buf).To(Equal(orig))
+
+		small := []byte("tiny")
+		resp = newResponse(small, "image/png")
+		Expect(ds.Recompress(resp, 40)).To(BeNil())
+		buf, _ = io.ReadAll(resp.Body)
+		Expect(buf).To(Equal(small))
+	})
+})
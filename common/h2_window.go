@@ -0,0 +1,361 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	h2FrameHeaderLen = 9
+
+	// x/net's transport advertises these and can't be told otherwise
+	transportStreamWindow = 4 << 20
+	transportConnWindow   = 1 << 30
+)
+
+var errWindowConnClosed = errors.New("window extending conn closed")
+
+// windowExtendingConn sits between an x/net h2 transport and its conn and
+// advertises a stream window of window to the server instead of the
+// transport's fixed one. DATA the server sends past what the transport
+// granted is held here, in order per stream, and handed over as the
+// transport's WINDOW_UPDATEs grant it, which are passed on as they are. So
+// the server may have window bytes in flight per stream, up to 4x that on
+// the conn, and the transport never sees more than it allowed.
+type windowExtendingConn struct {
+	net.Conn
+	window int64
+
+	wmu sync.Mutex
+	// written by the transport, not yet a whole frame
+	wbuf    []byte
+	preface int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// what the transport may read
+	out []byte
+	err error
+	// the transport's stream window, what it'd accept
+	initial int64
+	credit  map[uint32]int64
+	held    map[uint32][][]byte
+	// once a header block is held behind its stream's DATA, the frames
+	// after it wait too: HPACK state depends on the order of header blocks,
+	// only DATA of streams with nothing waiting passes
+	stalledOn      uint32
+	stalled        [][]byte
+	stalledStreams map[uint32]bool
+	// streams the transport reset, their DATA is dropped here
+	reset map[uint32]bool
+	// conn window of DATA dropped here, the transport never got to give it
+	// back
+	dropped int
+}
+
+func newWindowExtendingConn(conn net.Conn, window int32) *windowExtendingConn {
+	c := &windowExtendingConn{
+		Conn:    conn,
+		window:  int64(window),
+		preface: len(http2.ClientPreface),
+		initial: 65535,
+		credit:  make(map[uint32]int64),
+		held:    make(map[uint32][][]byte),
+		reset:   make(map[uint32]bool),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.readLoop()
+	return c
+}
+
+func (c *windowExtendingConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.out) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(c.out) == 0 {
+		return 0, c.err
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// Write passes on whole frames only, so frames of the conn's own can go in
+// between.
+func (c *windowExtendingConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf, p...)
+	n := c.preface
+	if n > len(c.wbuf) {
+		n = len(c.wbuf)
+	}
+	c.preface -= n
+	for c.preface == 0 && len(c.wbuf)-n >= h2FrameHeaderLen {
+		length := int(c.wbuf[n])<<16 | int(c.wbuf[n+1])<<8 | int(c.wbuf[n+2])
+		if len(c.wbuf)-n < h2FrameHeaderLen+length {
+			break
+		}
+		c.sent(c.wbuf[n : n+h2FrameHeaderLen+length])
+		n += h2FrameHeaderLen + length
+	}
+	frames := c.wbuf[:n]
+	if update := c.takeDropped(); update != nil {
+		frames = append(frames[:n:n], update...)
+	}
+	if len(frames) == 0 {
+		return len(p), nil
+	}
+	_, err := c.Conn.Write(frames)
+	c.wbuf = append(c.wbuf[:0], c.wbuf[n:]...)
+	return len(p), err
+}
+
+// takeDropped returns a WINDOW_UPDATE giving back the conn window of
+// dropped DATA, nil if there's none.
+func (c *windowExtendingConn) takeDropped() []byte {
+	c.mu.Lock()
+	n := c.dropped
+	c.dropped = 0
+	c.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	frame := make([]byte, h2FrameHeaderLen+4)
+	frame[2] = 4
+	frame[3] = byte(http2.FrameWindowUpdate)
+	binary.BigEndian.PutUint32(frame[h2FrameHeaderLen:], uint32(n))
+	return frame
+}
+
+func (c *windowExtendingConn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = errWindowConnClosed
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// reads are served from what the read loop buffered
+func (c *windowExtendingConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *windowExtendingConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// sent looks at frame the transport is sending, it may rewrite it in
+// place.
+func (c *windowExtendingConn) sent(frame []byte) {
+	typ, flags := http2.FrameType(frame[3]), http2.Flags(frame[4])
+	streamID := binary.BigEndian.Uint32(frame[5:9]) & (1<<31 - 1)
+	payload := frame[h2FrameHeaderLen:]
+	switch {
+	case typ == http2.FrameSettings && !flags.Has(http2.FlagSettingsAck):
+		for i := 0; i+6 <= len(payload); i += 6 {
+			if http2.SettingID(binary.BigEndian.Uint16(payload[i:])) != http2.SettingInitialWindowSize {
+				continue
+			}
+			c.mu.Lock()
+			c.initial = int64(binary.BigEndian.Uint32(payload[i+2:]))
+			c.mu.Unlock()
+			binary.BigEndian.PutUint32(payload[i+2:], uint32(c.window))
+		}
+	case typ == http2.FrameWindowUpdate && len(payload) == 4:
+		inc := binary.BigEndian.Uint32(payload) & (1<<31 - 1)
+		if streamID == 0 {
+			// the transport's first one opens its conn window to 1GB, the
+			// server gets 4 stream windows
+			if inc == transportConnWindow {
+				conn := 4 * c.window
+				if conn > math.MaxInt32 {
+					conn = math.MaxInt32
+				}
+				binary.BigEndian.PutUint32(payload, uint32(conn-65535))
+			}
+			return
+		}
+		c.mu.Lock()
+		c.credit[streamID] = c.creditLocked(streamID) + int64(inc)
+		c.releaseLocked(streamID)
+		c.mu.Unlock()
+	case typ == http2.FrameRSTStream:
+		// the transport still checks the stream's window until it forgets
+		// the stream, which is after the RST is written, so what's held or
+		// still coming is dropped here instead
+		c.mu.Lock()
+		if _, open := c.credit[streamID]; open {
+			c.reset[streamID] = true
+			for _, f := range c.held[streamID] {
+				c.receivedByResetLocked(streamID, f)
+			}
+			delete(c.held, streamID)
+			delete(c.credit, streamID)
+			c.unstallLocked(streamID)
+			c.cond.Broadcast()
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *windowExtendingConn) creditLocked(streamID uint32) int64 {
+	if credit, ok := c.credit[streamID]; ok {
+		return credit
+	}
+	return c.initial
+}
+
+func (c *windowExtendingConn) readLoop() {
+	var err error
+	header := make([]byte, h2FrameHeaderLen)
+	for {
+		if _, err = io.ReadFull(c.Conn, header); err != nil {
+			break
+		}
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		frame := make([]byte, h2FrameHeaderLen+length)
+		copy(frame, header)
+		if _, err = io.ReadFull(c.Conn, frame[h2FrameHeaderLen:]); err != nil {
+			break
+		}
+		c.mu.Lock()
+		c.receivedLocked(frame)
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		if update := c.takeDropped(); update != nil {
+			c.wmu.Lock()
+			_, err = c.Conn.Write(update)
+			c.wmu.Unlock()
+		}
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// receivedLocked hands frame to the transport, or holds it.
+func (c *windowExtendingConn) receivedLocked(frame []byte) {
+	typ := http2.FrameType(frame[3])
+	streamID := binary.BigEndian.Uint32(frame[5:9]) & (1<<31 - 1)
+	if c.stalledOn != 0 && (typ != http2.FrameData || c.stalledStreams[streamID]) {
+		c.stalled = append(c.stalled, frame)
+		c.stalledStreams[streamID] = true
+		return
+	}
+	held := c.held[streamID]
+	switch {
+	case streamID == 0:
+	case c.reset[streamID]:
+		c.receivedByResetLocked(streamID, frame)
+		return
+	case typ == http2.FrameRSTStream:
+		for _, f := range held {
+			if http2.FrameType(f[3]) == http2.FrameData {
+				c.dropped += len(f) - h2FrameHeaderLen
+			}
+		}
+		delete(c.held, streamID)
+		delete(c.credit, streamID)
+		c.out = append(c.out, frame...)
+		c.unstallLocked(streamID)
+		return
+	case typ == http2.FrameData && len(held) == 0:
+		length := int64(len(frame) - h2FrameHeaderLen)
+		if credit := c.creditLocked(streamID); credit >= length {
+			c.credit[streamID] = credit - length
+			c.deliverLocked(streamID, frame)
+			return
+		}
+		c.held[streamID] = append(held, frame)
+		return
+	case len(held) > 0:
+		c.held[streamID] = append(held, frame)
+		if typ != http2.FrameData {
+			c.stalledOn = streamID
+			c.stalledStreams = map[uint32]bool{streamID: true}
+		}
+		return
+	}
+	c.deliverLocked(streamID, frame)
+}
+
+// receivedByResetLocked drops DATA of a stream the transport reset, other
+// frames still go to it for their header blocks.
+func (c *windowExtendingConn) receivedByResetLocked(streamID uint32, frame []byte) {
+	typ := http2.FrameType(frame[3])
+	if typ == http2.FrameData {
+		c.dropped += len(frame) - h2FrameHeaderLen
+	} else {
+		c.out = append(c.out, frame...)
+	}
+	if typ == http2.FrameRSTStream || http2.Flags(frame[4]).Has(http2.FlagDataEndStream) && (typ == http2.FrameData || typ == http2.FrameHeaders) {
+		delete(c.reset, streamID)
+	}
+}
+
+func (c *windowExtendingConn) deliverLocked(streamID uint32, frame []byte) {
+	c.out = append(c.out, frame...)
+	typ := http2.FrameType(frame[3])
+	// both flags are 0x1, a stream has credit while it's open
+	switch {
+	case (typ == http2.FrameData || typ == http2.FrameHeaders) && http2.Flags(frame[4]).Has(http2.FlagDataEndStream):
+		delete(c.credit, streamID)
+	case typ == http2.FrameHeaders:
+		if _, ok := c.credit[streamID]; !ok {
+			c.credit[streamID] = c.initial
+		}
+	}
+}
+
+// releaseLocked hands what the transport now accepts of streamID's held
+// frames to it.
+func (c *windowExtendingConn) releaseLocked(streamID uint32) {
+	held := c.held[streamID]
+	for len(held) > 0 {
+		frame := held[0]
+		if http2.FrameType(frame[3]) == http2.FrameData {
+			length := int64(len(frame) - h2FrameHeaderLen)
+			credit := c.creditLocked(streamID)
+			if credit < length {
+				break
+			}
+			c.credit[streamID] = credit - length
+		}
+		c.deliverLocked(streamID, frame)
+		held = held[1:]
+	}
+	c.cond.Broadcast()
+	if len(held) > 0 {
+		c.held[streamID] = held
+		return
+	}
+	delete(c.held, streamID)
+	c.unstallLocked(streamID)
+}
+
+func (c *windowExtendingConn) unstallLocked(streamID uint32) {
+	if c.stalledOn != streamID {
+		return
+	}
+	stalled := c.stalled
+	c.stalledOn, c.stalled, c.stalledStreams = 0, nil, nil
+	// in order, one may stall again
+	for _, frame := range stalled {
+		c.receivedLocked(frame)
+	}
+}
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostMatcher matches hostnames against a list of patterns, either exact
+// names ("example.com"), wildcard suffixes ("*.example.com") or "*" for
+// any host.
+type HostMatcher struct {
+	any      bool
+	exact    map[string]struct{}
+	suffixes []string
+}
+
+// NewHostMatcher parses a comma separated pattern list, as used by flags.
+func NewHostMatcher(patterns string) *HostMatcher {
+	m := &HostMatcher{
+		exact: make(map[string]struct{}),
+	}
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			m.any = true
+		} else if strings.HasPrefix(p, "*.") {
+			m.suffixes = append(m.suffixes, p[1:])
+		} else {
+			m.exact[p] = struct{}{}
+		}
+	}
+	return m
+}
+
+// Match reports whether host (with or without port) matches any pattern.
+func (m *HostMatcher) Match(host string) bool {
+	if m == nil {
+		return false
+	}
+	if m.any {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if _, ok := m.exact[host]; ok {
+		return true
+	}
+	for _, suffix := range m.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HostRules maps host patterns to values, the first matching rule wins.
+type HostRules[T any] struct {
+	rules []hostRule[T]
+}
+
+type hostRule[T any] struct {
+	matcher *HostMatcher
+	value   T
+}
+
+// ParseHostRules parses a comma separated "pattern=value" list,
+// e.g. "*.example.com=chrome,foo.com=firefox".
+func ParseHostRules[T any](rules string, parseValue func(string) (T, error)) (*HostRules[T], error) {
+	r := &HostRules[T]{}
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		pattern, valueStr, ok := strings.Cut(rule, "=")
+		if !ok {
+			return nil, fmt.Errorf("host rule %q: missing '='", rule)
+		}
+		value, err := parseValue(strings.TrimSpace(valueStr))
+		if err != nil {
+			return nil, fmt.Errorf("host rule %q: %w", rule, err)
+		}
+		r.rules = append(r.rules, hostRule[T]{
+			matcher: NewHostMatcher(pattern),
+			value:   value,
+		})
+	}
+	return r, nil
+}
+
+func (r *HostRules[T]) Lookup(host string) (ret T, ok bool) {
+	if r == nil {
+		return
+	}
+	for _, rule := range r.rules {
+		if rule.matcher.Match(host) {
+			return rule.value, true
+		}
+	}
+	return
+}
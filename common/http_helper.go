@@ -8,10 +8,17 @@ import (
 	"strings"
 
 	"github.com/google/brotli/go/cbrotli"
+	"github.com/klauspost/compress/zstd"
 	"github.com/nadoo/glider/pkg/pool"
 	"golang.org/x/exp/maps"
 )
 
+const (
+	// set by the client relay for plain http requests, the h2 relay itself
+	// always carries https
+	OriginSchemeHeader = "X-Proxy-Origin-Scheme"
+)
+
 type HTTPRequestDoer interface {
 	Do(req *http.Request) (*http.Response, error)
 	// RoundTrip(req *http.Request) (*http.Response, error)
@@ -24,6 +31,10 @@ func FixRequest(r *http.Request) {
 	// add missing fields in response request
 	r.URL.Host = r.Host
 	r.URL.Scheme = "https"
+	if r.Header.Get(OriginSchemeHeader) == "http" {
+		r.URL.Scheme = "http"
+	}
+	r.Header.Del(OriginSchemeHeader)
 
 	// Don't send any DATA frame if request does not has any content,
 	// which will send END_STREAM in HEADERS instead of DATA frame.
@@ -33,15 +44,14 @@ func FixRequest(r *http.Request) {
 	}
 }
 
-func CopyResponse(w http.ResponseWriter, resp *http.Response) error {
+func CopyResponse(w http.ResponseWriter, resp *http.Response) (int64, error) {
 	// copy headers
 	maps.Copy(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
 
 	buf := pool.GetBuffer(4096)
 	defer pool.PutBuffer(buf)
-	_, err := io.CopyBuffer(w, resp.Body, buf)
-	return err
+	return io.CopyBuffer(w, resp.Body, buf)
 }
 
 func NewHttpClient(tr http.RoundTripper) *http.Client {
@@ -69,6 +79,12 @@ func WrapCompressedReader(r io.Reader, encoding string) (io.ReadCloser, error) {
 	case "br":
 		br := cbrotli.NewReader(r)
 		return br, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("zstd.NewReader failed: %w", err)
+		}
+		return zr.IOReadCloser(), nil
 	default:
 		return nil, fmt.Errorf("content-encoding not support: %s", encoding)
 	}
@@ -0,0 +1,43 @@
+package common
+
+import "expvar"
+
+// Counters exported on the pprof server's /debug/vars.
+var (
+	// requests whose browser went away before the response was relayed
+	CanceledRequests = expvar.NewInt("canceled_requests")
+	// prefetches canceled because the document that spawned them was
+	CanceledPrefetches = expvar.NewInt("canceled_prefetches")
+	// known response bytes that didn't cross the tunnel thanks to cancellation
+	BytesSavedByCancel = expvar.NewInt("bytes_saved_by_cancel")
+	// pushes the client dropped instead of caching, truncated or corrupt
+	DiscardedPushes = expvar.NewInt("discarded_pushes")
+	// pushes the client turned down after their header, client side
+	RejectedPushes = expvar.NewInt("rejected_pushes")
+	// pushes the server aborted on the client's rejection, server side
+	AbortedPushes = expvar.NewInt("aborted_pushes")
+	// response bytes before and after tunnel encoding, server side
+	TunnelUncompressedBytes = expvar.NewInt("tunnel_uncompressed_bytes")
+	TunnelCompressedBytes   = expvar.NewInt("tunnel_compressed_bytes")
+	// image bytes the data saver's recompression didn't send
+	DataSaverBytesSaved = expvar.NewInt("data_saver_bytes_saved")
+	// prefetches the server skipped as the client's cache digest has them
+	SkippedByCacheDigest = expvar.NewInt("skipped_by_cache_digest")
+	// pushes skipped or cut short by their page's byte budget
+	PushesOverBudget = expvar.NewInt("pushes_over_budget")
+	// module graphs whose imports weren't followed further by their page's
+	// module byte budget
+	ModuleGraphsOverBudget = expvar.NewInt("module_graphs_over_budget")
+	// 103 Early Hints written to the browser, or the client on server side
+	EarlyHintsSent = expvar.NewInt("early_hints_sent")
+	// origin conns the server dialed ahead of documents' requests for them
+	Preconnects = expvar.NewInt("preconnects")
+)
+
+// AddBytesSavedByCancel records what's left of a response of contentLength
+// after written bytes were sent, contentLength is -1 if unknown.
+func AddBytesSavedByCancel(contentLength, written int64) {
+	if contentLength > written {
+		BytesSavedByCancel.Add(contentLength - written)
+	}
+}
@@ -0,0 +1,199 @@
+package common
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	smuxHeaderLen = 8
+	smuxCmdFIN    = 1
+	smuxCmdUPD    = 4
+
+	// frames queued under the mux, what's reordered while the link is
+	// congested
+	maxMuxSchedulerQueue = 256 << 10
+)
+
+// MuxScheduler sits under the tunnel conn's smux session and sends the
+// frames it queued of more urgent streams first, so e.g. a push the mux
+// took before doesn't go ahead of a render-blocking response. Streams are
+// of UrgencyDefault unless set, a frame waits at most maxPriorityYield for
+// more urgent ones. Writes that aren't whole smux frames, e.g. of another
+// mux protocol, are sent in order. A nil *MuxScheduler doesn't schedule.
+type MuxScheduler struct {
+	net.Conn
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queues  map[uint32][]muxFrame
+	urgency map[uint32]Urgency
+	queued  int
+	seq     uint64
+	// once a write wasn't a frame
+	inOrder bool
+	err     error
+}
+
+type muxFrame struct {
+	data []byte
+	seq  uint64
+	at   time.Time
+}
+
+func NewMuxScheduler(conn net.Conn) *MuxScheduler {
+	s := &MuxScheduler{
+		Conn:    conn,
+		queues:  make(map[uint32][]muxFrame),
+		urgency: make(map[uint32]Urgency),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.writeLoop()
+	return s
+}
+
+// smuxFrameStream returns the stream of p if it's one whole smux frame,
+// the mux writes them one by one.
+func smuxFrameStream(p []byte) (uint32, bool) {
+	if len(p) < smuxHeaderLen || p[0] < 1 || p[0] > 2 || p[1] > smuxCmdUPD {
+		return 0, false
+	}
+	if smuxHeaderLen+int(binary.LittleEndian.Uint16(p[2:])) != len(p) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(p[4:]), true
+}
+
+// SetUrgency sets the urgency of mux stream conn, it's ignored if conn
+// isn't a smux stream.
+func (s *MuxScheduler) SetUrgency(conn net.Conn, u Urgency) {
+	if s == nil {
+		return
+	}
+	var c any = conn
+	for {
+		if stream, ok := c.(interface{ ID() uint32 }); ok {
+			s.mu.Lock()
+			s.urgency[stream.ID()] = u
+			s.mu.Unlock()
+			return
+		}
+		upstream, ok := c.(interface{ Upstream() any })
+		if !ok {
+			return
+		}
+		c = upstream.Upstream()
+	}
+}
+
+// Write queues p, it blocks while the queue is full.
+func (s *MuxScheduler) Write(p []byte) (int, error) {
+	frame := muxFrame{data: append([]byte(nil), p...), at: time.Now()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.queued >= maxMuxSchedulerQueue && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	sid, ok := smuxFrameStream(p)
+	if !ok {
+		s.inOrder = true
+	}
+	s.seq++
+	frame.seq = s.seq
+	s.queues[sid] = append(s.queues[sid], frame)
+	s.queued += len(p)
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+func (s *MuxScheduler) urgencyLocked(sid uint32) Urgency {
+	if sid == 0 {
+		// the session's own, e.g. keepalives
+		return UrgencyHighest
+	}
+	if u, ok := s.urgency[sid]; ok {
+		return u
+	}
+	return UrgencyDefault
+}
+
+// nextLocked returns the stream whose frame goes next: the oldest of those
+// waiting too long, or else of the most urgent streams.
+func (s *MuxScheduler) nextLocked(now time.Time) uint32 {
+	var (
+		next               uint32
+		nextSeq            uint64
+		nextU              Urgency
+		nextOverdue, found bool
+	)
+	for sid, queue := range s.queues {
+		f := queue[0]
+		overdue := s.inOrder || now.Sub(f.at) >= maxPriorityYield
+		u := s.urgencyLocked(sid)
+		var better bool
+		switch {
+		case !found:
+			better = true
+		case overdue != nextOverdue:
+			better = overdue
+		case !overdue && u != nextU:
+			better = u < nextU
+		default:
+			better = f.seq < nextSeq
+		}
+		if better {
+			next, nextSeq, nextU, nextOverdue, found = sid, f.seq, u, overdue, true
+		}
+	}
+	return next
+}
+
+func (s *MuxScheduler) writeLoop() {
+	for {
+		s.mu.Lock()
+		for s.queued == 0 && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			s.mu.Unlock()
+			return
+		}
+		sid := s.nextLocked(time.Now())
+		queue := s.queues[sid]
+		frame := queue[0]
+		if len(queue) == 1 {
+			delete(s.queues, sid)
+		} else {
+			s.queues[sid] = queue[1:]
+		}
+		s.mu.Unlock()
+
+		_, err := s.Conn.Write(frame.data)
+
+		s.mu.Lock()
+		s.queued -= len(frame.data)
+		if sid != 0 && frame.data[1] == smuxCmdFIN {
+			delete(s.urgency, sid)
+		}
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+func (s *MuxScheduler) Close() error {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = net.ErrClosed
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return s.Conn.Close()
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// smuxStream is a mux stream behind a wrapper, like sing-mux's.
+type smuxStream struct {
+	net.Conn
+	id uint32
+}
+
+func (s *smuxStream) ID() uint32 { return s.id }
+
+type wrappedStream struct {
+	net.Conn
+	upstream any
+}
+
+func (w *wrappedStream) Upstream() any { return w.upstream }
+
+var _ = Describe("MuxScheduler", func() {
+	frame := func(sid uint32, cmd byte, data string) []byte {
+		f := make([]byte, smuxHeaderLen+len(data))
+		f[0], f[1] = 1, cmd
+		binary.LittleEndian.PutUint16(f[2:], uint16(len(data)))
+		binary.LittleEndian.PutUint32(f[4:], sid)
+		copy(f[smuxHeaderLen:], data)
+		return f
+	}
+	// read returns the payloads of the next n frames
+	read := func(conn net.Conn, n int) []string {
+		var payloads []string
+		for i := 0; i < n; i++ {
+			header := make([]byte, smuxHeaderLen)
+			_, err := io.ReadFull(conn, header)
+			Expect(err).To(BeNil())
+			data := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+			_, err = io.ReadFull(conn, data)
+			Expect(err).To(BeNil())
+			payloads = append(payloads, string(data))
+		}
+		return payloads
+	}
+
+	It("should send queued frames of more urgent streams first", func() {
+		c, peer := net.Pipe()
+		defer peer.Close()
+		s := NewMuxScheduler(c)
+		defer s.Close()
+		push := &wrappedStream{upstream: &smuxStream{id: 3}}
+		s.SetUrgency(push, UrgencyBackground)
+
+		// the first is written right away, blocking on the pipe
+		s.Write(frame(3, 2, "push 1"))
+		time.Sleep(10 * time.Millisecond)
+		s.Write(frame(3, 2, "push 2"))
+		s.Write(frame(3, 2, "push 3"))
+		s.Write(frame(5, 2, "css 1"))
+		s.Write(frame(0, 3, ""))
+		s.Write(frame(5, 2, "css 2"))
+		Expect(read(peer, 6)).To(Equal([]string{"push 1", "", "css 1", "css 2", "push 2", "push 3"}))
+	})
+
+	It("should not starve less urgent streams", func() {
+		c, peer := net.Pipe()
+		defer peer.Close()
+		s := NewMuxScheduler(c)
+		defer s.Close()
+		s.SetUrgency(&smuxStream{id: 3}, UrgencyBackground)
+
+		s.Write(frame(5, 2, "css 1"))
+		time.Sleep(10 * time.Millisecond)
+		s.Write(frame(3, 2, "push"))
+		time.Sleep(maxPriorityYield)
+		s.Write(frame(5, 2, "css 2"))
+		Expect(read(peer, 3)).To(Equal([]string{"css 1", "push", "css 2"}))
+	})
+
+	It("should keep the order of what isn't smux", func() {
+		c, peer := net.Pipe()
+		defer peer.Close()
+		s := NewMuxScheduler(c)
+		defer s.Close()
+		s.SetUrgency(&smuxStream{id: 3}, UrgencyBackground)
+
+		go func() {
+			s.Write(frame(3, 2, "a"))
+			s.Write([]byte("yamux"))
+			s.Write(frame(5, 2, "b"))
+		}()
+		buf := make([]byte, 2*(smuxHeaderLen+1)+5)
+		_, err := io.ReadFull(peer, buf)
+		Expect(err).To(BeNil())
+		Expect(string(buf[smuxHeaderLen : smuxHeaderLen+6])).To(Equal("ayamux"))
+	})
+
+	It("should not schedule when nil", func() {
+		var s *MuxScheduler
+		Expect(func() { s.SetUrgency(&smuxStream{id: 3}, UrgencyBackground) }).NotTo(Panic())
+	})
+})
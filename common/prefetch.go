@@ -3,6 +3,7 @@ package common
 import (
 	"net/http"
 	"path/filepath"
+	"strings"
 )
 
 func GetCacheKey(req *http.Request) string {
@@ -14,6 +15,22 @@ func IsRequestCachable(req *http.Request) bool {
 	if !cacheable {
 		return false
 	}
-	ext := filepath.Ext(req.URL.Path)
-	return ext == ".js" || ext == ".css"
+	switch filepath.Ext(req.URL.Path) {
+	case ".js", ".mjs", ".css":
+		return true
+	// pushed for stylesheets' @font-face rules
+	case ".woff", ".woff2", ".ttf", ".otf":
+		return true
+	}
+	return IsImagePath(req.URL.Path)
+}
+
+// IsImagePath reports whether urlPath is of an image the client caches,
+// pushed for <img>, icons and stylesheets' backgrounds.
+func IsImagePath(urlPath string) bool {
+	switch strings.ToLower(filepath.Ext(urlPath)) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico":
+		return true
+	}
+	return false
 }
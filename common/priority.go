@@ -0,0 +1,278 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Urgency is the RFC 9218 urgency of a response, 0 is the most urgent.
+type Urgency int
+
+const (
+	UrgencyHighest Urgency = 0
+	UrgencyDefault Urgency = 3
+	// prefetch pushes, nobody is waiting for them yet
+	UrgencyBackground Urgency = 7
+
+	numUrgencies = 8
+
+	PriorityHeader = "Priority"
+
+	// a less urgent writer waits at most this long for more urgent ones per
+	// write, so it can't starve when e.g. they're blocked on flow control
+	maxPriorityYield = 50 * time.Millisecond
+)
+
+// ParsePriority parses the urgency of a RFC 9218 priority header,
+// e.g. "u=1, i".
+func ParsePriority(value string) (Urgency, bool) {
+	for _, param := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || k != "u" {
+			continue
+		}
+		u, err := strconv.Atoi(v)
+		if err != nil || u < 0 || u >= numUrgencies {
+			return UrgencyDefault, false
+		}
+		return Urgency(u), true
+	}
+	return UrgencyDefault, false
+}
+
+// inferUrgency guesses like Chrome does for requests without a priority
+// header: documents and CSS block rendering, then scripts and fonts, images last.
+func inferUrgency(r *http.Request) Urgency {
+	switch r.Header.Get("Sec-Fetch-Dest") {
+	case "document", "iframe", "style":
+		return UrgencyHighest
+	case "script":
+		return 1
+	case "font":
+		return 2
+	case "image", "video", "audio":
+		return 5
+	}
+	switch strings.ToLower(filepath.Ext(r.URL.Path)) {
+	case ".css":
+		return UrgencyHighest
+	case ".js", ".mjs":
+		return 1
+	case ".woff", ".woff2", ".ttf", ".otf":
+		return 2
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico":
+		return 5
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return UrgencyHighest
+	}
+	return UrgencyDefault
+}
+
+// SetRequestPriority makes sure r carries a priority header across the
+// tunnel, browsers don't always send one and h2 PRIORITY frames are
+// not visible to handlers.
+func SetRequestPriority(r *http.Request) {
+	if _, ok := ParsePriority(r.Header.Get(PriorityHeader)); ok {
+		return
+	}
+	r.Header.Set(PriorityHeader, "u="+strconv.Itoa(int(inferUrgency(r))))
+}
+
+func RequestUrgency(r *http.Request) Urgency {
+	if u, ok := ParsePriority(r.Header.Get(PriorityHeader)); ok {
+		return u
+	}
+	return inferUrgency(r)
+}
+
+// PriorityGate orders writers sharing one congested link, e.g. all the
+// responses and pushes going through a tunnel conn: a writer waits while a
+// more urgent one has data to write. It orders what is handed to the tunnel
+// mux, a MuxScheduler under the mux orders what it queued already. A nil
+// *PriorityGate doesn't gate.
+type PriorityGate struct {
+	mu    sync.Mutex
+	ready [numUrgencies]int
+	// requests in progress, writing or not
+	active  [numUrgencies]int
+	changed chan struct{}
+}
+
+func NewPriorityGate() *PriorityGate {
+	return &PriorityGate{
+		changed: make(chan struct{}),
+	}
+}
+
+// notify wakes up all waiters, must be called with g.mu held.
+func (g *PriorityGate) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+func (g *PriorityGate) moreUrgentReady(u Urgency) bool {
+	for i := Urgency(0); i < u; i++ {
+		if g.ready[i] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire marks a writer of urgency u ready and waits for its turn.
+func (g *PriorityGate) acquire(u Urgency) {
+	timer := time.NewTimer(maxPriorityYield)
+	defer timer.Stop()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ready[u]++
+	for g.moreUrgentReady(u) {
+		changed := g.changed
+		g.mu.Unlock()
+		select {
+		case <-changed:
+			g.mu.Lock()
+		case <-timer.C:
+			g.mu.Lock()
+			return
+		}
+	}
+}
+
+func (g *PriorityGate) release(u Urgency) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ready[u]--
+	g.notify()
+}
+
+// Begin marks a request of urgency u in progress until the returned func
+// is first called, from its arrival on, not only while it writes.
+func (g *PriorityGate) Begin(u Urgency) (end func()) {
+	if g == nil {
+		return func() {}
+	}
+	g.mu.Lock()
+	g.active[u]++
+	g.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			g.active[u]--
+			g.notify()
+			g.mu.Unlock()
+		})
+	}
+}
+
+func (g *PriorityGate) moreUrgentActive(u Urgency) bool {
+	for i := Urgency(0); i < u; i++ {
+		if g.active[i] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// WaitIdle waits up to maxWait for the requests more urgent than u to
+// finish, returning early only if ctx is done.
+func (g *PriorityGate) WaitIdle(ctx context.Context, u Urgency, maxWait time.Duration) error {
+	if g == nil {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	for {
+		g.mu.Lock()
+		busy, changed := g.moreUrgentActive(u), g.changed
+		g.mu.Unlock()
+		if !busy {
+			return ctx.Err()
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ctx.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Writer gates writes to w with urgency u.
+func (g *PriorityGate) Writer(w io.Writer, u Urgency) io.Writer {
+	if g == nil {
+		return w
+	}
+	return &prioritizedWriter{w: w, g: g, u: u}
+}
+
+type prioritizedWriter struct {
+	w io.Writer
+	g *PriorityGate
+	u Urgency
+}
+
+func (pw *prioritizedWriter) Write(p []byte) (int, error) {
+	pw.g.acquire(pw.u)
+	defer pw.g.release(pw.u)
+	return pw.w.Write(p)
+}
+
+// PrioritizedResponseWriter gates a handler's response writes, headers
+// and flushes included.
+type PrioritizedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+	g *PriorityGate
+	u Urgency
+}
+
+func NewPrioritizedResponseWriter(w http.ResponseWriter, g *PriorityGate, u Urgency) *PrioritizedResponseWriter {
+	return &PrioritizedResponseWriter{
+		ResponseWriter: w,
+		w:              g.Writer(w, u),
+		g:              g,
+		u:              u,
+	}
+}
+
+func (w *PrioritizedResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+// WriteHeader is gated as 1xx headers are written right away.
+func (w *PrioritizedResponseWriter) WriteHeader(code int) {
+	if w.g != nil {
+		w.g.acquire(w.u)
+		defer w.g.release(w.u)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush writes the headers if nothing else did, so it's gated too.
+func (w *PrioritizedResponseWriter) Flush() {
+	f, ok := w.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+	if w.g != nil {
+		w.g.acquire(w.u)
+		defer w.g.release(w.u)
+	}
+	f.Flush()
+}
+
+// Unwrap is for http.ResponseController.
+func (w *PrioritizedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
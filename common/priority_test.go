@@ -0,0 +1,130 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Priority", func() {
+	It("should parse RFC 9218 priority header", func() {
+		u, ok := ParsePriority("u=1, i")
+		Expect(ok).To(BeTrue())
+		Expect(u).To(Equal(Urgency(1)))
+
+		_, ok = ParsePriority("i")
+		Expect(ok).To(BeFalse())
+		_, ok = ParsePriority("u=9")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should infer urgency of requests without priority header", func() {
+		css, _ := http.NewRequest(http.MethodGet, "https://example.com/a.css", nil)
+		img, _ := http.NewRequest(http.MethodGet, "https://example.com/a.png", nil)
+		img.Header.Set("Sec-Fetch-Dest", "image")
+		SetRequestPriority(css)
+		SetRequestPriority(img)
+		Expect(RequestUrgency(css)).To(BeNumerically("<", RequestUrgency(img)))
+	})
+
+	It("should keep browser's priority header", func() {
+		r, _ := http.NewRequest(http.MethodGet, "https://example.com/a.png", nil)
+		r.Header.Set(PriorityHeader, "u=0")
+		SetRequestPriority(r)
+		Expect(RequestUrgency(r)).To(Equal(UrgencyHighest))
+	})
+
+	It("should let urgent writers go first", func() {
+		g := NewPriorityGate()
+		var (
+			mu    sync.Mutex
+			order []Urgency
+		)
+		record := func(u Urgency) {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, u)
+		}
+
+		// an urgent writer has data ready, the background one has to wait
+		g.acquire(UrgencyHighest)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			g.Writer(&bytes.Buffer{}, UrgencyBackground).Write([]byte("push"))
+			record(UrgencyBackground)
+		}()
+		time.Sleep(maxPriorityYield / 5)
+		record(UrgencyHighest)
+		g.release(UrgencyHighest)
+
+		<-done
+		Expect(order).To(Equal([]Urgency{UrgencyHighest, UrgencyBackground}))
+	})
+
+	It("should not starve less urgent writers", func() {
+		g := NewPriorityGate()
+		g.acquire(UrgencyHighest)
+		defer g.release(UrgencyHighest)
+
+		start := time.Now()
+		g.Writer(&bytes.Buffer{}, UrgencyBackground).Write([]byte("push"))
+		Expect(time.Since(start)).To(BeNumerically("<", 10*maxPriorityYield))
+	})
+
+	It("should wait for active urgent requests", func() {
+		g := NewPriorityGate()
+		end := g.Begin(UrgencyHighest)
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			end()
+		}()
+
+		start := time.Now()
+		Expect(g.WaitIdle(context.Background(), UrgencyBackground, time.Second)).To(BeNil())
+		Expect(time.Since(start)).To(And(
+			BeNumerically(">=", 20*time.Millisecond),
+			BeNumerically("<", time.Second),
+		))
+		// less urgent requests don't hold anyone up
+		defer g.Begin(UrgencyBackground)()
+		Expect(g.WaitIdle(context.Background(), 1, time.Second)).To(BeNil())
+	})
+
+	It("should gate response headers and flushes", func() {
+		g := NewPriorityGate()
+		g.acquire(UrgencyHighest)
+		rec := httptest.NewRecorder()
+		w := NewPrioritizedResponseWriter(rec, g, UrgencyBackground)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			w.WriteHeader(http.StatusEarlyHints)
+			w.Flush()
+		}()
+		Consistently(done, maxPriorityYield/5).ShouldNot(BeClosed())
+		g.release(UrgencyHighest)
+		Eventually(done).Should(BeClosed())
+		Expect(rec.Flushed).To(BeTrue())
+	})
+
+	It("should not gate without a gate", func() {
+		var g *PriorityGate
+		buf := &bytes.Buffer{}
+		g.Writer(buf, UrgencyBackground).Write([]byte("push"))
+		Expect(buf.String()).To(Equal("push"))
+
+		rec := httptest.NewRecorder()
+		w := NewPrioritizedResponseWriter(rec, g, UrgencyBackground)
+		w.WriteHeader(http.StatusNotFound)
+		w.Flush()
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+	})
+})
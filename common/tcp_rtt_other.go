@@ -0,0 +1,12 @@
+//go:build !linux
+
+package common
+
+import (
+	"net"
+	"time"
+)
+
+func tcpRTT(conn net.Conn) (time.Duration, bool) {
+	return 0, false
+}
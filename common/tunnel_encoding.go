@@ -0,0 +1,199 @@
+package common
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nadoo/glider/pkg/pool"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	// the client relay offers the encodings it can decode, the server answers
+	// with the one it used, the origin never sees either
+	TunnelEncodingHeader = "X-Proxy-Tunnel-Encoding"
+	// Content-Length of the response before tunnel encoding
+	TunnelLengthHeader = "X-Proxy-Tunnel-Length"
+
+	TunnelEncodingZstd = "zstd"
+
+	// not worth a compressor for tiny bodies
+	minTunnelEncodingLength = 1 << 10
+)
+
+var zstdEncoders = sync.Pool{
+	New: func() any {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	},
+}
+
+// NegotiateTunnelEncoding removes the client's offer from r and returns
+// supported if it was offered, "" otherwise.
+func NegotiateTunnelEncoding(r *http.Request, supported string) string {
+	offered := r.Header.Get(TunnelEncodingHeader)
+	r.Header.Del(TunnelEncodingHeader)
+	if supported == "" {
+		return ""
+	}
+	for _, encoding := range strings.Split(offered, ",") {
+		if strings.TrimSpace(encoding) == supported {
+			return supported
+		}
+	}
+	return ""
+}
+
+func isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		// compressors buffer, events must not wait
+		return false
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/x-javascript",
+		"application/xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// isTunnelEncodable reports whether resp is worth compressing over the tunnel,
+// i.e. a not yet compressed body of a text-like type.
+func isTunnelEncodable(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	if resp.StatusCode < http.StatusOK ||
+		resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minTunnelEncodingLength {
+		return false
+	}
+	return isCompressibleType(resp.Header.Get("Content-Type"))
+}
+
+// CopyResponseWithTunnelEncoding is CopyResponse compressing the body with
+// encoding if it's eligible, written counts the uncompressed bytes.
+func CopyResponseWithTunnelEncoding(w http.ResponseWriter, resp *http.Response, encoding string) (written int64, err error) {
+	if encoding != TunnelEncodingZstd || !isTunnelEncodable(resp) {
+		return CopyResponse(w, resp)
+	}
+
+	maps.Copy(w.Header(), resp.Header)
+	w.Header().Del("Content-Length")
+	if resp.ContentLength >= 0 {
+		w.Header().Set(TunnelLengthHeader, strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.Header().Set(TunnelEncodingHeader, encoding)
+	w.WriteHeader(resp.StatusCode)
+
+	cw := &countingWriter{w: w}
+	enc := zstdEncoders.Get().(*zstd.Encoder)
+	defer zstdEncoders.Put(enc)
+	enc.Reset(cw)
+
+	buf := pool.GetBuffer(32 << 10)
+	defer pool.PutBuffer(buf)
+	flusher, _ := w.(http.Flusher)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err = enc.Write(buf[:n]); err != nil {
+				break
+			}
+			written += int64(n)
+			// the origin may pause, e.g. streaming a page or events, what
+			// it sent so far must not wait in the encoder
+			if err = enc.Flush(); err != nil {
+				break
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+	}
+	if closeErr := enc.Close(); err == nil {
+		err = closeErr
+	}
+	TunnelUncompressedBytes.Add(written)
+	TunnelCompressedBytes.Add(cw.n)
+	return written, err
+}
+
+// DecodeTunnelEncoding undoes the server's tunnel encoding of resp, client
+// side.
+func DecodeTunnelEncoding(resp *http.Response) error {
+	encoding := resp.Header.Get(TunnelEncodingHeader)
+	if encoding == "" {
+		return nil
+	}
+	resp.Header.Del(TunnelEncodingHeader)
+
+	body, err := WrapCompressedReader(resp.Body, encoding)
+	if err != nil {
+		return err
+	}
+	resp.Body = &readCloser{Reader: body, closers: []io.Closer{body, resp.Body}}
+
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	if s := resp.Header.Get(TunnelLengthHeader); s != "" {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			resp.ContentLength = n
+			resp.Header.Set("Content-Length", s)
+		}
+		resp.Header.Del(TunnelLengthHeader)
+	}
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	var err error
+	for _, c := range rc.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
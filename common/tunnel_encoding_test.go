@@ -0,0 +1,105 @@
+package common
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TunnelEncoding", func() {
+	body := strings.Repeat(`{"hello": "world"}`, 1000)
+
+	newResponse := func(contentType string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Content-Type": {contentType}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}
+	}
+
+	relay := func(resp *http.Response) *http.Response {
+		rec := httptest.NewRecorder()
+		n, err := CopyResponseWithTunnelEncoding(rec, resp, TunnelEncodingZstd)
+		Expect(err).To(BeNil())
+		Expect(n).To(Equal(int64(len(body))))
+		relayed := rec.Result()
+		relayed.ContentLength = -1
+		return relayed
+	}
+
+	It("should negotiate offered encodings only", func() {
+		r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		r.Header.Set(TunnelEncodingHeader, "br, zstd")
+		Expect(NegotiateTunnelEncoding(r, TunnelEncodingZstd)).To(Equal(TunnelEncodingZstd))
+		Expect(r.Header.Get(TunnelEncodingHeader)).To(BeEmpty())
+
+		r.Header.Set(TunnelEncodingHeader, "br")
+		Expect(NegotiateTunnelEncoding(r, TunnelEncodingZstd)).To(BeEmpty())
+		Expect(NegotiateTunnelEncoding(r, "")).To(BeEmpty())
+	})
+
+	It("should compress and restore text responses", func() {
+		resp := relay(newResponse("application/json; charset=utf-8"))
+		Expect(resp.Header.Get(TunnelEncodingHeader)).To(Equal(TunnelEncodingZstd))
+
+		Expect(DecodeTunnelEncoding(resp)).To(BeNil())
+		buf, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resp.Body.Close()).To(BeNil())
+		Expect(string(buf)).To(Equal(body))
+		Expect(resp.ContentLength).To(Equal(int64(len(body))))
+		Expect(resp.Header.Get(TunnelEncodingHeader)).To(BeEmpty())
+		Expect(resp.Header.Get(TunnelLengthHeader)).To(BeEmpty())
+	})
+
+	It("should send what the origin sent before it pauses", func() {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		resp := newResponse("text/html")
+		resp.Body = pr
+		resp.ContentLength = -1
+
+		out, in := io.Pipe()
+		w := &pipeResponseWriter{header: make(http.Header), w: in}
+		go CopyResponseWithTunnelEncoding(w, resp, TunnelEncodingZstd)
+
+		// the rest of the page never comes, the first chunk must be readable
+		go pw.Write([]byte(body))
+		dec, err := WrapCompressedReader(out, TunnelEncodingZstd)
+		Expect(err).To(BeNil())
+		defer dec.Close()
+		got := make([]byte, len(body))
+		_, err = io.ReadFull(dec, got)
+		Expect(err).To(BeNil())
+		Expect(string(got)).To(Equal(body))
+	})
+
+	It("should leave images and encoded responses alone", func() {
+		resp := relay(newResponse("image/png"))
+		Expect(resp.Header.Get(TunnelEncodingHeader)).To(BeEmpty())
+
+		encoded := newResponse("text/html")
+		encoded.Header.Set("Content-Encoding", "br")
+		resp = relay(encoded)
+		Expect(resp.Header.Get(TunnelEncodingHeader)).To(BeEmpty())
+	})
+})
+
+// pipeResponseWriter streams the body to w as it's written.
+type pipeResponseWriter struct {
+	header http.Header
+	w      io.Writer
+}
+
+func (w *pipeResponseWriter) Header() http.Header { return w.header }
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) { return w.w.Write(p) }
+
+func (w *pipeResponseWriter) WriteHeader(int) {}
@@ -0,0 +1,225 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// use the ClientHello of the browser who sent the request, by User-Agent
+	UTLSProfileAuto = "auto"
+
+	utlsHelloIDKey = "utls_hello_id"
+
+	// a conn negotiated as http/1.1 waits this long for the h1 transport
+	parkedConnTTL = 10 * time.Second
+)
+
+var (
+	utlsProfiles = map[string]utls.ClientHelloID{
+		"chrome":     utls.HelloChrome_Auto,
+		"firefox":    utls.HelloFirefox_Auto,
+		"edge":       utls.HelloEdge_Auto,
+		"safari":     utls.HelloSafari_Auto,
+		"ios":        utls.HelloIOS_Auto,
+		"randomized": utls.HelloRandomized,
+	}
+
+	errALPNNotH2 = errors.New("utls: ALPN did not pick h2")
+)
+
+// ParseUTLSProfile validates a profile name used in --utls-profiles.
+func ParseUTLSProfile(name string) (string, error) {
+	name = strings.ToLower(name)
+	if name == UTLSProfileAuto {
+		return name, nil
+	}
+	if _, ok := utlsProfiles[name]; !ok {
+		return "", fmt.Errorf("unknown utls profile: %s", name)
+	}
+	return name, nil
+}
+
+// helloIDFromUserAgent guesses the downstream browser's ClientHello.
+func helloIDFromUserAgent(ua string) utls.ClientHelloID {
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		return utls.HelloEdge_Auto
+	case strings.Contains(ua, "Firefox/"):
+		return utls.HelloFirefox_Auto
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "Chromium/"):
+		return utls.HelloChrome_Auto
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		return utls.HelloIOS_Auto
+	case strings.Contains(ua, "Safari/"):
+		return utls.HelloSafari_Auto
+	default:
+		return utls.HelloChrome_Auto
+	}
+}
+
+// WithUTLSProfile attaches the ClientHello to use for req's upstream dial.
+func WithUTLSProfile(req *http.Request, profile string) *http.Request {
+	helloID, ok := utlsProfiles[profile]
+	if !ok {
+		helloID = helloIDFromUserAgent(req.Header.Get("User-Agent"))
+	}
+	return req.WithContext(context.WithValue(req.Context(), utlsHelloIDKey, helloID))
+}
+
+// uTLSTransport dials origins with a browser-like TLS fingerprint. Like
+// AutoFallbackClient it lets ALPN pick the protocol: the first dial goes
+// through the h2 transport, and if the origin picked http/1.1 the conn is
+// parked and handed to the h1 transport instead of being thrown away.
+type uTLSTransport struct {
+	dialContext DialContextFunc
+	verifyPeer  func(serverName string, certs []*x509.Certificate) error
+
+	h1 *http.Transport
+	h2 *http2.Transport
+
+	// addr -> struct{}, origins whose ALPN picked http/1.1
+	h1Addrs *TTLCache
+
+	// conns dialed by h2 but negotiated as http/1.1, closed if the h1
+	// transport doesn't take them within parkTTL
+	mu      sync.Mutex
+	parked  map[string]*parkedConn
+	parkTTL time.Duration
+}
+
+type parkedConn struct {
+	net.Conn
+	timer *time.Timer
+}
+
+func newUTLSTransport(dialContext DialContextFunc, verifyPeer func(string, []*x509.Certificate) error) *uTLSTransport {
+	t := &uTLSTransport{
+		dialContext: dialContext,
+		verifyPeer:  verifyPeer,
+		h1Addrs:     NewTTLCache(h1FallbackTTL, time.Minute),
+		parked:      make(map[string]*parkedConn),
+		parkTTL:     parkedConnTTL,
+	}
+	t.h1 = &http.Transport{
+		ReadBufferSize: 1 << 16,
+		DialTLSContext: t.dialH1,
+	}
+	t.h2 = &http2.Transport{
+		DialTLSContext: t.dialH2,
+	}
+	return t
+}
+
+func (t *uTLSTransport) dialTLS(ctx context.Context, network, addr string) (*utls.UConn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	helloID, ok := GetValueFromContext[utls.ClientHelloID](ctx, utlsHelloIDKey)
+	if !ok {
+		helloID = utls.HelloChrome_Auto
+	}
+	rawConn, err := t.dialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// always the dialed host's SNI, the browser's hints may be for another
+	// origin's conn
+	conn := utls.UClient(rawConn, &utls.Config{
+		ServerName: host,
+		// verified in VerifyConnection, see AutoFallbackClient.tlsConfig
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs utls.ConnectionState) error {
+			return t.verifyPeer(host, cs.PeerCertificates)
+		},
+	}, helloID)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t *uTLSTransport) dialH2(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+	conn, err := t.dialTLS(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		t.h1Addrs.Set(addr, struct{}{})
+		t.parkConn(addr, conn)
+		return nil, errALPNNotH2
+	}
+	return conn, nil
+}
+
+func (t *uTLSTransport) dialH1(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn := t.takeParked(addr); conn != nil {
+		return conn, nil
+	}
+	return t.dialTLS(ctx, network, addr)
+}
+
+func (t *uTLSTransport) parkConn(addr string, conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.parked[addr]; ok {
+		old.timer.Stop()
+		old.Close()
+	}
+	p := &parkedConn{Conn: conn}
+	p.timer = time.AfterFunc(t.parkTTL, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.parked[addr] == p {
+			delete(t.parked, addr)
+			p.Close()
+		}
+	})
+	t.parked[addr] = p
+}
+
+// takeParked returns the conn parked for addr, nil if there's none.
+func (t *uTLSTransport) takeParked(addr string) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.parked[addr]
+	if !ok {
+		return nil
+	}
+	delete(t.parked, addr)
+	p.timer.Stop()
+	return p.Conn
+}
+
+func canonicalAddr(req *http.Request) string {
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
+	return host
+}
+
+func (t *uTLSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addr := canonicalAddr(req)
+	if _, ok := t.h1Addrs.Get(addr); ok {
+		return t.h1.RoundTrip(req)
+	}
+	resp, err := t.h2.RoundTrip(req)
+	if errors.Is(err, errALPNNotH2) {
+		return t.h1.RoundTrip(req)
+	}
+	return resp, err
+}
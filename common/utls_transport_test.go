@@ -0,0 +1,208 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("uTLSTransport", func() {
+	It("should parse profiles", func() {
+		for _, name := range []string{"auto", "Chrome", "firefox", "edge", "safari", "ios", "randomized"} {
+			_, err := ParseUTLSProfile(name)
+			Expect(err).To(BeNil())
+		}
+		profile, _ := ParseUTLSProfile("Chrome")
+		Expect(profile).To(Equal("chrome"))
+		_, err := ParseUTLSProfile("netscape")
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should guess the browser's ClientHello for auto", func() {
+		for ua, id := range map[string]utls.ClientHelloID{
+			"Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 Chrome/115.0.0.0 Safari/537.36 Edg/115.0": utls.HelloEdge_Auto,
+			"Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0":                    utls.HelloFirefox_Auto,
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 Chrome/115.0.0.0 Safari/537.36":         utls.HelloChrome_Auto,
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 16_5 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148": utls.HelloIOS_Auto,
+			"Mozilla/5.0 (Macintosh) AppleWebKit/605.1.15 Version/16.5 Safari/605.1.15":                 utls.HelloSafari_Auto,
+			"curl/8.0": utls.HelloChrome_Auto,
+		} {
+			req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+			req.Header.Set("User-Agent", ua)
+			req = WithUTLSProfile(req, UTLSProfileAuto)
+			Expect(req.Context().Value(utlsHelloIDKey)).To(Equal(id), ua)
+		}
+	})
+
+	DescribeTable("should let ALPN pick the protocol",
+		func(enableHTTP2 bool, proto string) {
+			ca := newTestCA()
+			var conns atomic.Int32
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto)
+			}))
+			srv.EnableHTTP2 = enableHTTP2
+			srv.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue("example.com")}}
+			srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+				if s == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			srv.StartTLS()
+			defer srv.Close()
+
+			_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+			c := newTestClient(srv.Listener.Addr().String(), AutoFallbackClientOptions{
+				UTLSProfiles: "example.com=firefox",
+				RootCAs:      ca.pool,
+			})
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(http.MethodGet, "https://example.com:"+port+"/", nil)
+				resp, err := c.Do(req)
+				Expect(err).To(BeNil())
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				Expect(string(body)).To(Equal(proto))
+			}
+			// an http/1.1 conn dialed by h2 is parked and reused, not redialed
+			Expect(conns.Load()).To(Equal(int32(1)))
+		},
+		Entry("h2", true, "HTTP/2.0"),
+		Entry("http/1.1", false, "HTTP/1.1"),
+	)
+
+	It("should only apply the browser's hints to the host they're for", func() {
+		ca := newTestCA()
+		var sni atomic.Value
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Proto)
+		}))
+		srv.EnableHTTP2 = true
+		srv.TLS = &tls.Config{
+			Certificates: []tls.Certificate{ca.issue("b.example.com")},
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				sni.Store(hello.ServerName)
+				return nil, nil
+			},
+		}
+		srv.StartTLS()
+		defer srv.Close()
+
+		_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+		c := newTestClient(srv.Listener.Addr().String(), AutoFallbackClientOptions{
+			UTLSProfiles: "b.example.com=chrome",
+			RootCAs:      ca.pool,
+		})
+		get := func(hintedHost string) string {
+			ctx := WithClientHelloHints(context.Background(), &ClientHelloHints{
+				ServerName: hintedHost,
+				ALPN:       []string{"http/1.1"},
+			})
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://b.example.com:"+port+"/", nil)
+			resp, err := c.Do(req)
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return string(body)
+		}
+
+		// a document of a.example.com prefetching from b.example.com
+		Expect(get("a.example.com")).To(Equal("HTTP/2.0"))
+		Expect(sni.Load()).To(Equal("b.example.com"))
+		// the browser only offered http/1.1 to b.example.com itself
+		Expect(get("B.example.com")).To(Equal("HTTP/1.1"))
+		Expect(sni.Load()).To(Equal("b.example.com"))
+
+		_, ok := ClientHelloHintsFor(WithoutClientHelloHints(WithClientHelloHints(context.Background(), &ClientHelloHints{
+			ServerName: "b.example.com",
+		})), "b.example.com")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should close parked conns nobody took", func() {
+		t := newUTLSTransport(nil, nil)
+		t.parkTTL = 50 * time.Millisecond
+		taken, takenPeer := net.Pipe()
+		expired, expiredPeer := net.Pipe()
+		defer taken.Close()
+
+		t.parkConn("a.example.com:443", taken)
+		t.parkConn("b.example.com:443", expired)
+		Expect(t.takeParked("a.example.com:443")).To(Equal(taken))
+		Expect(t.takeParked("a.example.com:443")).To(BeNil())
+
+		closed := func(peer net.Conn) func() error {
+			return func() error {
+				peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+				_, err := peer.Read(make([]byte, 1))
+				return err
+			}
+		}
+		Eventually(closed(expiredPeer)).Should(Equal(io.EOF))
+		Expect(t.takeParked("b.example.com:443")).To(BeNil())
+		// the taken one stays open
+		Consistently(closed(takenPeer), 100*time.Millisecond).ShouldNot(Equal(io.EOF))
+	})
+
+	It("should close a conn parked over by another", func() {
+		t := newUTLSTransport(nil, nil)
+		first, firstPeer := net.Pipe()
+		second, _ := net.Pipe()
+		defer second.Close()
+		t.parkConn("example.com:443", first)
+		t.parkConn("example.com:443", second)
+		_, err := firstPeer.Read(make([]byte, 1))
+		Expect(err).To(Equal(io.EOF))
+		Expect(t.takeParked("example.com:443")).To(Equal(second))
+	})
+})
+
+var _ = Describe("HostRules", func() {
+	It("should match names, wildcard suffixes and any host", func() {
+		m := NewHostMatcher(" Example.com, *.cdn.example.net ,")
+		Expect(m.Match("example.com")).To(BeTrue())
+		Expect(m.Match("EXAMPLE.com:443")).To(BeTrue())
+		Expect(m.Match("www.example.com")).To(BeFalse())
+		Expect(m.Match("a.cdn.example.net")).To(BeTrue())
+		Expect(m.Match("cdn.example.net")).To(BeFalse())
+		Expect(NewHostMatcher("*").Match("anything.org")).To(BeTrue())
+		var none *HostMatcher
+		Expect(none.Match("example.com")).To(BeFalse())
+	})
+
+	It("should pick the first matching rule", func() {
+		rules, err := ParseHostRules("*.example.com=firefox, *=chrome", ParseUTLSProfile)
+		Expect(err).To(BeNil())
+		profile, ok := rules.Lookup("www.example.com")
+		Expect(ok).To(BeTrue())
+		Expect(profile).To(Equal("firefox"))
+		profile, ok = rules.Lookup("example.org")
+		Expect(ok).To(BeTrue())
+		Expect(profile).To(Equal("chrome"))
+
+		empty, err := ParseHostRules("", ParseUTLSProfile)
+		Expect(err).To(BeNil())
+		_, ok = empty.Lookup("example.com")
+		Expect(ok).To(BeFalse())
+		var none *HostRules[string]
+		_, ok = none.Lookup("example.com")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should reject malformed rules", func() {
+		_, err := ParseHostRules("example.com", ParseUTLSProfile)
+		Expect(err).NotTo(BeNil())
+		_, err = ParseHostRules("example.com=netscape", ParseUTLSProfile)
+		Expect(err).NotTo(BeNil())
+	})
+})
@@ -7,24 +7,31 @@ import (
 	mux "github.com/sagernet/sing-mux"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
+	"github.com/zckevin/http2-mitm-proxy/common"
 )
 
 type rawTCPDialer struct {
 	serverAddr *net.TCPAddr
+	bdp        *common.BDPEstimator
 }
 
-func newRawTCPDialer(serverAddr string) *rawTCPDialer {
+func newRawTCPDialer(serverAddr string, bdp *common.BDPEstimator) *rawTCPDialer {
 	addr, err := net.ResolveTCPAddr("tcp", serverAddr)
 	if err != nil {
 		panic(err)
 	}
 	return &rawTCPDialer{
 		serverAddr: addr,
+		bdp:        bdp,
 	}
 }
 
 func (d *rawTCPDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
-	return net.DialTCP("tcp", nil, d.serverAddr)
+	conn, err := net.DialTCP("tcp", nil, d.serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	return d.bdp.WrapConn(conn), nil
 }
 
 func (d *rawTCPDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
@@ -35,9 +42,9 @@ type MuxServerConnDialer struct {
 	muxClient *mux.Client
 }
 
-func NewMuxServerConnDialer(serverAddr, protocol string, maxConnections int) *MuxServerConnDialer {
+func NewMuxServerConnDialer(serverAddr, protocol string, maxConnections int, bdp *common.BDPEstimator) *MuxServerConnDialer {
 	client, err := mux.NewClient(mux.Options{
-		Dialer:         newRawTCPDialer(serverAddr),
+		Dialer:         newRawTCPDialer(serverAddr, bdp),
 		Protocol:       protocol,
 		MaxConnections: maxConnections,
 	})
@@ -49,22 +56,31 @@ func NewMuxServerConnDialer(serverAddr, protocol string, maxConnections int) *Mu
 	}
 }
 
-func (d *MuxServerConnDialer) dialStream(host string, typ StreamType) (net.Conn, error) {
+func (d *MuxServerConnDialer) dialStream(host string, handshakeMsg *HandshakeMsg) (net.Conn, error) {
 	addr := M.ParseSocksaddr(host)
 	st, err := d.muxClient.DialContext(context.TODO(), N.NetworkTCP, addr)
 	if err != nil {
 		return nil, err
 	}
-	handshakeMsg := &HandshakeMsg{
-		StreamType: typ,
-	}
 	return st, handshakeMsg.WriteTo(st)
 }
 
 func (d *MuxServerConnDialer) DialNormalStream(host string) (net.Conn, error) {
-	return d.dialStream(host, StreamTypeNormal)
+	return d.dialStream(host, &HandshakeMsg{StreamType: StreamTypeNormal})
+}
+
+func (d *MuxServerConnDialer) DialUpgradeStream(host string) (net.Conn, error) {
+	return d.dialStream(host, &HandshakeMsg{StreamType: StreamTypeUpgrade})
 }
 
 func (d *MuxServerConnDialer) DialPrefetchStream(host string) (net.Conn, error) {
-	return d.dialStream(host, StreamTypePrefetch)
+	return d.dialStream(host, &HandshakeMsg{StreamType: StreamTypePrefetch})
+}
+
+func (d *MuxServerConnDialer) DialCacheDigestStream(host string) (net.Conn, error) {
+	return d.dialStream(host, &HandshakeMsg{StreamType: StreamTypeCacheDigest})
+}
+
+func (d *MuxServerConnDialer) DialCacheHitsStream(host string) (net.Conn, error) {
+	return d.dialStream(host, &HandshakeMsg{StreamType: StreamTypeCacheHits})
 }
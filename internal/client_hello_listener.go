@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/zckevin/http2-mitm-proxy/common"
+)
+
+const (
+	tlsRecordHeaderLen     = 5
+	tlsRecordTypeHandshake = 0x16
+	tlsMaxRecordLen        = 16384 + tlsRecordHeaderLen
+)
+
+// clientHelloListener records the ClientHello of every browser connection,
+// martian terminates TLS itself so this is the only place we can see it.
+// The hints are keyed by the browser conn's remote address, which is
+// preserved by the conns martian wraps around ours.
+type clientHelloListener struct {
+	net.Listener
+
+	mu    sync.Mutex
+	hints map[string]*common.ClientHelloHints
+}
+
+func newClientHelloListener(l net.Listener) *clientHelloListener {
+	return &clientHelloListener{
+		Listener: l,
+		hints:    make(map[string]*common.ClientHelloHints),
+	}
+}
+
+func (l *clientHelloListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &clientHelloConn{Conn: conn, l: l}, nil
+}
+
+func (l *clientHelloListener) Lookup(remoteAddr string) *common.ClientHelloHints {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.hints[remoteAddr]
+}
+
+func (l *clientHelloListener) store(remoteAddr string, hints *common.ClientHelloHints) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hints[remoteAddr] = hints
+}
+
+func (l *clientHelloListener) remove(remoteAddr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.hints, remoteAddr)
+}
+
+// clientHelloConn copies what martian reads until it has seen a whole TLS
+// handshake record. The browser waits for our CONNECT response before
+// sending the ClientHello, so the record starts at the beginning of a read.
+type clientHelloConn struct {
+	net.Conn
+	l *clientHelloListener
+
+	done   bool
+	record []byte
+}
+
+func (c *clientHelloConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	if n > 0 && !c.done {
+		c.sniff(p[:n])
+	}
+	return
+}
+
+func (c *clientHelloConn) sniff(b []byte) {
+	if len(c.record) == 0 && b[0] != tlsRecordTypeHandshake {
+		// still in the CONNECT request
+		return
+	}
+	c.record = append(c.record, b...)
+	if len(c.record) < tlsRecordHeaderLen {
+		return
+	}
+	recordLen := tlsRecordHeaderLen + int(binary.BigEndian.Uint16(c.record[3:5]))
+	if recordLen > tlsMaxRecordLen {
+		c.done, c.record = true, nil
+		return
+	}
+	if len(c.record) < recordLen {
+		return
+	}
+	if hints, err := common.ParseClientHello(c.record[:recordLen]); err == nil {
+		c.l.store(c.RemoteAddr().String(), hints)
+	}
+	c.done, c.record = true, nil
+}
+
+func (c *clientHelloConn) Close() error {
+	c.l.remove(c.RemoteAddr().String())
+	return c.Conn.Close()
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+
+	"github.com/zckevin/http2-mitm-proxy/common"
+)
+
+// writeEarlyHints writes a 103 Early Hints with links to w, it must be
+// before the final response's WriteHeader.
+func writeEarlyHints(w http.ResponseWriter, links []string) {
+	if len(links) == 0 {
+		return
+	}
+	// a 103 carries the handler's header at the time, Link must not leak
+	// into the final response
+	w.Header()["Link"] = links
+	w.WriteHeader(http.StatusEarlyHints)
+	w.Header().Del("Link")
+	common.EarlyHintsSent.Add(1)
+}
+
+// earlyHintsRelay forwards the server's 103 Early Hints to the browser
+// until the final response arrives, client side only. The transport calls
+// it from its own goroutine, which may outlive a failed request.
+type earlyHintsRelay struct {
+	mu   sync.Mutex
+	w    http.ResponseWriter
+	done bool
+}
+
+func newEarlyHintsRelay(w http.ResponseWriter) *earlyHintsRelay {
+	return &earlyHintsRelay{w: w}
+}
+
+// withTrace returns ctx whose requests report their 1xx to the relay.
+func (e *earlyHintsRelay) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: e.got1xx,
+	})
+}
+
+func (e *earlyHintsRelay) got1xx(code int, header textproto.MIMEHeader) error {
+	if code != http.StatusEarlyHints {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.done {
+		writeEarlyHints(e.w, header.Values("Link"))
+	}
+	return nil
+}
+
+// finish stops forwarding, call it once the request returned. A nil
+// *earlyHintsRelay forwards nothing.
+func (e *earlyHintsRelay) finish() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.done = true
+}
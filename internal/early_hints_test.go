@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// headerCountingWriter counts WriteHeader calls by status.
+type headerCountingWriter struct {
+	header http.Header
+	codes  []int
+}
+
+func (w *headerCountingWriter) Header() http.Header         { return w.header }
+func (w *headerCountingWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *headerCountingWriter) WriteHeader(code int)        { w.codes = append(w.codes, code) }
+
+var _ = Describe("early hints", func() {
+	links := []string{
+		"<https://example.com/app.css>; rel=preload; as=style",
+		"<https://example.com/app.js>; rel=modulepreload",
+	}
+
+	// getWithHints gets url, returning the Links of the 103s before the
+	// final response.
+	getWithHints := func(url string) (hinted [][]string, resp *http.Response) {
+		var mu sync.Mutex
+		ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				mu.Lock()
+				defer mu.Unlock()
+				if code == http.StatusEarlyHints {
+					hinted = append(hinted, header.Values("Link"))
+				}
+				return nil
+			},
+		})
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		mu.Lock()
+		defer mu.Unlock()
+		return hinted, resp
+	}
+
+	It("should send links in a 103 but not in the final response", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeEarlyHints(w, links)
+			writeEarlyHints(w, nil)
+			w.Write([]byte("doc"))
+		}))
+		defer origin.Close()
+
+		hinted, resp := getWithHints(origin.URL)
+		defer resp.Body.Close()
+		Expect(hinted).To(Equal([][]string{links}))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Values("Link")).To(BeEmpty())
+	})
+
+	It("should relay the origin's 103s to the browser", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeEarlyHints(w, links)
+			w.Write([]byte("doc"))
+		}))
+		defer origin.Close()
+		relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hints := newEarlyHintsRelay(w)
+			req, _ := http.NewRequestWithContext(hints.withTrace(r.Context()), http.MethodGet, origin.URL, nil)
+			resp, err := http.DefaultClient.Do(req)
+			hints.finish()
+			Expect(err).To(BeNil())
+			defer resp.Body.Close()
+			io.Copy(w, resp.Body)
+		}))
+		defer relay.Close()
+
+		hinted, resp := getWithHints(relay.URL)
+		defer resp.Body.Close()
+		Expect(hinted).To(Equal([][]string{links}))
+		Expect(resp.Header.Values("Link")).To(BeEmpty())
+		Expect(io.ReadAll(resp.Body)).To(Equal([]byte("doc")))
+	})
+
+	It("should forward nothing once the request returned", func() {
+		w := &headerCountingWriter{header: make(http.Header)}
+		hints := newEarlyHintsRelay(w)
+		header := textproto.MIMEHeader{"Link": links}
+
+		Expect(hints.got1xx(http.StatusContinue, header)).To(BeNil())
+		Expect(w.codes).To(BeEmpty())
+		Expect(hints.got1xx(http.StatusEarlyHints, header)).To(BeNil())
+		Expect(w.codes).To(Equal([]int{http.StatusEarlyHints}))
+		Expect(w.header.Values("Link")).To(BeEmpty())
+
+		hints.finish()
+		Expect(hints.got1xx(http.StatusEarlyHints, header)).To(BeNil())
+		Expect(w.codes).To(Equal([]int{http.StatusEarlyHints}))
+
+		var none *earlyHintsRelay
+		Expect(none.finish).NotTo(Panic())
+	})
+})
@@ -2,6 +2,8 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"html/template"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -18,8 +20,26 @@ import (
 
 const (
 	dumpReqRespSeperator = "=====================\n"
+
+	// lets the client side (and curious users) tell our error pages apart
+	// from the origin's own responses
+	proxyErrorHeader = "X-Proxy-Error"
 )
 
+var upstreamCertificateErrorPage = template.Must(template.New("cert").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Your connection is not private</title></head>
+<body style="font-family: sans-serif; max-width: 640px; margin: 48px auto;">
+<h1>Your connection is not private</h1>
+<p>The proxy server could not verify the certificate of <b>{{.Host}}</b>,
+so the request was not sent.</p>
+<pre style="white-space: pre-wrap;">{{.Err}}</pre>
+<p>If you trust this host, add it to the server's
+<code>--insecure-skip-verify-hosts</code> flag.</p>
+</body>
+</html>
+`))
+
 type h2MuxHandler struct {
 	debug        bool
 	isServerSide bool
@@ -29,6 +49,16 @@ type h2MuxHandler struct {
 
 	pc *prefetch.PrefetchClient
 	ps *prefetch.PrefetchServer
+	// orders response writes by urgency, server side only
+	gate *common.PriorityGate
+	// compresses responses over the tunnel if the client offers it, server
+	// side only
+	tunnelEncoding string
+	// recompresses images to save bandwidth, server side only
+	dataSaver *common.DataSaver
+
+	// browser's ClientHello of this conn, client side only
+	clientHello *common.ClientHelloHints
 }
 
 func newH2MuxHandler(
@@ -62,34 +92,64 @@ func (h *h2MuxHandler) writeInternalError(w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusInternalServerError)
 }
 
-func (h *h2MuxHandler) Serve(w http.ResponseWriter, r *http.Request) {
-	common.FixRequest(r)
-	if r.Body != nil {
-		defer r.Body.Close()
+func (h *h2MuxHandler) writeUpstreamCertificateError(w http.ResponseWriter, certErr *common.UpstreamCertificateError) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set(proxyErrorHeader, "upstream-certificate")
+	w.WriteHeader(http.StatusBadGateway)
+	upstreamCertificateErrorPage.Execute(w, certErr)
+}
+
+func (h *h2MuxHandler) writeError(w http.ResponseWriter, err error) {
+	var certErr *common.UpstreamCertificateError
+	if errors.As(err, &certErr) {
+		h.writeUpstreamCertificateError(w, certErr)
+		return
 	}
+	h.writeInternalError(w, err)
+}
 
-	var (
-		ctx  context.Context
-		span trace.Span
-	)
+func injectClientHello(r *http.Request, hints *common.ClientHelloHints) {
+	if hints.IsEmpty() {
+		return
+	}
+	if s, err := hints.Encode(); err == nil {
+		r.Header.Set(common.ClientHelloHeader, s)
+	}
+}
+
+func (h *h2MuxHandler) extractClientHello(ctx context.Context, r *http.Request) context.Context {
+	s := r.Header.Get(common.ClientHelloHeader)
+	if s == "" {
+		return ctx
+	}
+	r.Header.Del(common.ClientHelloHeader)
+	hints, err := common.DecodeClientHelloHints(s)
+	if err != nil {
+		h.logError(r, "decode client hello err: ", err)
+		return ctx
+	}
+	return common.WithClientHelloHints(ctx, hints)
+}
+
+func (h *h2MuxHandler) startSpan(r *http.Request) (ctx context.Context, span trace.Span) {
 	if !h.isServerSide {
+		common.SetRequestPriority(r)
 		ctx = tracing.GetChromeTracingContext(r)
 		ctx, span = tracing.GetTracer(ctx, "internal").Start(ctx, r.URL.String())
 		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(r.Header))
+		injectClientHello(r, h.clientHello)
 	} else {
-		ctx = otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+		ctx = otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
 		ctx, span = tracing.GetTracer(ctx, "internal").Start(ctx, r.URL.String())
+		ctx = h.extractClientHello(ctx, r)
 	}
-	defer span.End()
-
-	var err error
-	defer func() {
-		if err != nil {
-			h.writeInternalError(w, err)
-			span.RecordError(err)
-		}
-	}()
+	return
+}
 
+// do sends r to the next hop, the server on client side and the origin on
+// server side.
+func (h *h2MuxHandler) do(ctx context.Context, r *http.Request) (resp *http.Response, err error) {
 	if h.debug {
 		buf, _ := httputil.DumpRequest(r, true)
 		h.dump("== dump request for: ", string(buf), r)
@@ -97,7 +157,6 @@ func (h *h2MuxHandler) Serve(w http.ResponseWriter, r *http.Request) {
 
 	// for tracing in go-libs
 	r = r.WithContext(ctx)
-	var resp *http.Response
 	if !h.isServerSide && h.pc.FilterRequest(r) {
 		// add client to context for prefetch's racing http client
 		r = r.WithContext(context.WithValue(r.Context(), "client", h.client))
@@ -109,46 +168,144 @@ func (h *h2MuxHandler) Serve(w http.ResponseWriter, r *http.Request) {
 		if !common.IsIgnoredError(err) {
 			h.logError(r, "do request err: ", err)
 		}
-		return
+		return nil, err
 	}
 	if h.debug {
 		buf, _ := httputil.DumpResponse(resp, false)
 		h.dump("== dump response for: ", string(buf), r)
 	}
-	defer resp.Body.Close()
 
 	if !h.isServerSide {
 		tracing.AddSpansFromResponse(r, resp)
+	}
+	return resp, nil
+}
+
+// browserAborted records a request whose browser went away, written is how
+// much of resp was relayed before that.
+func (h *h2MuxHandler) browserAborted(r *http.Request, resp *http.Response, written int64) {
+	common.CanceledRequests.Add(1)
+	if resp != nil {
+		common.AddBytesSavedByCancel(resp.ContentLength, written)
+	}
+	h.logger.Debug("browser aborted: ", r.URL.String())
+}
+
+func (h *h2MuxHandler) Serve(w http.ResponseWriter, r *http.Request) {
+	common.FixRequest(r)
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+
+	ctx, span := h.startSpan(r)
+	defer span.End()
+
+	var (
+		encoding string
+		quality  int
+	)
+	endRequest := func() {}
+	if h.isServerSide {
+		u := common.RequestUrgency(r)
+		// pushes hold back while the request waits for its response
+		endRequest = h.gate.Begin(u)
+		defer endRequest()
+		w = common.NewPrioritizedResponseWriter(w, h.gate, u)
+		h.ps.ObserveRequest(r)
+		encoding = common.NegotiateTunnelEncoding(r, h.tunnelEncoding)
+		quality = h.dataSaver.Quality(r)
+	}
+
+	var err error
+	defer func() {
+		if err != nil {
+			h.writeError(w, err)
+			span.RecordError(err)
+		}
+	}()
+
+	var hints *earlyHintsRelay
+	if h.isServerSide {
+		// while the origin works on the document
+		writeEarlyHints(w, h.ps.EarlyHints(r))
 	} else {
-		// TODO: if html load fast and then exit, if we want to cancel all flying prefetch requests?
-		h.ps.TryPrefetch(ctx, resp)
+		hints = newEarlyHintsRelay(w)
+		ctx = hints.withTrace(ctx)
 	}
 
-	if err = common.CopyResponse(w, resp); err != nil /* && !errors.Is(err, io.EOF) */ {
+	resp, err := h.do(ctx, r)
+	hints.finish()
+	if err != nil {
+		if r.Context().Err() != nil {
+			h.browserAborted(r, nil, 0)
+			// nobody to write an error to
+			err = nil
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	cancelPrefetch := context.CancelFunc(func() {})
+	if h.isServerSide {
+		cancelPrefetch, _ = h.ps.TryPrefetch(ctx, resp)
+		// the response headers are in, from here on its body goes first
+		// through the gate and pushes may use the link whenever it idles,
+		// e.g. between the events of a stream
+		endRequest()
+		if err := h.dataSaver.Recompress(resp, quality); err != nil {
+			h.logError(r, "data saver recompress err: ", err)
+		}
+	}
+
+	var n int64
+	if n, err = common.CopyResponseWithTunnelEncoding(w, resp, encoding); err != nil /* && !errors.Is(err, io.EOF) */ {
+		if r.Context().Err() != nil {
+			// the browser aborted the document, its prefetches are useless now
+			h.browserAborted(r, resp, n)
+			cancelPrefetch()
+			// nobody to write an error to
+			err = nil
+			return
+		}
 		h.logError(r, "CopyResponse err: ", err)
 		return
 	}
 }
 
-// TODO: we should create a relay for all incoming h2conns
-/*
-func h2Relay(h2conn net.Conn, client common.HTTPRequestDoer, isServerSide bool) error {
-	handler := newH2MuxHandler(isServerSide, common.DebugMode, client)
-	server := &http2.Server{}
-	server.ServeConn(h2conn, &http2.ServeConnOpts{
-		Handler: http.HandlerFunc(handler.Serve),
-	})
-	return nil
+// RoundTrip relays a request martian read from a HTTP/1.1 browser conn
+// over the h2 relay, client side only.
+func (h *h2MuxHandler) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.RequestURI = ""
+	if r.ContentLength == 0 {
+		r.Body = nil
+	}
+	// the relay only speaks https, tell the server what the browser asked for
+	if r.URL.Scheme == "http" {
+		r.Header.Set(common.OriginSchemeHeader, "http")
+		r.URL.Scheme = "https"
+	}
+
+	ctx, span := h.startSpan(r)
+	defer span.End()
+
+	resp, err := h.do(ctx, r)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return resp, nil
 }
-*/
 
 func createClientSideH2Relay(
 	h2conn net.Conn,
 	httpClient common.HTTPRequestDoer,
 	pc *prefetch.PrefetchClient,
+	clientHello *common.ClientHelloHints,
 ) error {
 	handler := newH2MuxHandler(false, common.DebugMode, httpClient)
 	handler.pc = pc
+	handler.clientHello = clientHello
+	// the browser is local, its windows are no bottleneck
 	server := &http2.Server{}
 	server.ServeConn(h2conn, &http2.ServeConnOpts{
 		Handler: http.HandlerFunc(handler.Serve),
@@ -158,12 +315,17 @@ func createClientSideH2Relay(
 
 func createServerSideH2Relay(
 	h2conn net.Conn,
-	httpClient common.HTTPRequestDoer,
+	opts *MuxHandlerOptions,
 	ps *prefetch.PrefetchServer,
+	gate *common.PriorityGate,
 ) error {
-	handler := newH2MuxHandler(true, common.DebugMode, httpClient)
+	handler := newH2MuxHandler(true, common.DebugMode, opts.HTTPClient)
 	handler.ps = ps
+	handler.gate = gate
+	handler.tunnelEncoding = opts.TunnelEncoding
+	handler.dataSaver = opts.DataSaver
 	server := &http2.Server{}
+	opts.BDP.ConfigureServer(server)
 	server.ServeConn(h2conn, &http2.ServeConnOpts{
 		Handler: http.HandlerFunc(handler.Serve),
 	})
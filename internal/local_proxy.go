@@ -1,10 +1,9 @@
 package internal
 
 import (
-	"context"
-	"crypto/tls"
 	"io"
 	"net"
+	"net/http"
 
 	"github.com/zckevin/http2-mitm-proxy/common"
 	"github.com/zckevin/http2-mitm-proxy/prefetch"
@@ -14,18 +13,65 @@ import (
 type LocalProxy struct {
 	pc    *prefetch.PrefetchClient
 	muxer *MuxServerConnDialer
+
+	helloListener *clientHelloListener
+
+	// one h2 relay to the server, shared by all browser connections
+	relayClient *http.Client
+	// relays requests martian read from HTTP/1.1 browser conns
+	h1Handler *h2MuxHandler
 }
 
-func NewLocalProxy(serverAddr string) *LocalProxy {
-	muxer := NewMuxServerConnDialer(serverAddr, "smux", 1)
-	pc := prefetch.NewPrefetchClient(muxer.DialPrefetchStream)
+func NewLocalProxy(serverAddr string, bdp *common.BDPEstimator, tunnelEncoding string) *LocalProxy {
+	muxer := NewMuxServerConnDialer(serverAddr, "smux", 1, bdp)
+	pc := prefetch.NewPrefetchClient(muxer.DialPrefetchStream, muxer.DialCacheDigestStream, muxer.DialCacheHitsStream)
 	lp := &LocalProxy{
 		pc:    pc,
 		muxer: muxer,
 	}
+
+	tr := &http2.Transport{}
+	bdp.ConfigureTransport(tr)
+	tr.ConnPool = newRelayConnPool(tr, func() (net.Conn, error) {
+		conn, err := lp.DialNormalStream("")
+		if err != nil {
+			return nil, err
+		}
+		return bdp.WrapTransportConn(conn), nil
+	})
+	lp.relayClient = common.NewHttpClient(&tunnelEncodingTransport{rt: tr, encodings: tunnelEncoding})
+
+	lp.h1Handler = newH2MuxHandler(false, common.DebugMode, lp.relayClient)
+	lp.h1Handler.pc = pc
 	return lp
 }
 
+// RoundTrip makes LocalProxy martian's http.RoundTripper, so HTTP/1.1
+// browser requests go through the same h2 relay as h2 ones. Upgrade
+// requests, e.g. WebSockets, get a raw stream of their own instead.
+func (lp *LocalProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isUpgradeRequest(req) {
+		return relayUpgrade(req, lp.muxer.DialUpgradeStream)
+	}
+	// martian sets RemoteAddr to the browser conn's
+	injectClientHello(req, lp.clientHello(req.RemoteAddr))
+	return lp.h1Handler.RoundTrip(req)
+}
+
+// WrapListener records browsers' ClientHellos on l, it must wrap the
+// listener martian serves on.
+func (lp *LocalProxy) WrapListener(l net.Listener) net.Listener {
+	lp.helloListener = newClientHelloListener(l)
+	return lp.helloListener
+}
+
+func (lp *LocalProxy) clientHello(remoteAddr string) *common.ClientHelloHints {
+	if lp.helloListener == nil {
+		return nil
+	}
+	return lp.helloListener.Lookup(remoteAddr)
+}
+
 func (lp *LocalProxy) DialNormalStream(host string) (net.Conn, error) {
 	return lp.muxer.DialNormalStream(host)
 }
@@ -44,11 +90,5 @@ func (lp *LocalProxy) BitwiseCopy(cc, sc net.Conn) error {
 }
 
 func (lp *LocalProxy) H2ServerCopy(cc net.Conn) error {
-	tr := &http2.Transport{
-		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
-			return lp.DialNormalStream("")
-		},
-	}
-	baseClient := common.NewHttpClient(tr)
-	return createClientSideH2Relay(cc, baseClient, lp.pc)
+	return createClientSideH2Relay(cc, lp.relayClient, lp.pc, lp.clientHello(cc.RemoteAddr().String()))
 }
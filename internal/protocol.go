@@ -11,6 +11,11 @@ type StreamType int
 const (
 	StreamTypeNormal StreamType = iota
 	StreamTypePrefetch
+	StreamTypeCacheDigest
+	// an HTTP/1.1 upgrade request followed by raw bytes both ways
+	StreamTypeUpgrade
+	// requests the client's cache answered
+	StreamTypeCacheHits
 )
 
 type HandshakeMsg struct {
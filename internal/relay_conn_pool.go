@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// relayConnPool shares h2 conns over mux streams between all browser
+// connections, whatever origin they are for, the server routes each
+// request by its :authority. A new conn is only dialed when all existing
+// ones are closing or out of concurrent streams.
+type relayConnPool struct {
+	t    *http2.Transport
+	dial func() (net.Conn, error)
+
+	mu    sync.Mutex
+	conns []*http2.ClientConn
+	// the dial in flight, requests wait for it instead of dialing their own
+	dialing *relayDial
+}
+
+type relayDial struct {
+	done chan struct{}
+	err  error
+}
+
+var _ http2.ClientConnPool = (*relayConnPool)(nil)
+
+func newRelayConnPool(t *http2.Transport, dial func() (net.Conn, error)) *relayConnPool {
+	return &relayConnPool{
+		t:    t,
+		dial: dial,
+	}
+}
+
+func (p *relayConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	for {
+		p.mu.Lock()
+		if cc := p.usableLocked(); cc != nil {
+			p.mu.Unlock()
+			return cc, nil
+		}
+		if d := p.dialing; d != nil {
+			p.mu.Unlock()
+			select {
+			case <-d.done:
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			if d.err != nil {
+				return nil, d.err
+			}
+			// the new conn may be taken already, look again
+			continue
+		}
+		d := &relayDial{done: make(chan struct{})}
+		p.dialing = d
+		p.mu.Unlock()
+
+		// dialing a tunnel takes a round trip or more, without the lock
+		cc, err := p.dialClientConn()
+		p.mu.Lock()
+		if err == nil {
+			p.conns = append(p.conns, cc)
+		}
+		p.dialing = nil
+		p.mu.Unlock()
+		d.err = err
+		close(d.done)
+		return cc, err
+	}
+}
+
+// usableLocked drops the closed conns and returns one taking new requests,
+// nil if none.
+func (p *relayConnPool) usableLocked() *http2.ClientConn {
+	alive := p.conns[:0]
+	for _, cc := range p.conns {
+		if state := cc.State(); state.Closed || state.Closing {
+			continue
+		}
+		alive = append(alive, cc)
+	}
+	for i := len(alive); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = alive
+
+	for _, cc := range p.conns {
+		if cc.CanTakeNewRequest() {
+			return cc
+		}
+	}
+	return nil
+}
+
+func (p *relayConnPool) dialClientConn() (*http2.ClientConn, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+func (p *relayConnPool) MarkDead(dead *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, cc := range p.conns {
+		if cc == dead {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+)
+
+// pipeDialer dials h2 servers over net.Pipe, each dial waits for release
+// if it's set.
+type pipeDialer struct {
+	dials   atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func (d *pipeDialer) dial() (net.Conn, error) {
+	d.dials.Add(1)
+	if d.release != nil {
+		<-d.release
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	client, server := net.Pipe()
+	go (&http2.Server{}).ServeConn(server, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	})
+	return client, nil
+}
+
+var _ = Describe("relayConnPool", func() {
+	var (
+		d    *pipeDialer
+		pool *relayConnPool
+		req  *http.Request
+	)
+
+	BeforeEach(func() {
+		d = &pipeDialer{}
+		pool = newRelayConnPool(&http2.Transport{}, d.dial)
+		req, _ = http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	})
+
+	It("should share a conn between requests", func() {
+		cc, err := pool.GetClientConn(req, "example.com:443")
+		Expect(err).To(BeNil())
+		again, err := pool.GetClientConn(req, "other.example.com:443")
+		Expect(err).To(BeNil())
+		Expect(again).To(BeIdenticalTo(cc))
+		Expect(d.dials.Load()).To(Equal(int32(1)))
+	})
+
+	It("should dial once for concurrent requests, without holding the lock", func() {
+		d.release = make(chan struct{})
+		var (
+			wg  sync.WaitGroup
+			ccs = make([]*http2.ClientConn, 8)
+		)
+		for i := range ccs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ccs[i], _ = pool.GetClientConn(req, "example.com:443")
+			}(i)
+		}
+		Eventually(d.dials.Load).Should(Equal(int32(1)))
+
+		// the pool stays usable while the tunnel is being dialed
+		marked := make(chan struct{})
+		go func() {
+			pool.MarkDead(nil)
+			close(marked)
+		}()
+		Eventually(marked).Should(BeClosed())
+
+		close(d.release)
+		wg.Wait()
+		Expect(ccs[0]).NotTo(BeNil())
+		for _, cc := range ccs {
+			Expect(cc).To(BeIdenticalTo(ccs[0]))
+		}
+		Expect(d.dials.Load()).To(Equal(int32(1)))
+	})
+
+	It("should hand the dial error to the waiting requests", func() {
+		d.release = make(chan struct{})
+		d.err = errors.New("tunnel down")
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				_, err := pool.GetClientConn(req, "example.com:443")
+				errs <- err
+			}()
+		}
+		Eventually(d.dials.Load).Should(Equal(int32(1)))
+		Consistently(errs, 50*time.Millisecond).ShouldNot(Receive())
+		close(d.release)
+		Eventually(errs).Should(Receive(Equal(d.err)))
+		Eventually(errs).Should(Receive(Equal(d.err)))
+		Expect(d.dials.Load()).To(Equal(int32(1)))
+
+		// a later request dials again
+		d.release, d.err = nil, nil
+		_, err := pool.GetClientConn(req, "example.com:443")
+		Expect(err).To(BeNil())
+		Expect(d.dials.Load()).To(Equal(int32(2)))
+	})
+
+	It("should dial a new conn after MarkDead or close", func() {
+		cc, err := pool.GetClientConn(req, "example.com:443")
+		Expect(err).To(BeNil())
+		pool.MarkDead(cc)
+		marked, err := pool.GetClientConn(req, "example.com:443")
+		Expect(err).To(BeNil())
+		Expect(marked).NotTo(BeIdenticalTo(cc))
+		Expect(d.dials.Load()).To(Equal(int32(2)))
+
+		Expect(marked.Close()).To(BeNil())
+		closed, err := pool.GetClientConn(req, "example.com:443")
+		Expect(err).To(BeNil())
+		Expect(closed).NotTo(BeIdenticalTo(marked))
+		Expect(d.dials.Load()).To(Equal(int32(3)))
+		Expect(pool.conns).To(HaveLen(1))
+	})
+})
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
@@ -31,29 +30,60 @@ var (
 	connectionPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
 
 	_ mux.ServerHandler = (*muxHandler)(nil)
-
-	httpclient = common.NewAutoFallbackClient()
 )
 
+type MuxHandlerOptions struct {
+	RelayType  string
+	HTTPClient *common.AutoFallbackClient
+	// sizes relay windows, nil keeps the defaults
+	BDP *common.BDPEstimator
+	// compresses responses for clients offering it, empty disables
+	TunnelEncoding string
+	// recompresses images of hosts with rules, nil disables
+	DataSaver *common.DataSaver
+	// the prefetch server of each tunnel conn
+	Prefetch prefetch.PrefetchServerOptions
+}
+
 type muxHandler struct {
-	relayType string
-	h2Config  *h2.Config
-	logger    log.ContextLogger
+	opts     MuxHandlerOptions
+	h2Config *h2.Config
+	logger   log.ContextLogger
 
 	ps *prefetch.PrefetchServer
+	// shared by all responses and pushes over this tunnel conn
+	gate *common.PriorityGate
+	// orders the frames of the mux streams, nil until WrapConn
+	sched *common.MuxScheduler
 }
 
-func NewMuxHandler(relayType string) *muxHandler {
-	h2Config := &h2.Config{
+func NewMuxHandler(opts MuxHandlerOptions) *muxHandler {
+	gate := common.NewPriorityGate()
+	h := &muxHandler{
+		opts:   opts,
+		logger: common.NewLogger("muxerHandler"),
+		ps:     prefetch.NewPrefetchServer(opts.HTTPClient, gate, opts.Prefetch),
+		gate:   gate,
+	}
+	h.h2Config = &h2.Config{
 		AllowedHostsFilter: func(_ string) bool { return true },
 		EnableDebugLogs:    true,
+		DialServerConn:     h.dialOriginH2,
 	}
-	return &muxHandler{
-		relayType: relayType,
-		h2Config:  h2Config,
-		logger:    common.NewLogger("muxerHandler"),
-		ps:        prefetch.NewPrefetchServer(httpclient),
-	}
+	return h
+}
+
+// dialOriginH2 dials a TLS conn speaking h2 to host, through the upstream
+// client's resolver and certificate verification.
+func (h *muxHandler) dialOriginH2(host string) (net.Conn, error) {
+	return h.opts.HTTPClient.DialTLSContext(context.TODO(), "tcp", host, []string{"h2"})
+}
+
+// WrapConn schedules the frames the tunnel mux writes to conn by the
+// urgency of their streams.
+func (h *muxHandler) WrapConn(conn net.Conn) net.Conn {
+	h.sched = common.NewMuxScheduler(conn)
+	return h.sched
 }
 
 func (h *muxHandler) NewConnection(ctx context.Context, stream net.Conn, metadata M.Metadata) error {
@@ -64,8 +94,18 @@ func (h *muxHandler) NewConnection(ctx context.Context, stream net.Conn, metadat
 	switch handshakeMsg.StreamType {
 	case StreamTypeNormal:
 		return h.serveNormalConn(ctx, stream, metadata)
+	case StreamTypeUpgrade:
+		return h.serveUpgradeConn(ctx, stream, metadata)
 	case StreamTypePrefetch:
+		// pushes go after the responses the browser waits for
+		h.sched.SetUrgency(stream, common.UrgencyBackground)
 		return h.servePrefetchConn(ctx, stream)
+	case StreamTypeCacheDigest:
+		defer stream.Close()
+		return h.ps.ReceiveCacheDigest(stream)
+	case StreamTypeCacheHits:
+		defer stream.Close()
+		return h.ps.ReceiveCacheHits(stream)
 	default:
 		return fmt.Errorf("unknown stream type: %d", handshakeMsg.StreamType)
 	}
@@ -105,6 +145,9 @@ func (h *muxHandler) serveNormalConn(ctx context.Context, stream net.Conn, metad
 func (h *muxHandler) serveH1Conn(ctx context.Context, stream net.Conn, peekBuf []byte) error {
 	p := martian.NewProxy()
 	defer p.Close()
+	p.SetDial(func(network, addr string) (net.Conn, error) {
+		return h.opts.HTTPClient.DialContext(ctx, network, addr)
+	})
 
 	mctx, _, _ := martian.TestContext(&http.Request{}, nil, nil)
 	brw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
@@ -113,11 +156,9 @@ func (h *muxHandler) serveH1Conn(ctx context.Context, stream net.Conn, peekBuf [
 }
 
 func (h *muxHandler) serveH2Conn(ctx context.Context, stream net.Conn, u *url.URL) error {
-	switch h.relayType {
+	switch h.opts.RelayType {
 	case "bitwise":
-		sc, err := tls.Dial("tcp", u.Host, &tls.Config{
-			NextProtos: []string{"h2"},
-		})
+		sc, err := h.opts.HTTPClient.DialTLSContext(ctx, "tcp", u.Host, []string{"h2"})
 		if err != nil {
 			return err
 		}
@@ -125,7 +166,7 @@ func (h *muxHandler) serveH2Conn(ctx context.Context, stream net.Conn, u *url.UR
 	case "martian":
 		return h.h2Config.Proxy(nil, stream, u)
 	case "h2":
-		return createServerSideH2Relay(stream, httpclient, h.ps)
+		return createServerSideH2Relay(stream, &h.opts, h.ps, h.gate)
 	default:
 		panic("unknown relay type")
 	}
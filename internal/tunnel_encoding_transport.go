@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/zckevin/http2-mitm-proxy/common"
+)
+
+// tunnelEncodingTransport offers the server the tunnel encodings we can
+// decode and undoes the one it picked, so handlers only see origin responses.
+type tunnelEncodingTransport struct {
+	rt        http.RoundTripper
+	encodings string
+}
+
+func (t *tunnelEncodingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.encodings != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(common.TunnelEncodingHeader, t.encodings)
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := common.DecodeTunnelEncoding(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
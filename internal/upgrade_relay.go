@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/google/martian/v3"
+	singBufio "github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/zckevin/http2-mitm-proxy/common"
+	"golang.org/x/net/http/httpguts"
+)
+
+// isUpgradeRequest reports whether r asks to switch protocols, e.g. a
+// WebSocket handshake, which the h2 relay can't carry.
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" &&
+		httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
+// relayUpgrade relays upgrade request r read by martian over a stream from
+// dial, then copies raw bytes between it and the browser conn until either
+// closes, the origin's response included. It hijacks the browser conn from
+// martian, which writes nothing of the response returned.
+func relayUpgrade(r *http.Request, dial func(addr string) (net.Conn, error)) (*http.Response, error) {
+	mctx := martian.NewContext(r)
+	if mctx == nil {
+		return nil, errors.New("upgrade request not read by martian")
+	}
+	addr := r.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		port := "443"
+		if r.URL.Scheme == "http" {
+			port = "80"
+		}
+		addr = net.JoinHostPort(addr, port)
+	}
+	stream, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	conn, brw, err := mctx.Session().Hijack()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	r.RequestURI = ""
+	if r.URL.Scheme == "http" {
+		r.Header.Set(common.OriginSchemeHeader, "http")
+	}
+	if err := r.Write(stream); err != nil {
+		return nil, err
+	}
+	err = singBufio.CopyConn(r.Context(), common.NewPeekedConn(conn, brw.Reader), stream)
+	return &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    r,
+	}, err
+}
+
+// serveUpgradeConn writes the upgrade request of relayUpgrade to its
+// origin, then copies raw bytes between the stream and the origin.
+func (h *muxHandler) serveUpgradeConn(ctx context.Context, stream net.Conn, metadata M.Metadata) error {
+	br := bufio.NewReader(stream)
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		return err
+	}
+	addr := metadata.Destination.String()
+	var origin net.Conn
+	if r.Header.Get(common.OriginSchemeHeader) == "http" {
+		origin, err = h.opts.HTTPClient.DialContext(ctx, "tcp", addr)
+	} else {
+		origin, err = h.opts.HTTPClient.DialTLSContext(ctx, "tcp", addr, []string{"http/1.1"})
+	}
+	if err != nil {
+		resp := &http.Response{
+			StatusCode: http.StatusBadGateway,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Close:      true,
+			Request:    r,
+		}
+		resp.Write(stream)
+		return err
+	}
+	r.Header.Del(common.OriginSchemeHeader)
+	if err := r.Write(origin); err != nil {
+		origin.Close()
+		return err
+	}
+	return singBufio.CopyConn(ctx, common.NewPeekedConn(stream, br), origin)
+}
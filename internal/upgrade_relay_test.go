@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/google/martian/v3"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/zckevin/http2-mitm-proxy/common"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// serveEchoUpgrade switches to a protocol echoing what it reads.
+func serveEchoUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !isUpgradeRequest(r) {
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	brw.Flush()
+	io.Copy(conn, brw)
+}
+
+var _ = Describe("upgrade relay", func() {
+	It("should tell upgrade requests apart", func() {
+		r, _ := http.NewRequest(http.MethodGet, "https://example.com/ws", nil)
+		Expect(isUpgradeRequest(r)).To(BeFalse())
+		r.Header.Set("Upgrade", "websocket")
+		Expect(isUpgradeRequest(r)).To(BeFalse())
+		r.Header.Set("Connection", "keep-alive, Upgrade")
+		Expect(isUpgradeRequest(r)).To(BeTrue())
+	})
+
+	It("should relay a WebSocket-like upgrade through martian and the server", func() {
+		origin := httptest.NewServer(http.HandlerFunc(serveEchoUpgrade))
+		defer origin.Close()
+
+		client, err := common.NewAutoFallbackClient(common.AutoFallbackClientOptions{})
+		Expect(err).To(BeNil())
+		h := &muxHandler{opts: MuxHandlerOptions{HTTPClient: client}}
+		dial := func(addr string) (net.Conn, error) {
+			clientSide, serverSide := net.Pipe()
+			go h.serveUpgradeConn(context.Background(), serverSide, M.Metadata{
+				Destination: M.ParseSocksaddr(addr),
+			})
+			return clientSide, nil
+		}
+
+		p := martian.NewProxy()
+		defer p.Close()
+		p.SetRoundTripper(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return relayUpgrade(r, dial)
+		}))
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		go p.Serve(l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		u, _ := url.Parse(origin.URL + "/ws")
+		req, _ := http.NewRequest(http.MethodGet, u.String(), nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "echo")
+		Expect(req.WriteProxy(conn)).To(Succeed())
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+		Expect(resp.Header.Get("Upgrade")).To(Equal("echo"))
+
+		for _, msg := range []string{"ping", "pong"} {
+			_, err = conn.Write([]byte(msg))
+			Expect(err).To(BeNil())
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(br, buf)
+			Expect(err).To(BeNil())
+			Expect(string(buf)).To(Equal(msg))
+		}
+	})
+})
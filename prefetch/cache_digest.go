@@ -0,0 +1,360 @@
+package prefetch
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+	"golang.org/x/exp/maps"
+)
+
+// The client tells the server what its prefetch cache holds with Golomb
+// coded sets, like the HTTP cache digest draft: one of fresh URLs, which
+// the server doesn't fetch at all, and one of URL+ETag validators, which it
+// doesn't push again after fetching.
+
+const (
+	cacheDigestVersion = 1
+	// false positive rate 1/2^7, a false positive only costs a prefetch
+	cacheDigestLogP = 7
+	// cache entries without explicit freshness
+	defaultCacheDigestTTL = 10 * time.Minute
+	maxCacheDigestKeys    = 1 << 16
+	// a stale entry is kept as a validator this long, the client cache has
+	// likely evicted it by then
+	maxCacheDigestStaleness = time.Hour
+)
+
+var (
+	errCacheDigestCorrupt = errors.New("cache digest: corrupt set")
+)
+
+// GolombSet is a Golomb-Rice coded set of key hashes.
+type GolombSet struct {
+	N    uint32
+	LogP uint8
+	Data []byte
+}
+
+func hashDigestKey(key string, n uint32, logP uint8) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8]) % (uint64(n) << logP)
+}
+
+func NewGolombSet(keys []string, logP uint8) *GolombSet {
+	n := uint32(len(keys))
+	if n == 0 {
+		return &GolombSet{LogP: logP}
+	}
+	hashes := make([]uint64, 0, n)
+	for _, key := range keys {
+		hashes = append(hashes, hashDigestKey(key, n, logP))
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	w := &bitWriter{}
+	var last uint64
+	for _, h := range hashes {
+		delta := h - last
+		last = h
+		for q := delta >> logP; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, logP)
+	}
+	return &GolombSet{N: n, LogP: logP, Data: w.buf}
+}
+
+// decode returns the sorted hashes of the set.
+func (s *GolombSet) decode() ([]uint64, error) {
+	if s.N > maxCacheDigestKeys || s.LogP > 32 {
+		return nil, errCacheDigestCorrupt
+	}
+	r := &bitReader{buf: s.Data}
+	hashes := make([]uint64, 0, s.N)
+	var last uint64
+	for i := uint32(0); i < s.N; i++ {
+		var q uint64
+		for {
+			bit, ok := r.readBit()
+			if !ok {
+				return nil, errCacheDigestCorrupt
+			}
+			if bit == 0 {
+				break
+			}
+			q++
+		}
+		rem, ok := r.readBits(s.LogP)
+		if !ok {
+			return nil, errCacheDigestCorrupt
+		}
+		last += q<<s.LogP | rem
+		hashes = append(hashes, last)
+	}
+	return hashes, nil
+}
+
+type bitWriter struct {
+	buf  []byte
+	nbit uint
+}
+
+func (w *bitWriter) writeBit(bit byte) {
+	if w.nbit%8 == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	if bit != 0 {
+		w.buf[len(w.buf)-1] |= 0x80 >> (w.nbit % 8)
+	}
+	w.nbit++
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint8) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.writeBit(byte(v >> i & 1))
+	}
+}
+
+type bitReader struct {
+	buf  []byte
+	nbit uint
+}
+
+func (r *bitReader) readBit() (byte, bool) {
+	if r.nbit >= uint(len(r.buf))*8 {
+		return 0, false
+	}
+	bit := r.buf[r.nbit/8] >> (7 - r.nbit%8) & 1
+	r.nbit++
+	return bit, true
+}
+
+func (r *bitReader) readBits(n uint8) (uint64, bool) {
+	var v uint64
+	for i := uint8(0); i < n; i++ {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		v = v<<1 | uint64(bit)
+	}
+	return v, true
+}
+
+type CacheDigestMsg struct {
+	Version    uint8
+	Fresh      GolombSet
+	Validators GolombSet
+}
+
+func validatorKey(url, etag string) string {
+	return url + "\x00" + etag
+}
+
+// CacheDigest is the server side view of a client's cache.
+type CacheDigest struct {
+	fresh, validators         []uint64
+	freshN, validatorsN       uint32
+	freshLogP, validatorsLogP uint8
+}
+
+func ReadCacheDigest(r io.Reader) (*CacheDigest, error) {
+	var msg CacheDigestMsg
+	if err := kbinary.NewDecoder(r).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("failed to decode CacheDigestMsg: %w", err)
+	}
+	if msg.Version != cacheDigestVersion {
+		return nil, fmt.Errorf("unsupported cache digest version: %d", msg.Version)
+	}
+	fresh, err := msg.Fresh.decode()
+	if err != nil {
+		return nil, err
+	}
+	validators, err := msg.Validators.decode()
+	if err != nil {
+		return nil, err
+	}
+	return &CacheDigest{
+		fresh:          fresh,
+		freshN:         msg.Fresh.N,
+		freshLogP:      msg.Fresh.LogP,
+		validators:     validators,
+		validatorsN:    msg.Validators.N,
+		validatorsLogP: msg.Validators.LogP,
+	}, nil
+}
+
+func containsHash(hashes []uint64, key string, n uint32, logP uint8) bool {
+	if n == 0 {
+		return false
+	}
+	h := hashDigestKey(key, n, logP)
+	i := sort.Search(len(hashes), func(i int) bool { return hashes[i] >= h })
+	return i < len(hashes) && hashes[i] == h
+}
+
+// HasFresh reports whether the client probably has a fresh copy of url.
+func (d *CacheDigest) HasFresh(url string) bool {
+	return d != nil && containsHash(d.fresh, url, d.freshN, d.freshLogP)
+}
+
+// HasValidator reports whether the client probably has url with etag,
+// fresh or not.
+func (d *CacheDigest) HasValidator(url, etag string) bool {
+	return d != nil && etag != "" &&
+		containsHash(d.validators, validatorKey(url, etag), d.validatorsN, d.validatorsLogP)
+}
+
+type cacheIndexEntry struct {
+	etag     string
+	expireAt time.Time
+}
+
+// cacheIndex mirrors what the client's prefetch cache admitted, for
+// building digests.
+type cacheIndex struct {
+	mu      sync.Mutex
+	entries map[string]cacheIndexEntry
+	dirty   bool
+}
+
+func newCacheIndex() *cacheIndex {
+	return &cacheIndex{
+		entries: make(map[string]cacheIndexEntry),
+	}
+}
+
+// freshness is how long resp may be served from cache, 0 if not at all.
+func freshness(resp *http.Response) time.Duration {
+	cc := strings.ToLower(resp.Header.Get("Cache-Control"))
+	if strings.Contains(cc, "no-store") || strings.Contains(cc, "no-cache") {
+		return 0
+	}
+	for _, directive := range strings.Split(cc, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if k == "max-age" {
+			if secs, err := strconv.Atoi(v); err == nil {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return defaultCacheDigestTTL
+}
+
+func (idx *cacheIndex) add(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	url := resp.Request.URL.String()
+	ttl := freshness(resp)
+	if resp.StatusCode != http.StatusOK || ttl <= 0 {
+		if resp.StatusCode != http.StatusNotModified {
+			// the cache can't have admitted it
+			idx.remove(url)
+		}
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.entries[url]; !ok && len(idx.entries) >= maxCacheDigestKeys {
+		idx.evictLocked(time.Now())
+	}
+	idx.entries[url] = cacheIndexEntry{
+		etag:     resp.Header.Get("Etag"),
+		expireAt: time.Now().Add(ttl),
+	}
+	idx.dirty = true
+}
+
+// remove drops url, e.g. fetched again without validators so the cache
+// didn't have it anymore.
+func (idx *cacheIndex) remove(url string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.entries[url]; ok {
+		delete(idx.entries, url)
+		idx.dirty = true
+	}
+}
+
+// expired reports whether e is of no use in a digest anymore.
+func (e cacheIndexEntry) expired(now time.Time) bool {
+	if e.etag == "" {
+		return !now.Before(e.expireAt)
+	}
+	return now.Sub(e.expireAt) > maxCacheDigestStaleness
+}
+
+// evictLocked drops the expired entries, then those expiring first until
+// an eighth of the index is free, so it's not done on every add.
+func (idx *cacheIndex) evictLocked(now time.Time) {
+	for url, e := range idx.entries {
+		if e.expired(now) {
+			delete(idx.entries, url)
+		}
+	}
+	target := maxCacheDigestKeys - maxCacheDigestKeys/8
+	if len(idx.entries) <= target {
+		return
+	}
+	urls := maps.Keys(idx.entries)
+	sort.Slice(urls, func(i, j int) bool {
+		return idx.entries[urls[i]].expireAt.Before(idx.entries[urls[j]].expireAt)
+	})
+	for _, url := range urls[:len(urls)-target] {
+		delete(idx.entries, url)
+	}
+}
+
+// has reports whether url is cached fresh, or with etag.
+func (idx *cacheIndex) has(url, etag string) bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[url]
+	return ok && (time.Now().Before(e.expireAt) || etag != "" && e.etag == etag)
+}
+
+// digest builds the digest of the index, entries past their freshness stay
+// in the validators set.
+func (idx *cacheIndex) digest() *CacheDigestMsg {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.dirty = false
+
+	now := time.Now()
+	var fresh, validators []string
+	for url, e := range idx.entries {
+		if e.expired(now) {
+			delete(idx.entries, url)
+			continue
+		}
+		if now.Before(e.expireAt) {
+			fresh = append(fresh, url)
+		}
+		if e.etag != "" {
+			validators = append(validators, validatorKey(url, e.etag))
+		}
+	}
+	return &CacheDigestMsg{
+		Version:    cacheDigestVersion,
+		Fresh:      *NewGolombSet(fresh, cacheDigestLogP),
+		Validators: *NewGolombSet(validators, cacheDigestLogP),
+	}
+}
+
+func (idx *cacheIndex) isDirty() bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.dirty
+}
@@ -0,0 +1,176 @@
+package prefetch
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kelindar/binary"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CacheDigest", func() {
+	newResponse := func(url, etag, cacheControl string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Request:    req,
+		}
+		resp.Header.Set("Etag", etag)
+		resp.Header.Set("Cache-Control", cacheControl)
+		return resp
+	}
+
+	roundTrip := func(idx *cacheIndex) *CacheDigest {
+		buf := &bytes.Buffer{}
+		Expect(binary.MarshalTo(idx.digest(), buf)).To(BeNil())
+		digest, err := ReadCacheDigest(buf)
+		Expect(err).To(BeNil())
+		return digest
+	}
+
+	It("should contain every key with few false positives", func() {
+		idx := newCacheIndex()
+		for i := 0; i < 1000; i++ {
+			idx.add(newResponse(fmt.Sprintf("https://example.com/%d.js", i), fmt.Sprintf(`"%d"`, i), "max-age=3600"))
+		}
+		msg := idx.digest()
+		// about logP+2 bits a key
+		Expect(len(msg.Fresh.Data)).To(BeNumerically("<", 1000*10/8))
+
+		digest := roundTrip(idx)
+		for i := 0; i < 1000; i++ {
+			url := fmt.Sprintf("https://example.com/%d.js", i)
+			Expect(digest.HasFresh(url)).To(BeTrue())
+			Expect(digest.HasValidator(url, fmt.Sprintf(`"%d"`, i))).To(BeTrue())
+		}
+		falsePositives := 0
+		for i := 0; i < 10000; i++ {
+			if digest.HasFresh(fmt.Sprintf("https://example.org/%d.js", i)) {
+				falsePositives++
+			}
+		}
+		// 1/128 expected
+		Expect(falsePositives).To(BeNumerically("<", 200))
+	})
+
+	It("should keep stale entries as validators only", func() {
+		idx := newCacheIndex()
+		idx.add(newResponse("https://example.com/stale.js", `"v1"`, "max-age=0"))
+		idx.add(newResponse("https://example.com/fresh.js", `"v1"`, ""))
+		idx.add(newResponse("https://example.com/private.js", `"v1"`, "no-store"))
+		// max-age=0 isn't cacheable at all
+		Expect(idx.entries).To(HaveLen(1))
+
+		idx.entries["https://example.com/stale.js"] = cacheIndexEntry{etag: `"v1"`, expireAt: time.Now().Add(-time.Minute)}
+		digest := roundTrip(idx)
+		Expect(digest.HasFresh("https://example.com/fresh.js")).To(BeTrue())
+		Expect(digest.HasFresh("https://example.com/stale.js")).To(BeFalse())
+		Expect(digest.HasValidator("https://example.com/stale.js", `"v1"`)).To(BeTrue())
+		Expect(digest.HasValidator("https://example.com/stale.js", `"v2"`)).To(BeFalse())
+		Expect(digest.HasFresh("https://example.com/private.js")).To(BeFalse())
+	})
+
+	It("should evict expired entries", func() {
+		idx := newCacheIndex()
+		idx.add(newResponse("https://example.com/fresh.js", `"v1"`, "max-age=3600"))
+		idx.entries["https://example.com/expired.js"] = cacheIndexEntry{expireAt: time.Now().Add(-time.Minute)}
+		idx.entries["https://example.com/forgotten.js"] = cacheIndexEntry{
+			etag:     `"v1"`,
+			expireAt: time.Now().Add(-2 * maxCacheDigestStaleness),
+		}
+		digest := roundTrip(idx)
+		Expect(idx.entries).To(HaveLen(1))
+		Expect(digest.HasValidator("https://example.com/forgotten.js", `"v1"`)).To(BeFalse())
+	})
+
+	It("should update entries and make room when full", func() {
+		idx := newCacheIndex()
+		now := time.Now()
+		for i := 0; i < maxCacheDigestKeys; i++ {
+			idx.entries[fmt.Sprintf("https://example.com/%d.js", i)] = cacheIndexEntry{
+				expireAt: now.Add(time.Duration(i+1) * time.Second),
+			}
+		}
+		idx.entries["https://example.com/0.js"] = cacheIndexEntry{expireAt: now.Add(-time.Second)}
+
+		// an update doesn't evict anything
+		idx.add(newResponse("https://example.com/1.js", `"v2"`, "max-age=3600"))
+		Expect(idx.entries).To(HaveLen(maxCacheDigestKeys))
+		Expect(idx.entries["https://example.com/1.js"].etag).To(Equal(`"v2"`))
+
+		// a new key evicts the expired ones, then those expiring first
+		idx.add(newResponse("https://example.com/new.js", `"v1"`, "max-age=3600"))
+		Expect(idx.entries).To(HaveKey("https://example.com/new.js"))
+		Expect(idx.entries).To(HaveKey(fmt.Sprintf("https://example.com/%d.js", maxCacheDigestKeys-1)))
+		Expect(idx.entries).NotTo(HaveKey("https://example.com/0.js"))
+		Expect(idx.entries).NotTo(HaveKey("https://example.com/2.js"))
+		Expect(len(idx.entries)).To(BeNumerically("<=", maxCacheDigestKeys-maxCacheDigestKeys/8+1))
+	})
+
+	It("should drop entries the cache no longer has", func() {
+		idx := newCacheIndex()
+		idx.add(newResponse("https://example.com/a.js", `"v1"`, "max-age=3600"))
+		Expect(idx.has("https://example.com/a.js", "")).To(BeTrue())
+
+		// refetched without validators, and not cacheable this time
+		gone := newResponse("https://example.com/a.js", "", "no-store")
+		idx.add(gone)
+		Expect(idx.has("https://example.com/a.js", "")).To(BeFalse())
+
+		idx.add(newResponse("https://example.com/b.js", `"v1"`, "max-age=3600"))
+		notModified := newResponse("https://example.com/b.js", `"v1"`, "")
+		notModified.StatusCode = http.StatusNotModified
+		idx.add(notModified)
+		Expect(idx.has("https://example.com/b.js", "")).To(BeTrue())
+	})
+
+	It("should contain nothing when empty or missing", func() {
+		digest := roundTrip(newCacheIndex())
+		Expect(digest.HasFresh("https://example.com/a.js")).To(BeFalse())
+		var missing *CacheDigest
+		Expect(missing.HasFresh("https://example.com/a.js")).To(BeFalse())
+		Expect(missing.HasValidator("https://example.com/a.js", `"v1"`)).To(BeFalse())
+	})
+
+	It("should reject truncated sets", func() {
+		set := NewGolombSet([]string{"a", "b", "c"}, cacheDigestLogP)
+		set.Data = set.Data[:1]
+		_, err := set.decode()
+		Expect(err).To(Equal(errCacheDigestCorrupt))
+	})
+
+	It("should skip urls in the digest", func() {
+		idx := newCacheIndex()
+		idx.add(newResponse("https://example.com/cached.js", `"v1"`, "max-age=3600"))
+		ps := &PrefetchServer{}
+		Expect(ps.clientHasFresh("https://example.com/cached.js")).To(BeFalse())
+
+		buf := &bytes.Buffer{}
+		Expect(binary.MarshalTo(idx.digest(), buf)).To(BeNil())
+		Expect(ps.ReceiveCacheDigest(buf)).To(BeNil())
+		Expect(ps.clientHasFresh("https://example.com/cached.js")).To(BeTrue())
+		Expect(ps.clientHasFresh("https://example.com/new.js")).To(BeFalse())
+	})
+
+	It("should serve pushed images from the client's cache", func() {
+		pc := &PrefetchClient{index: newCacheIndex()}
+		for _, url := range []string{
+			"https://example.com/img/hero.webp",
+			"https://example.com/favicon.ico",
+		} {
+			pushed := newResponse(url, `"1"`, "max-age=60")
+			Expect(pc.FilterRequest(pushed.Request)).To(BeTrue())
+			pc.index.add(pushed)
+			// pushed again it's turned down, requested it goes to the cache
+			Expect(pc.acceptPush(url, pushed.Header)).To(BeFalse())
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			Expect(pc.FilterRequest(req)).To(BeTrue())
+		}
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/api/bootstrap.json", nil)
+		Expect(pc.FilterRequest(req)).To(BeFalse())
+	})
+})
@@ -0,0 +1,89 @@
+package prefetch
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	kbinary "github.com/kelindar/binary"
+)
+
+// The client's cache answers the browser's requests for what was pushed or
+// fetched before, the server never sees those. The client reports them so
+// the predictor still credits the resources it predicted.
+
+const (
+	// how often the hits so far are sent, well within a prediction window
+	cacheHitsInterval  = time.Second
+	maxCacheHitsPerMsg = 256
+)
+
+type CacheHit struct {
+	Url     string
+	Referer string
+	// requested as an ES module
+	Module bool
+}
+
+type CacheHitsMsg struct {
+	Hits []CacheHit
+}
+
+func ReadCacheHits(r io.Reader) (*CacheHitsMsg, error) {
+	var msg CacheHitsMsg
+	if err := kbinary.NewDecoder(r).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("failed to decode CacheHitsMsg: %w", err)
+	}
+	if len(msg.Hits) > maxCacheHitsPerMsg {
+		msg.Hits = msg.Hits[:maxCacheHitsPerMsg]
+	}
+	return &msg, nil
+}
+
+// cacheHit queues req's hit for the next report, it's dropped if the
+// queue is full.
+func (pc *PrefetchClient) cacheHit(req *http.Request) {
+	hit := CacheHit{
+		Url:     req.URL.String(),
+		Referer: req.Header.Get("Referer"),
+		Module:  isModuleRequest(req),
+	}
+	select {
+	case pc.hits <- hit:
+	default:
+	}
+}
+
+func (pc *PrefetchClient) sendCacheHits(dialFn func(string) (net.Conn, error)) {
+	ticker := time.NewTicker(cacheHitsInterval)
+	defer ticker.Stop()
+	msg := &CacheHitsMsg{}
+	for {
+		select {
+		case hit := <-pc.hits:
+			if len(msg.Hits) < maxCacheHitsPerMsg {
+				msg.Hits = append(msg.Hits, hit)
+			}
+		case <-ticker.C:
+			if len(msg.Hits) == 0 {
+				continue
+			}
+			if err := pc.sendCacheHitsMsg(dialFn, msg); err != nil {
+				pc.logger.Error("send cache hits: ", err)
+			}
+			// they're only of use within the prediction window
+			msg = &CacheHitsMsg{}
+		}
+	}
+}
+
+func (pc *PrefetchClient) sendCacheHitsMsg(dialFn func(string) (net.Conn, error), msg *CacheHitsMsg) error {
+	conn, err := dialFn("cacheHits")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return kbinary.MarshalTo(msg, conn)
+}
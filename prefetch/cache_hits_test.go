@@ -0,0 +1,85 @@
+package prefetch
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/kelindar/binary"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// cacheDoer answers the urls in cached itself and fetches the rest, like
+// the client's cache.
+type cacheDoer struct {
+	cached map[string]bool
+	next   *perRequestHTTPClient
+}
+
+func (d *cacheDoer) Do(req *http.Request) (*http.Response, error) {
+	if d.cached[req.URL.String()] {
+		return &http.Response{StatusCode: http.StatusOK, Request: req}, nil
+	}
+	return d.next.Do(req)
+}
+
+var _ = Describe("CacheHits", func() {
+	It("should report the requests the cache answered", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer origin.Close()
+		pc := &PrefetchClient{index: newCacheIndex(), hits: make(chan CacheHit, 1)}
+		pc.client = &cacheDoer{
+			cached: map[string]bool{"https://example.com/pushed.mjs": true},
+			next:   &perRequestHTTPClient{pc.index},
+		}
+
+		do := func(url string) {
+			ctx := context.WithValue(context.Background(), "client", origin.Client())
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			req.Header.Set("Referer", "https://example.com/a")
+			_, err := pc.Do(req)
+			Expect(err).To(BeNil())
+		}
+		do(origin.URL + "/fetched.js")
+		Expect(pc.hits).To(BeEmpty())
+		do("https://example.com/pushed.mjs")
+		Expect(pc.hits).To(Receive(Equal(CacheHit{
+			Url:     "https://example.com/pushed.mjs",
+			Referer: "https://example.com/a",
+			Module:  true,
+		})))
+	})
+
+	It("should credit predictions the client's cache answered", func() {
+		p, err := NewPredictor(PredictorOptions{
+			StorePath:     GinkgoT().TempDir() + "/history.json",
+			MinConfidence: 0.5,
+			MinVisits:     2,
+		})
+		Expect(err).To(BeNil())
+		ps := &PrefetchServer{predictor: p, session: newPredictionSession(p)}
+		visit := func(doc string) []string {
+			u, _ := url.Parse(doc)
+			return ps.visitDocument(u)
+		}
+		receive := func(msg *CacheHitsMsg) {
+			buf := &bytes.Buffer{}
+			Expect(binary.MarshalTo(msg, buf)).To(BeNil())
+			Expect(ps.ReceiveCacheHits(buf)).To(BeNil())
+		}
+
+		for _, doc := range []string{"https://example.com/item/111", "https://example.com/item/222"} {
+			visit(doc)
+			ps.session.requested("https://example.com/app.js", doc, false)
+		}
+		// pushed from now on, the browser only asks the client's cache
+		for _, doc := range []string{"https://example.com/item/333", "https://example.com/item/444", "https://example.com/item/555"} {
+			Expect(visit(doc)).To(Equal([]string{"https://example.com/app.js"}))
+			receive(&CacheHitsMsg{Hits: []CacheHit{{Url: "https://example.com/app.js", Referer: doc}}})
+		}
+		Expect(visit("https://example.com/item/666")).To(Equal([]string{"https://example.com/app.js"}))
+	})
+})
@@ -1,10 +1,14 @@
 package prefetch
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 
+	"github.com/kelindar/binary"
 	"github.com/sagernet/sing-box/log"
 	"github.com/zckevin/go-libs/httpclient"
 	"github.com/zckevin/http2-mitm-proxy/common"
@@ -17,27 +21,77 @@ type PrefetchClient struct {
 	pushRespCh chan *http.Response
 
 	client common.HTTPRequestDoer
+	// what the cache admitted, sent to the server as digests
+	index *cacheIndex
+	// requests the cache answered, reported to the server
+	hits chan CacheHit
 }
 
+const (
+	// how often a changed cache digest is sent
+	cacheDigestInterval = 10 * time.Second
+	// an unchanged one is still resent, the server forgets it with its
+	// tunnel conn
+	cacheDigestRefresh = 2 * time.Minute
+)
+
 func NewPrefetchClient(
 	dialPrefetchStream func(string) (net.Conn, error),
+	dialCacheDigestStream func(string) (net.Conn, error),
+	dialCacheHitsStream func(string) (net.Conn, error),
 ) *PrefetchClient {
 	pushRespCh := make(chan *http.Response, 16)
 	pc := &PrefetchClient{
 		logger:     common.NewLogger("PrefetchClient"),
-		channel:    NewPushChannelClient(dialPrefetchStream, pushRespCh),
 		pushRespCh: pushRespCh,
+		index:      newCacheIndex(),
+		hits:       make(chan CacheHit, maxCacheHitsPerMsg),
 	}
+	pc.channel = NewPushChannelClient(dialPrefetchStream, pushRespCh, pc.acceptPush)
 	pc.createHTTPClient()
+	go pc.sendCacheDigests(dialCacheDigestStream)
+	go pc.sendCacheHits(dialCacheHitsStream)
 	return pc
 }
 
+// acceptPush turns down pushes of what the cache already has, the server
+// only learns it with the next cache digest.
+func (pc *PrefetchClient) acceptPush(url string, header http.Header) bool {
+	return !pc.index.has(url, header.Get("Etag"))
+}
+
+func (pc *PrefetchClient) sendCacheDigests(dialFn func(string) (net.Conn, error)) {
+	ticker := time.NewTicker(cacheDigestInterval)
+	defer ticker.Stop()
+	var lastSent time.Time
+	for range ticker.C {
+		if !pc.index.isDirty() && time.Since(lastSent) < cacheDigestRefresh {
+			continue
+		}
+		if err := pc.sendCacheDigest(dialFn); err != nil {
+			pc.logger.Error("send cache digest: ", err)
+			continue
+		}
+		lastSent = time.Now()
+	}
+}
+
+func (pc *PrefetchClient) sendCacheDigest(dialFn func(string) (net.Conn, error)) error {
+	conn, err := dialFn("cacheDigest")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return binary.MarshalTo(pc.index.digest(), conn)
+}
+
 func (pc *PrefetchClient) createHTTPClient() {
 	cache := httpclient.NewMemcacheImpl(common.GetCacheKey)
-	client := httpclient.NewCachedHTTPClient(cache, &perRequestHTTPClient{})
+	client := httpclient.NewCachedHTTPClient(cache, &perRequestHTTPClient{pc.index})
 	go func() {
 		for resp := range pc.pushRespCh {
 			fmt.Println("=== recv push resp ===", resp.Request.URL)
+			pc.index.add(resp)
 			client.ReceivePush(resp)
 		}
 	}()
@@ -51,16 +105,37 @@ func (pc *PrefetchClient) FilterRequest(req *http.Request) (result bool) {
 	return common.IsRequestCachable(req)
 }
 
+type fetchedKey struct{}
+
+// Do answers req from the cache, or else fetches it through the server.
 func (pc *PrefetchClient) Do(req *http.Request) (*http.Response, error) {
-	return pc.client.Do(req)
+	fetched := &atomic.Bool{}
+	resp, err := pc.client.Do(req.WithContext(context.WithValue(req.Context(), fetchedKey{}, fetched)))
+	if err == nil && !fetched.Load() {
+		pc.cacheHit(req)
+	}
+	return resp, err
 }
 
-type perRequestHTTPClient struct{}
+type perRequestHTTPClient struct {
+	index *cacheIndex
+}
 
 func (c *perRequestHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if fetched, ok := req.Context().Value(fetchedKey{}).(*atomic.Bool); ok {
+		fetched.Store(true)
+	}
 	client, ok := req.Context().Value("client").(*http.Client)
 	if !ok {
 		return nil, fmt.Errorf("perRequestHTTPClient: client not found in request context")
 	}
-	return client.Do(req)
+	if req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		// the cache has no copy to revalidate, e.g. it evicted it
+		c.index.remove(req.URL.String())
+	}
+	resp, err := client.Do(req)
+	if err == nil {
+		c.index.add(resp)
+	}
+	return resp, err
 }
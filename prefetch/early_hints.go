@@ -0,0 +1,119 @@
+package prefetch
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	htmlparser "github.com/zckevin/http2-mitm-proxy/prefetch/html_parser"
+)
+
+const (
+	// Link values of a 103, browsers ignore preloads past a few dozen
+	maxEarlyHints = 16
+	// how long the resources found in a document are hinted to the next
+	// ones of its pattern
+	scannedHintsTTL = time.Hour
+)
+
+// isDocumentRequest reports whether r is likely a navigation, browsers
+// only act on 103 Early Hints of those.
+func isDocumentRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" {
+		return dest == "document"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// preloadLink returns the Link header value preloading resourceUrl, an ES
+// module if module, "" if its type isn't known. A preload is only used by a
+// fetch of the same CORS mode: fonts are always fetched with CORS, modules
+// too but modulepreload defaults to it like <script type=module> does,
+// classic scripts and styles without.
+func preloadLink(resourceUrl string, module bool) string {
+	u, err := url.Parse(resourceUrl)
+	if err != nil {
+		return ""
+	}
+	ext := strings.ToLower(path.Ext(u.Path))
+	if module && ext != ".css" {
+		return fmt.Sprintf("<%s>; rel=modulepreload", u)
+	}
+	switch ext {
+	case ".css":
+		return fmt.Sprintf("<%s>; rel=preload; as=style", u)
+	case ".js":
+		return fmt.Sprintf("<%s>; rel=preload; as=script", u)
+	case ".mjs":
+		return fmt.Sprintf("<%s>; rel=modulepreload", u)
+	case ".woff", ".woff2", ".ttf", ".otf":
+		return fmt.Sprintf("<%s>; rel=preload; as=font; crossorigin", u)
+	}
+	return ""
+}
+
+// EarlyHints returns the Link header values of a 103 Early Hints for
+// document request r, sent while the origin is still working on it so the
+// browser requests the document's subresources from the pushed cache
+// sooner. The body isn't there yet, so they're the predicted ones and
+// those found in the latest document of the same pattern.
+func (ps *PrefetchServer) EarlyHints(r *http.Request) (links []string) {
+	if !ps.earlyHints || !isDocumentRequest(r) {
+		return nil
+	}
+	seen := make(map[string]bool)
+	add := func(link string) {
+		if link != "" && !seen[link] && len(links) < maxEarlyHints {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	for _, resourceUrl := range ps.predictor.Predict(r.URL) {
+		add(preloadLink(resourceUrl, ps.predictor.isModule(r.URL, resourceUrl)))
+	}
+	if ps.scannedHints == nil {
+		return links
+	}
+	if scanned, ok := ps.scannedHints.Get(documentPattern(r.URL)); ok {
+		for _, link := range scanned.([]string) {
+			add(link)
+		}
+	}
+	return links
+}
+
+// scannedHintsRecorder collects the preload links of the resources found
+// in document docUrl, call done once it's scanned to hint them to the next
+// documents of its pattern. Both are no-ops if early hints are off.
+func (ps *PrefetchServer) scannedHintsRecorder(docUrl *url.URL) (found func(htmlparser.Resource), done func()) {
+	if !ps.earlyHints || ps.scannedHints == nil {
+		return func(htmlparser.Resource) {}, func() {}
+	}
+	var (
+		mu    sync.Mutex
+		links []string
+	)
+	found = func(r htmlparser.Resource) {
+		link := preloadLink(r.URL, r.Module)
+		mu.Lock()
+		defer mu.Unlock()
+		if link != "" && len(links) < maxEarlyHints {
+			links = append(links, link)
+		}
+	}
+	done = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(links) > 0 {
+			ps.scannedHints.Set(documentPattern(docUrl), links)
+		}
+	}
+	return found, done
+}
@@ -0,0 +1,93 @@
+package prefetch
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/zckevin/http2-mitm-proxy/common"
+	htmlparser "github.com/zckevin/http2-mitm-proxy/prefetch/html_parser"
+)
+
+var _ = Describe("EarlyHints", func() {
+	It("should build preload links by type", func() {
+		Expect(preloadLink("https://example.com/a.css?v=1", false)).To(Equal("<https://example.com/a.css?v=1>; rel=preload; as=style"))
+		Expect(preloadLink("https://example.com/a.js", false)).To(Equal("<https://example.com/a.js>; rel=preload; as=script"))
+		Expect(preloadLink("https://example.com/a.js", true)).To(Equal("<https://example.com/a.js>; rel=modulepreload"))
+		Expect(preloadLink("https://example.com/a.mjs", false)).To(Equal("<https://example.com/a.mjs>; rel=modulepreload"))
+		Expect(preloadLink("https://fonts.example.net/a.woff2", false)).To(Equal("<https://fonts.example.net/a.woff2>; rel=preload; as=font; crossorigin"))
+		Expect(preloadLink("https://example.com/api", false)).To(Equal(""))
+	})
+
+	It("should hint predicted resources of documents", func() {
+		p, err := NewPredictor(PredictorOptions{
+			StorePath:     filepath.Join(GinkgoT().TempDir(), "history.json"),
+			Window:        time.Second,
+			MinConfidence: 0.5,
+			MinVisits:     2,
+		})
+		Expect(err).To(BeNil())
+		s := newPredictionSession(p)
+		for _, doc := range []string{"https://example.com/item/111", "https://example.com/item/222", "https://example.com/item/333"} {
+			u, _ := url.Parse(doc)
+			s.documentVisited(u)
+			s.requested("https://example.com/app.css", doc, false)
+			s.requested("https://example.com/app.js", doc, true)
+		}
+
+		newRequest := func(dest string) *http.Request {
+			r, _ := http.NewRequest(http.MethodGet, "https://example.com/item/444", nil)
+			r.Header.Set("Sec-Fetch-Dest", dest)
+			return r
+		}
+		ps := &PrefetchServer{predictor: p, earlyHints: true}
+		Expect(ps.EarlyHints(newRequest("document"))).To(Equal([]string{
+			"<https://example.com/app.css>; rel=preload; as=style",
+			"<https://example.com/app.js>; rel=modulepreload",
+		}))
+		Expect(ps.EarlyHints(newRequest("script"))).To(BeEmpty())
+
+		ps.earlyHints = false
+		Expect(ps.EarlyHints(newRequest("document"))).To(BeEmpty())
+	})
+
+	It("should hint resources found in the latest document of the pattern", func() {
+		ps := &PrefetchServer{earlyHints: true, scannedHints: common.NewTTLCache(time.Minute, time.Minute)}
+		doc, _ := url.Parse("https://example.com/item/111")
+		found, done := ps.scannedHintsRecorder(doc)
+		found(htmlparser.Resource{URL: "https://example.com/app.css"})
+		found(htmlparser.Resource{URL: "https://example.com/app.js", Module: true})
+		found(htmlparser.Resource{URL: "https://example.com/api"})
+
+		r, _ := http.NewRequest(http.MethodGet, "https://example.com/item/222", nil)
+		r.Header.Set("Sec-Fetch-Dest", "document")
+		Expect(ps.EarlyHints(r)).To(BeEmpty())
+		done()
+		Expect(ps.EarlyHints(r)).To(Equal([]string{
+			"<https://example.com/app.css>; rel=preload; as=style",
+			"<https://example.com/app.js>; rel=modulepreload",
+		}))
+		other, _ := http.NewRequest(http.MethodGet, "https://example.com/about", nil)
+		other.Header.Set("Sec-Fetch-Dest", "document")
+		Expect(ps.EarlyHints(other)).To(BeEmpty())
+	})
+
+	It("should tell module requests from classic script ones", func() {
+		newRequest := func(u, dest, mode string) *http.Request {
+			r, _ := http.NewRequest(http.MethodGet, u, nil)
+			if dest != "" {
+				r.Header.Set("Sec-Fetch-Dest", dest)
+				r.Header.Set("Sec-Fetch-Mode", mode)
+			}
+			return r
+		}
+		Expect(isModuleRequest(newRequest("https://example.com/a.js", "script", "cors"))).To(BeTrue())
+		Expect(isModuleRequest(newRequest("https://example.com/a.js", "script", "no-cors"))).To(BeFalse())
+		Expect(isModuleRequest(newRequest("https://example.com/a.css", "style", "no-cors"))).To(BeFalse())
+		Expect(isModuleRequest(newRequest("https://example.com/a.mjs", "", ""))).To(BeTrue())
+		Expect(isModuleRequest(newRequest("https://example.com/a.js", "", ""))).To(BeFalse())
+	})
+})
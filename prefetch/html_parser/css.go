@@ -0,0 +1,141 @@
+package html_parser
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/zckevin/http2-mitm-proxy/common"
+	"github.com/zckevin/http2-mitm-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	css_comment_regexp = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	// @import "a.css"; @import url(a.css) screen;
+	css_import_regexp    = regexp.MustCompile(`@import\s+(?:url\(\s*)?(?:"([^"]*)"|'([^']*)'|([^\s;)]+))`)
+	css_url_regexp       = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)`)
+	css_font_face_regexp = regexp.MustCompile(`(?s)@font-face\s*\{[^}]*\}`)
+	// stylesheets are parsed whole, unlike documents, but not unbounded
+	css_read_limit = 512 * 1024
+)
+
+// IsStylesheet reports whether resp is CSS worth parsing for dependencies.
+func IsStylesheet(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK &&
+		(strings.Contains(resp.Header.Get("Content-Type"), "text/css") ||
+			strings.HasSuffix(resp.Request.URL.Path, ".css"))
+}
+
+func firstSubmatch(m []string) string {
+	for _, s := range m[1:] {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func isFontUrl(u *url.URL) bool {
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".woff", ".woff2", ".ttf", ".otf", ".eot":
+		return true
+	}
+	return false
+}
+
+// findLinksInCSS returns the dependencies of a stylesheet of types,
+// resolved against the stylesheet's url: @imports first as they're render
+// blocking, then fonts, then the images of rules, e.g. backgrounds.
+func findLinksInCSS(css string, base *url.URL, types ResourceTypes) (resources []string) {
+	css = css_comment_regexp.ReplaceAllString(css, "")
+	seen := make(map[string]bool)
+	resolve := func(ref string) *url.URL {
+		ref = strings.TrimSpace(ref)
+		if ref == "" || strings.HasPrefix(ref, "data:") || strings.HasPrefix(ref, "#") {
+			return nil
+		}
+		target, err := url.Parse(ref)
+		if err != nil {
+			return nil
+		}
+		resolved := base.ResolveReference(target)
+		resolved.Fragment = ""
+		if seen[resolved.String()] {
+			return nil
+		}
+		// seen even if not wanted, an @import url() isn't an image
+		seen[resolved.String()] = true
+		return resolved
+	}
+	add := func(u *url.URL, wanted bool) {
+		if u != nil && wanted {
+			resources = append(resources, u.String())
+		}
+	}
+
+	for _, m := range css_import_regexp.FindAllStringSubmatch(css, -1) {
+		add(resolve(firstSubmatch(m)), types.Stylesheets)
+	}
+	for _, block := range css_font_face_regexp.FindAllString(css, -1) {
+		for _, m := range css_url_regexp.FindAllStringSubmatch(block, -1) {
+			add(resolve(firstSubmatch(m)), types.Fonts)
+		}
+	}
+	rules := css_font_face_regexp.ReplaceAllString(css, "")
+	for _, m := range css_url_regexp.FindAllStringSubmatch(rules, -1) {
+		if u := resolve(firstSubmatch(m)); u != nil {
+			add(u, isFontUrl(u) && types.Fonts || !isFontUrl(u) && types.Images)
+		}
+	}
+	return resources
+}
+
+func parseCSS(ctx context.Context, r io.Reader, encoding string, base *url.URL, types ResourceTypes) (_ []string, err error) {
+	_, span := tracing.GetTracer(ctx, "html_parser").Start(ctx, "parseCSS")
+	defer span.End()
+
+	cr, err := common.WrapCompressedReader(r, encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+	buf, err := io.ReadAll(io.LimitReader(cr, int64(css_read_limit)))
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("cssLength", len(buf)))
+	return findLinksInCSS(string(buf), base, types), nil
+}
+
+// ScanStylesheet reports the dependencies of stylesheet resp of types to
+// found as they're parsed, from a goroutine reading a fork of the body, so
+// resp can be pushed meanwhile. done gets the error once it's parsed.
+func ScanStylesheet(ctx context.Context, resp *http.Response, types ResourceTypes, found func(url string)) (done <-chan error) {
+	bodyWrapper := wrapRespBody(resp)
+	resp.Body = bodyWrapper
+	fork := bodyWrapper.Fork()
+	encoding, base := resp.Header.Get("Content-Encoding"), resp.Request.URL
+
+	errCh := make(chan error, 1)
+	go func() {
+		ctx, span := tracing.GetTracer(ctx, "html_parser").Start(ctx, "ScanStylesheet")
+		defer span.End()
+		defer fork.Close()
+
+		urls, err := parseCSS(ctx, fork, encoding, base, types)
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.SetAttributes(attribute.StringSlice("resourcesUrls", urls))
+		for _, url := range urls {
+			found(url)
+		}
+		errCh <- err
+	}()
+	return errCh
+}
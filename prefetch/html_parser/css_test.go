@@ -0,0 +1,68 @@
+package html_parser
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CSS", func() {
+	base, _ := url.Parse("https://cdn.example.com/css/main.css?v=1")
+
+	css := `
+@charset "utf-8";
+@import "reset.css";
+@import url('https://fonts.example.com/css?family=Roboto') screen;
+/* @import "commented.css"; */
+@font-face {
+	font-family: "Icons";
+	src: url(../fonts/icons.woff2#iefix) format("woff2"),
+	     url("../fonts/icons.woff") format("woff");
+}
+.hero { background: url( "/img/hero.jpg" ) no-repeat; }
+.dot { background: url(data:image/png;base64,iVBORw0KGgo=); }
+.again { background: url(/img/hero.jpg); }
+`
+
+	all := ResourceTypes{Stylesheets: true, Fonts: true, Images: true}
+
+	It("should find imports first, then fonts and images, resolved against the stylesheet", func() {
+		Expect(findLinksInCSS(css, base, all)).To(Equal([]string{
+			"https://cdn.example.com/css/reset.css",
+			"https://fonts.example.com/css?family=Roboto",
+			"https://cdn.example.com/fonts/icons.woff2",
+			"https://cdn.example.com/fonts/icons.woff",
+			"https://cdn.example.com/img/hero.jpg",
+		}))
+	})
+
+	It("should only find the types asked for", func() {
+		Expect(findLinksInCSS(css, base, DefaultResourceTypes)).To(Equal([]string{
+			"https://cdn.example.com/css/reset.css",
+			"https://fonts.example.com/css?family=Roboto",
+			"https://cdn.example.com/fonts/icons.woff2",
+			"https://cdn.example.com/fonts/icons.woff",
+		}))
+		Expect(findLinksInCSS(css, base, ResourceTypes{Images: true})).To(Equal([]string{
+			"https://cdn.example.com/img/hero.jpg",
+		}))
+	})
+
+	It("should decode compressed stylesheets", func() {
+		buf := &bytes.Buffer{}
+		gw := gzip.NewWriter(buf)
+		gw.Write([]byte(css))
+		gw.Close()
+		urls, err := parseCSS(context.Background(), buf, "gzip", base, all)
+		Expect(err).To(BeNil())
+		Expect(urls).To(HaveLen(5))
+
+		_, err = parseCSS(context.Background(), strings.NewReader(css), "compress", base, all)
+		Expect(err).NotTo(BeNil())
+	})
+})
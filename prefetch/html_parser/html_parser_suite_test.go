@@ -0,0 +1,13 @@
+package html_parser
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestHtmlParser(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "HtmlParser Suite")
+}
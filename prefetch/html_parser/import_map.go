@@ -0,0 +1,123 @@
+package html_parser
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ImportMap is a <script type=importmap>, mapping module specifiers to
+// urls, https://html.spec.whatwg.org/multipage/webappapis.html#import-maps
+type ImportMap struct {
+	Imports map[string]string            `json:"imports"`
+	Scopes  map[string]map[string]string `json:"scopes"`
+}
+
+func parseImportMap(text string) (*ImportMap, error) {
+	var m ImportMap
+	if err := json.Unmarshal([]byte(text), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// urlLike resolves specifier against base if it's a url or a path, "" if
+// it's bare like "vue".
+func urlLike(specifier string, base *url.URL) string {
+	if strings.HasPrefix(specifier, "/") ||
+		strings.HasPrefix(specifier, "./") ||
+		strings.HasPrefix(specifier, "../") {
+		return resolveUrl(specifier, base)
+	}
+	if u, err := url.Parse(specifier); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return u.String()
+	}
+	return ""
+}
+
+func normalizeSpecifierMap(m map[string]string, base *url.URL) map[string]string {
+	normalized := make(map[string]string, len(m))
+	for specifier, target := range m {
+		if resolved := urlLike(specifier, base); resolved != "" {
+			specifier = resolved
+		}
+		if target = resolveUrl(target, base); target != "" {
+			normalized[specifier] = target
+		}
+	}
+	return normalized
+}
+
+// normalize resolves the map's url-like specifiers, scopes and targets
+// against the document's base url, as browsers do when parsing it.
+func (m *ImportMap) normalize(base *url.URL) {
+	m.Imports = normalizeSpecifierMap(m.Imports, base)
+	scopes := make(map[string]map[string]string, len(m.Scopes))
+	for scope, imports := range m.Scopes {
+		if resolved := resolveUrl(scope, base); resolved != "" {
+			scopes[resolved] = normalizeSpecifierMap(imports, base)
+		}
+	}
+	m.Scopes = scopes
+}
+
+// moduleUrls returns the module urls the top level imports map to, prefix
+// mappings ("lib/": "/js/lib/") name no module and are left out.
+func (m *ImportMap) moduleUrls() []string {
+	var urls []string
+	for specifier, target := range m.Imports {
+		if !strings.HasSuffix(specifier, "/") {
+			urls = append(urls, target)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// longestMatch maps key by an exact or the longest prefix specifier.
+func longestMatch(m map[string]string, key string) (string, bool) {
+	if target, ok := m[key]; ok {
+		return target, true
+	}
+	var best string
+	for specifier := range m {
+		if strings.HasSuffix(specifier, "/") && strings.HasPrefix(key, specifier) && len(specifier) > len(best) {
+			best = specifier
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return m[best] + key[len(best):], true
+}
+
+// Resolve returns the url of module specifier imported by referrer, a nil
+// *ImportMap maps nothing, so bare specifiers don't resolve.
+func (m *ImportMap) Resolve(specifier string, referrer *url.URL) (string, bool) {
+	asURL := urlLike(specifier, referrer)
+	key := specifier
+	if asURL != "" {
+		key = asURL
+	}
+	if m != nil {
+		// the most specific scope containing the referrer first
+		ref := referrer.String()
+		scopes := make([]string, 0, len(m.Scopes))
+		for scope := range m.Scopes {
+			if ref == scope || strings.HasSuffix(scope, "/") && strings.HasPrefix(ref, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		sort.Slice(scopes, func(i, j int) bool { return len(scopes[i]) > len(scopes[j]) })
+		for _, scope := range scopes {
+			if target, ok := longestMatch(m.Scopes[scope], key); ok {
+				return target, true
+			}
+		}
+		if target, ok := longestMatch(m.Imports, key); ok {
+			return target, true
+		}
+	}
+	return asURL, asURL != ""
+}
@@ -0,0 +1,113 @@
+package html_parser
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/zckevin/http2-mitm-proxy/common"
+	"github.com/zckevin/http2-mitm-proxy/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	// not part of a longer identifier or a member, e.g. obj.import(...)
+	js_boundary = `(?:^|[^\w$.])`
+	// import "a.js"; import x, {y as z} from "a.js"; minified import{x}from"a.js"
+	js_import_regexp = regexp.MustCompile(js_boundary + `import\s*(?:[\w$*{}\s,]+?\s*from\s*)?["']([^"'\n]+)["']`)
+	// export * from "a.js"; export * as ns from "a.js"; export {x} from "a.js"
+	js_export_regexp = regexp.MustCompile(js_boundary + `export\s*(?:\*(?:\s*as\s+[\w$]+)?|\{[^}]*\})\s*from\s*["']([^"'\n]+)["']`)
+	// import("a.js") with a literal only, import("./" + name) is left to
+	// the browser
+	js_dynamic_import_regexp = regexp.MustCompile(js_boundary + `import\(\s*(?:"([^"\n]+)"|'([^'\n]+)'|` + "`([^`$\\n]+)`" + `)\s*\)`)
+	// imports come first in a module, dynamic ones may not but a module is
+	// parsed whole up to here
+	js_read_limit = 2 << 20
+)
+
+// IsJavaScript reports whether resp is a script worth parsing for imports.
+func IsJavaScript(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	return resp.StatusCode == http.StatusOK &&
+		(strings.Contains(contentType, "javascript") ||
+			strings.HasSuffix(resp.Request.URL.Path, ".js") ||
+			strings.HasSuffix(resp.Request.URL.Path, ".mjs"))
+}
+
+// findModuleImports returns the modules js imports statically or with a
+// literal import(), resolved against moduleUrl and import map m. Matches
+// within comments and strings aren't told apart, a needless push or two
+// is cheaper than a JS parser.
+func findModuleImports(js string, moduleUrl *url.URL, m *ImportMap) (modules []string) {
+	seen := make(map[string]bool)
+	add := func(specifier string) {
+		resolved, ok := m.Resolve(strings.TrimSpace(specifier), moduleUrl)
+		if !ok {
+			return
+		}
+		if u, err := url.Parse(resolved); err == nil {
+			u.Fragment = ""
+			resolved = u.String()
+		}
+		if !seen[resolved] {
+			seen[resolved] = true
+			modules = append(modules, resolved)
+		}
+	}
+
+	for _, re := range []*regexp.Regexp{js_import_regexp, js_export_regexp, js_dynamic_import_regexp} {
+		for _, match := range re.FindAllStringSubmatch(js, -1) {
+			add(firstSubmatch(match))
+		}
+	}
+	return modules
+}
+
+func parseModule(ctx context.Context, r io.Reader, encoding string, moduleUrl *url.URL, m *ImportMap) (_ []string, size int, err error) {
+	_, span := tracing.GetTracer(ctx, "html_parser").Start(ctx, "parseModule")
+	defer span.End()
+
+	jr, err := common.WrapCompressedReader(r, encoding)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer jr.Close()
+	buf, err := io.ReadAll(io.LimitReader(jr, int64(js_read_limit)))
+	if err != nil {
+		return nil, 0, err
+	}
+	span.SetAttributes(attribute.Int("jsLength", len(buf)))
+	return findModuleImports(string(buf), moduleUrl, m), len(buf), nil
+}
+
+// ScanModuleImports reports the imports of module resp resolved with import
+// map m, which may be nil, and the size of its source read to found, from a
+// goroutine reading a fork of the body, so resp can be pushed meanwhile.
+// done gets the error once it's parsed, found isn't called on one.
+func ScanModuleImports(ctx context.Context, resp *http.Response, m *ImportMap, found func(moduleUrls []string, size int)) (done <-chan error) {
+	bodyWrapper := wrapRespBody(resp)
+	resp.Body = bodyWrapper
+	fork := bodyWrapper.Fork()
+	encoding, base := resp.Header.Get("Content-Encoding"), resp.Request.URL
+
+	errCh := make(chan error, 1)
+	go func() {
+		ctx, span := tracing.GetTracer(ctx, "html_parser").Start(ctx, "ScanModuleImports")
+		defer span.End()
+		defer fork.Close()
+
+		moduleUrls, size, err := parseModule(ctx, fork, encoding, base, m)
+		if err != nil {
+			span.RecordError(err)
+			errCh <- err
+			return
+		}
+		span.SetAttributes(attribute.StringSlice("moduleUrls", moduleUrls))
+		found(moduleUrls, size)
+		errCh <- nil
+	}()
+	return errCh
+}
@@ -0,0 +1,97 @@
+package html_parser
+
+import (
+	"net/url"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JS modules", func() {
+	docUrl, _ := url.Parse("https://example.com/app/index.html")
+	moduleUrl, _ := url.Parse("https://example.com/js/main.js")
+
+	newImportMap := func(text string) *ImportMap {
+		m, err := parseImportMap(text)
+		Expect(err).To(BeNil())
+		m.normalize(docUrl)
+		return m
+	}
+
+	It("should resolve specifiers with an import map", func() {
+		m := newImportMap(`{
+			"imports": {
+				"vue": "https://esm.example.net/vue@3/vue.js",
+				"lib/": "/js/lib/",
+				"lib/legacy/": "/js/legacy/",
+				"/js/old.js": "/js/new.js"
+			},
+			"scopes": {
+				"/js/vendor/": {"vue": "/js/vendor/vue2.js"}
+			}
+		}`)
+		resolve := func(specifier string, referrer *url.URL) string {
+			resolved, _ := m.Resolve(specifier, referrer)
+			return resolved
+		}
+		Expect(resolve("vue", moduleUrl)).To(Equal("https://esm.example.net/vue@3/vue.js"))
+		Expect(resolve("lib/a.js", moduleUrl)).To(Equal("https://example.com/js/lib/a.js"))
+		Expect(resolve("lib/legacy/b.js", moduleUrl)).To(Equal("https://example.com/js/legacy/b.js"))
+		Expect(resolve("./old.js", moduleUrl)).To(Equal("https://example.com/js/new.js"))
+		Expect(resolve("./util.js", moduleUrl)).To(Equal("https://example.com/js/util.js"))
+		Expect(resolve("https://cdn.example.net/x.js", moduleUrl)).To(Equal("https://cdn.example.net/x.js"))
+		Expect(resolve("missing", moduleUrl)).To(Equal(""))
+
+		vendored, _ := url.Parse("https://example.com/js/vendor/plugin.js")
+		Expect(resolve("vue", vendored)).To(Equal("https://example.com/js/vendor/vue2.js"))
+		Expect(resolve("lib/a.js", vendored)).To(Equal("https://example.com/js/lib/a.js"))
+
+		var none *ImportMap
+		_, ok := none.Resolve("vue", moduleUrl)
+		Expect(ok).To(BeFalse())
+		resolved, _ := none.Resolve("../b.js", moduleUrl)
+		Expect(resolved).To(Equal("https://example.com/b.js"))
+	})
+
+	It("should find imports in modules", func() {
+		js := `
+import "./polyfill.js";
+import App, { createApp as create } from './app.js';
+import * as utils from "./utils.js?v=2";
+export { helper } from "./helper.js";
+export * from "./all.js";
+export * as ns from "./ns.js";
+const page = await import("./pages/home.js");
+const lazy = () => import(` + "`./lazy.js`" + `);
+const dynamic = import("./pages/" + name);
+obj.import("./not-a-module.js");
+import.meta.url;
+import App2 from "./app.js";
+import vue from "vue";
+import missing from "missing";
+`
+		m := newImportMap(`{"imports": {"vue": "/js/vue.js"}}`)
+		Expect(findModuleImports(js, moduleUrl, m)).To(Equal([]string{
+			"https://example.com/js/polyfill.js",
+			"https://example.com/js/app.js",
+			"https://example.com/js/utils.js?v=2",
+			"https://example.com/js/vue.js",
+			"https://example.com/js/helper.js",
+			"https://example.com/js/all.js",
+			"https://example.com/js/ns.js",
+			"https://example.com/js/pages/home.js",
+			"https://example.com/js/lazy.js",
+		}))
+	})
+
+	It("should find imports in minified modules", func() {
+		js := `import{a as b}from"./a.js";import"./b.js";export*from"./c.js";export{d}from"./d.js";const e=()=>import("./e.js");let f=1;`
+		Expect(findModuleImports(js, moduleUrl, nil)).To(Equal([]string{
+			"https://example.com/js/a.js",
+			"https://example.com/js/b.js",
+			"https://example.com/js/c.js",
+			"https://example.com/js/d.js",
+			"https://example.com/js/e.js",
+		}))
+	})
+})
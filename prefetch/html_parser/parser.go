@@ -1,160 +1,351 @@
 package html_parser
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strings"
 
-	"github.com/PuerkitoBio/goquery"
-	"github.com/samber/lo"
 	buffer "github.com/zckevin/go-libs/repeatable_buffer"
 	"github.com/zckevin/http2-mitm-proxy/common"
 	"github.com/zckevin/http2-mitm-proxy/tracing"
 	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 var (
-	// flags: multi-line + dot match newline
-	// match <html> and <body> tag in case some html page doesn't have <head> tag
-	html_head_regex  = `(?ms)<html.+?<body`
-	html_head_regexp = regexp.MustCompile(html_head_regex)
+	ErrContentEncodingNotSupport = errors.New("html_parser: content-encoding not support")
 
-	ErrHeadElementNotFound       = fmt.Errorf("html_parser: head element not found")
-	ErrContentEncodingNotSupport = fmt.Errorf("html_parser: content-encoding not support")
-
-	head_read_limit = 128 * 1024
+	// of the decoded document, resources past it are left to the browser
+	scan_read_limit = 1 << 20
+	// of the body, for the images of the first viewport
+	viewport_read_limit = 16 * 1024
+	viewport_max_images = 4
 )
 
-type readerWithCache struct {
-	r     io.ReadCloser
-	cache bytes.Buffer
+func wrapRespBody(resp *http.Response) buffer.RepeatableStreamWrapper {
+	body := resp.Body
+	if wrapper, ok := body.(buffer.RepeatableStreamWrapper); ok {
+		return wrapper
+	}
+	return buffer.NewRepeatableStreamWrapper(body, func(_ io.Reader, err error) {
+		body.Close()
+	})
 }
 
-func (rwc *readerWithCache) Read(p []byte) (n int, err error) {
-	n, err = rwc.r.Read(p)
-	if n > 0 {
-		rwc.cache.Write(p[:n])
+// relTokens returns the lower cased tokens of a rel attribute, e.g.
+// "Preload Stylesheet".
+func relTokens(rel string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, t := range strings.Fields(strings.ToLower(rel)) {
+		tokens[t] = true
 	}
-	return n, err
+	return tokens
 }
 
-func (rwc *readerWithCache) Bytes() []byte {
-	return rwc.cache.Bytes()
+// firstCandidate returns the first url of a srcset, e.g.
+// "a.jpg 1x, b.jpg 2x".
+func firstCandidate(srcset string) string {
+	first, _, _ := strings.Cut(srcset, ",")
+	if fields := strings.Fields(first); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
 }
 
-func (rwc *readerWithCache) Close() error {
-	return rwc.r.Close()
+func resolveUrl(targetUrlStr string, base *url.URL) string {
+	target, err := url.Parse(targetUrlStr)
+	if err != nil {
+		return ""
+	}
+	resolved := base.ResolveReference(target)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
+	resolved.Fragment = ""
+	return resolved.String()
+}
+
+// Resource is a resource referenced by a document.
+type Resource struct {
+	URL string
+	// an ES module, whose imports can be followed
+	Module bool
+	// only the origin of a <link rel=preconnect> or dns-prefetch, not to be
+	// fetched
+	Preconnect bool
 }
 
-func parseHead(ctx context.Context, r io.Reader, encoding string) (_ []byte, err error) {
-	_, span := tracing.GetTracer(ctx, "html_parser").Start(ctx, "parseHead")
-	defer span.End()
+// scanner picks resources from a document's tokens as they arrive, it
+// needs no <html>, <head> or <body>, only the tags that matter.
+type scanner struct {
+	types     ResourceTypes
+	found     func(Resource)
+	importMap func(*ImportMap)
 
-	var rwc readerWithCache
-	if rwc.r, err = common.WrapCompressedReader(r, encoding); err != nil {
-		return nil, err
+	docUrl *url.URL
+	// <base href> once seen, urls found before it resolve against docUrl
+	base *url.URL
+	seen map[string]bool
+	// of preconnect hints
+	seenOrigins map[string]bool
+
+	// bytes tokenized so far, and where the body started, -1 before
+	offset     int
+	bodyOffset int
+	images     int
+	// within a <picture>, and whether one of its sources was taken
+	inPicture   bool
+	pictureDone bool
+	// the next text token is an import map
+	inImportMap bool
+}
+
+func newScanner(docUrl *url.URL, types ResourceTypes, found func(Resource), importMap func(*ImportMap)) *scanner {
+	return &scanner{
+		types:       types,
+		found:       found,
+		importMap:   importMap,
+		docUrl:      docUrl,
+		base:        docUrl,
+		seen:        make(map[string]bool),
+		seenOrigins: make(map[string]bool),
+		bodyOffset:  -1,
 	}
-	defer rwc.Close()
+}
+
+func (s *scanner) add(ref string) bool {
+	return s.addResource(ref, false)
+}
+
+func (s *scanner) addModule(ref string) bool {
+	return s.addResource(ref, true)
+}
 
-	runeRd := bufio.NewReader(&rwc)
-	loc := html_head_regexp.FindReaderIndex(runeRd)
-	if loc == nil {
-		return nil, ErrHeadElementNotFound
+func (s *scanner) addResource(ref string, module bool) bool {
+	if ref = strings.TrimSpace(ref); ref == "" || strings.HasPrefix(ref, "data:") {
+		return false
+	}
+	resolved := resolveUrl(ref, s.base)
+	if resolved == "" || s.seen[resolved] {
+		return false
 	}
-	span.SetAttributes(attribute.Int("headLength", loc[1]-loc[0]))
-	return rwc.Bytes()[loc[0]:loc[1]], nil
+	s.seen[resolved] = true
+	s.found(Resource{URL: resolved, Module: module})
+	return true
 }
 
-func wrapRespBody(resp *http.Response) buffer.RepeatableStreamWrapper {
-	body := resp.Body
-	if wrapper, ok := body.(buffer.RepeatableStreamWrapper); ok {
-		return wrapper
+func (s *scanner) addPreconnect(ref string) {
+	resolved := resolveUrl(strings.TrimSpace(ref), s.base)
+	if resolved == "" {
+		return
 	}
-	return buffer.NewRepeatableStreamWrapper(body, func(_ io.Reader, err error) {
-		body.Close()
-	})
+	u, _ := url.Parse(resolved)
+	origin := u.Scheme + "://" + u.Host
+	if s.seenOrigins[origin] {
+		return
+	}
+	s.seenOrigins[origin] = true
+	s.found(Resource{URL: origin, Preconnect: true})
 }
 
-func unwrap(s *goquery.Selection, key string) string {
-	if val, ok := s.Attr(key); ok {
-		return val
+// inViewport reports whether an image here is likely visible without
+// scrolling, the body starts at the first image if there's no <body>.
+func (s *scanner) inViewport() bool {
+	if s.bodyOffset < 0 {
+		s.bodyOffset = s.offset
 	}
-	return ""
+	return s.images < viewport_max_images &&
+		s.offset-s.bodyOffset <= viewport_read_limit
 }
 
-func findLinksInDoc(ctx context.Context, doc *goquery.Document) (resources []string) {
-	_, span := tracing.GetTracer(ctx, "html_parser").Start(ctx, "findLinksInDoc")
-	defer span.End()
+func (s *scanner) addImage(ref string) {
+	if s.add(ref) {
+		s.images++
+	}
+}
 
-	doc.Find("script").Each(func(_ int, s *goquery.Selection) {
-		if src := unwrap(s, "src"); src != "" {
-			resources = append(resources, src)
+func tagAttrs(z *html.Tokenizer, hasAttr bool) map[string]string {
+	attrs := make(map[string]string)
+	for hasAttr {
+		var k, v []byte
+		k, v, hasAttr = z.TagAttr()
+		// the first one wins, like in browsers
+		if _, ok := attrs[string(k)]; !ok {
+			attrs[string(k)] = string(v)
 		}
-	})
-	doc.Find("link").Each(func(_ int, s *goquery.Selection) {
-		if unwrap(s, "rel") == "stylesheet" ||
-			(unwrap(s, "rel") == "preload" && unwrap(s, "as") == "style") {
-			if href := unwrap(s, "href"); href != "" {
-				resources = append(resources, href)
+	}
+	return attrs
+}
+
+func (s *scanner) startTag(z *html.Tokenizer) {
+	name, hasAttr := z.TagName()
+	switch atom.Lookup(name) {
+	case atom.Body:
+		if s.bodyOffset < 0 {
+			s.bodyOffset = s.offset
+		}
+	case atom.Base:
+		attrs := tagAttrs(z, hasAttr)
+		// only the first <base href> counts
+		if href, ok := attrs["href"]; ok && s.base == s.docUrl {
+			if base, err := url.Parse(strings.TrimSpace(href)); err == nil {
+				s.base = s.docUrl.ResolveReference(base)
 			}
 		}
-	})
-	return resources
+	case atom.Script:
+		attrs := tagAttrs(z, hasAttr)
+		switch strings.ToLower(attrs["type"]) {
+		case "importmap":
+			s.inImportMap = true
+			return
+		case "module":
+			if s.types.Scripts {
+				s.addModule(attrs["src"])
+			}
+			return
+		}
+		// browsers supporting anything else here skip nomodule scripts
+		if _, ok := attrs["nomodule"]; ok || !s.types.Scripts {
+			return
+		}
+		s.add(attrs["src"])
+	case atom.Link:
+		attrs := tagAttrs(z, hasAttr)
+		rel := relTokens(attrs["rel"])
+		switch {
+		case rel["stylesheet"]:
+			if s.types.Stylesheets {
+				s.add(attrs["href"])
+			}
+		case rel["modulepreload"]:
+			if s.types.ModulePreloads {
+				s.addModule(attrs["href"])
+			}
+		case rel["preload"]:
+			if s.types.preloadEnabled(strings.ToLower(attrs["as"])) {
+				s.add(attrs["href"])
+			}
+		case rel["icon"]:
+			if s.types.Icons {
+				s.add(attrs["href"])
+			}
+		case rel["preconnect"], rel["dns-prefetch"]:
+			s.addPreconnect(attrs["href"])
+		}
+	case atom.Picture:
+		s.inPicture, s.pictureDone = true, false
+	case atom.Source:
+		if !s.types.Images || !s.inPicture || s.pictureDone || !s.inViewport() {
+			return
+		}
+		// the browser picks the first <source> it supports, most likely
+		// the first one
+		if src := firstCandidate(tagAttrs(z, hasAttr)["srcset"]); src != "" {
+			s.pictureDone = true
+			s.addImage(src)
+		}
+	case atom.Img:
+		if !s.types.Images || s.inPicture && s.pictureDone || !s.inViewport() {
+			return
+		}
+		s.pictureDone = s.inPicture
+		attrs := tagAttrs(z, hasAttr)
+		if strings.EqualFold(attrs["loading"], "lazy") {
+			return
+		}
+		src := attrs["src"]
+		if src == "" {
+			src = firstCandidate(attrs["srcset"])
+		}
+		s.addImage(src)
+	}
 }
 
-func fixUrl(targetUrlStr string, referrer *url.URL) string {
-	target, err := url.Parse(targetUrlStr)
-	if err != nil {
-		return ""
+func (s *scanner) scan(ctx context.Context, r io.Reader) error {
+	z := html.NewTokenizer(r)
+	for ctx.Err() == nil && s.offset < scan_read_limit {
+		tt := z.Next()
+		s.offset += len(z.Raw())
+		switch tt {
+		case html.ErrorToken:
+			if errors.Is(z.Err(), io.EOF) {
+				return nil
+			}
+			return z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			s.startTag(z)
+		case html.EndTagToken:
+			if name, _ := z.TagName(); atom.Lookup(name) == atom.Picture {
+				s.inPicture = false
+			}
+		case html.TextToken:
+			if s.inImportMap {
+				s.inImportMap = false
+				if m, err := parseImportMap(string(z.Text())); err == nil {
+					m.normalize(s.base)
+					// before its modules, their imports resolve against it
+					if s.importMap != nil {
+						s.importMap(m)
+					}
+					if s.types.ImportMaps {
+						for _, target := range m.moduleUrls() {
+							s.addModule(target)
+						}
+					}
+				}
+			}
+		}
 	}
+	return ctx.Err()
+}
 
-	// fix missing fields, e.g:
-	// - url without scheme: //www.google.com/1.js
-	// - url without host: /1.js
-	if target.Scheme == "" {
-		target.Scheme = referrer.Scheme
-	}
-	if target.Host == "" {
-		target.Host = referrer.Host
+// scanResources calls found with each resource of the document read from
+// r in document order, and importMap with its import map.
+func scanResources(ctx context.Context, r io.Reader, encoding string, docUrl *url.URL, types ResourceTypes, found func(Resource), importMap func(*ImportMap)) error {
+	dr, err := common.WrapCompressedReader(r, encoding)
+	if err != nil {
+		return err
 	}
-	return target.String()
+	defer dr.Close()
+	return newScanner(docUrl, types, found, importMap).scan(ctx, dr)
 }
 
-func ExtractResourcesInHead(ctx context.Context, resp *http.Response) (resourceUrls []string, err error) {
-	ctx, span := tracing.GetTracer(ctx, "html_parser").Start(ctx, "ExtractResourcesInHead")
-	defer func() {
-		if err != nil {
-			span.RecordError(err)
-		}
-		span.End()
-	}()
-
+// ScanResources scans document resp for resources of types while it's
+// relayed, found is called with each one as soon as it's seen and
+// importMap, which may be nil, with the document's import map. The body
+// stays readable, the scan goes on in the background until the document
+// ends or ctx is done and then sends its result on done.
+func ScanResources(
+	ctx context.Context,
+	resp *http.Response,
+	types ResourceTypes,
+	found func(Resource),
+	importMap func(*ImportMap),
+) (done <-chan error) {
 	bodyWrapper := wrapRespBody(resp)
 	resp.Body = bodyWrapper
 	fork := bodyWrapper.Fork()
-	defer fork.Close()
 
-	headBuf, err := parseHead(ctx, io.LimitReader(fork, int64(head_read_limit)), resp.Header.Get("Content-Encoding"))
-	if err != nil {
-		return nil, err
-	}
-	doc, err := goquery.NewDocumentFromReader(bytes.NewBuffer(headBuf))
-	if err != nil {
-		return nil, fmt.Errorf("html_parser: goquery.NewDocumentFromReader failed: %w", err)
-	}
-
-	resourceUrls = lo.Filter(
-		lo.Map(findLinksInDoc(ctx, doc), func(s string, _ int) string {
-			return fixUrl(s, resp.Request.URL)
-		}),
-		func(s string, _ int) bool {
-			return s != ""
-		})
-	span.SetAttributes(attribute.StringSlice("resourcesUrls", resourceUrls))
-	return resourceUrls, nil
+	errCh := make(chan error, 1)
+	go func() {
+		ctx, span := tracing.GetTracer(ctx, "html_parser").Start(ctx, "ScanResources")
+		defer span.End()
+		defer fork.Close()
+
+		var urls []string
+		err := scanResources(ctx, fork, resp.Header.Get("Content-Encoding"), resp.Request.URL, types, func(r Resource) {
+			urls = append(urls, r.URL)
+			found(r)
+		}, importMap)
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.SetAttributes(attribute.StringSlice("resourcesUrls", urls))
+		errCh <- err
+	}()
+	return errCh
 }
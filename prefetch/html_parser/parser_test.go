@@ -1,5 +1,181 @@
 package html_parser
 
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Parser", func() {
+	docUrl, _ := url.Parse("https://example.com/index.html")
+
+	allTypes := ResourceTypes{
+		Scripts:        true,
+		Stylesheets:    true,
+		ModulePreloads: true,
+		Fonts:          true,
+		Images:         true,
+		Icons:          true,
+		ImportMaps:     true,
+	}
+
+	extract := func(fixture string, types ResourceTypes) []string {
+		f, err := os.Open(filepath.Join("testdata", fixture))
+		Expect(err).To(BeNil())
+		defer f.Close()
+		var urls []string
+		err = scanResources(context.Background(), f, "", docUrl, types, func(r Resource) {
+			if !r.Preconnect {
+				urls = append(urls, r.URL)
+			}
+		}, nil)
+		Expect(err).To(BeNil())
+		return urls
+	}
+
+	DescribeTable("should find resources in fixtures",
+		func(fixture string, types ResourceTypes, expected []string) {
+			Expect(extract(fixture, types)).To(Equal(expected))
+		},
+		Entry("classic, default types", "classic.html", DefaultResourceTypes, []string{
+			"https://example.com/css/site.css",
+			"https://example.com/css/print.css",
+			"https://cdn.example.net/jquery.min.js",
+			"https://example.com/js/app.js",
+		}),
+		Entry("classic, all types", "classic.html", allTypes, []string{
+			"https://example.com/css/site.css",
+			"https://example.com/css/print.css",
+			"https://example.com/favicon.ico",
+			"https://cdn.example.net/jquery.min.js",
+			"https://example.com/js/app.js",
+			"https://example.com/img/logo.png",
+			"https://example.com/img/hero-1x.jpg",
+		}),
+		Entry("classic, styles only", "classic.html", ResourceTypes{Stylesheets: true}, []string{
+			"https://example.com/css/site.css",
+			"https://example.com/css/print.css",
+		}),
+		Entry("modern, default types", "modern.html", DefaultResourceTypes, []string{
+			"https://example.com/js/chunk-a.js",
+			"https://example.com/fonts/inter.woff2",
+			"https://example.com/js/main.js",
+		}),
+		Entry("modern, all types", "modern.html", allTypes, []string{
+			"https://esm.example.net/vue@3/dist/vue.esm-browser.js",
+			"https://example.com/js/chunk-a.js",
+			"https://example.com/fonts/inter.woff2",
+			"https://example.com/img/banner.webp",
+			"https://example.com/js/main.js",
+			"https://example.com/img/photo.avif",
+			"https://example.com/img/1.png",
+			"https://example.com/img/2.png",
+			"https://example.com/img/3.png",
+		}),
+		Entry("base href", "base_href.html", DefaultResourceTypes, []string{
+			"https://static.example.com/v2/css/main.css",
+			"https://static.example.com/shared/runtime.js",
+			"https://static.example.com/root.js",
+		}),
+		Entry("no html or head, late body scripts", "fragment.html", DefaultResourceTypes, []string{
+			"https://example.com/css/fragment.css",
+			"https://example.com/js/early.js",
+			"https://example.com/js/late.js",
+		}),
+	)
+
+	It("should decode compressed documents", func() {
+		html, err := os.ReadFile(filepath.Join("testdata", "classic.html"))
+		Expect(err).To(BeNil())
+		buf := &bytes.Buffer{}
+		gw := gzip.NewWriter(buf)
+		gw.Write(html)
+		gw.Close()
+		var urls []string
+		err = scanResources(context.Background(), buf, "gzip", docUrl, DefaultResourceTypes, func(r Resource) {
+			if !r.Preconnect {
+				urls = append(urls, r.URL)
+			}
+		}, nil)
+		Expect(err).To(BeNil())
+		Expect(urls).To(Equal(extract("classic.html", DefaultResourceTypes)))
+	})
+
+	It("should report urls before the document ends", func() {
+		pr, pw := io.Pipe()
+		found := make(chan string, 4)
+		done := make(chan error, 1)
+		go func() {
+			done <- scanResources(context.Background(), pr, "", docUrl, DefaultResourceTypes, func(r Resource) {
+				found <- r.URL
+			}, nil)
+		}()
+
+		io.WriteString(pw, `<!doctype html><link rel=stylesheet href=/a.css><script src=/a.js></script>`)
+		Eventually(found).Should(Receive(Equal("https://example.com/a.css")))
+		Eventually(found).Should(Receive(Equal("https://example.com/a.js")))
+		Consistently(done).ShouldNot(Receive())
+
+		io.WriteString(pw, `<p>text</p><script src=/b.js></script>`)
+		pw.Close()
+		Eventually(found).Should(Receive(Equal("https://example.com/b.js")))
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should mark modules and report the import map", func() {
+		f, err := os.Open(filepath.Join("testdata", "modern.html"))
+		Expect(err).To(BeNil())
+		defer f.Close()
+		var modules []string
+		var m *ImportMap
+		err = scanResources(context.Background(), f, "", docUrl, DefaultResourceTypes, func(r Resource) {
+			if r.Module {
+				modules = append(modules, r.URL)
+			}
+		}, func(importMap *ImportMap) {
+			m = importMap
+		})
+		Expect(err).To(BeNil())
+		Expect(modules).To(Equal([]string{
+			"https://example.com/js/chunk-a.js",
+			"https://example.com/js/main.js",
+		}))
+		// reported even though its targets aren't prefetched by default
+		Expect(m).NotTo(BeNil())
+		Expect(m.Imports).To(HaveKeyWithValue("lib/", "https://example.com/js/lib/"))
+	})
+
+	It("should report preconnect hints by origin", func() {
+		var origins []string
+		html := `<link rel=preconnect href="https://cdn.example.net/path">
+<link rel=dns-prefetch href="//fonts.example.org">
+<link rel="preconnect dns-prefetch" href="https://cdn.example.net">
+<link rel=preconnect href="data:,">`
+		err := scanResources(context.Background(), strings.NewReader(html), "", docUrl, ResourceTypes{}, func(r Resource) {
+			Expect(r.Preconnect).To(BeTrue())
+			origins = append(origins, r.URL)
+		}, nil)
+		Expect(err).To(BeNil())
+		Expect(origins).To(Equal([]string{"https://cdn.example.net", "https://fonts.example.org"}))
+	})
+
+	It("should parse resource type flags", func() {
+		types, err := ParseResourceTypes("script, font,importmap")
+		Expect(err).To(BeNil())
+		Expect(types).To(Equal(ResourceTypes{Scripts: true, Fonts: true, ImportMaps: true}))
+		_, err = ParseResourceTypes("script,video")
+		Expect(err).NotTo(BeNil())
+	})
+})
+
 /*
 import (
 	"fmt"
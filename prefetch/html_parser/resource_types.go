@@ -0,0 +1,78 @@
+package html_parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResourceTypes selects what the parser reports for prefetching. There's no
+// type for <link rel=preload as=fetch>: the client caches by extension and
+// can't tell those URLs, often APIs, apart.
+type ResourceTypes struct {
+	// <script src>
+	Scripts bool
+	// <link rel=stylesheet>, <link rel=preload as=style>
+	Stylesheets bool
+	// <link rel=modulepreload>
+	ModulePreloads bool
+	// <link rel=preload as=font>
+	Fonts bool
+	// <link rel=preload as=image>, <img> and <picture> in the first viewport
+	Images bool
+	// <link rel=icon>
+	Icons bool
+	// module URLs mapped by <script type=importmap>
+	ImportMaps bool
+}
+
+// DefaultResourceTypes are the render blocking types, images cost more
+// bandwidth than they save round trips on most pages.
+var DefaultResourceTypes = ResourceTypes{
+	Scripts:        true,
+	Stylesheets:    true,
+	ModulePreloads: true,
+	Fonts:          true,
+}
+
+// ParseResourceTypes parses comma separated type names, e.g.
+// "script,style,font".
+func ParseResourceTypes(s string) (ResourceTypes, error) {
+	var types ResourceTypes
+	for _, name := range strings.Split(s, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "script":
+			types.Scripts = true
+		case "style":
+			types.Stylesheets = true
+		case "modulepreload":
+			types.ModulePreloads = true
+		case "font":
+			types.Fonts = true
+		case "image":
+			types.Images = true
+		case "icon":
+			types.Icons = true
+		case "importmap":
+			types.ImportMaps = true
+		default:
+			return types, fmt.Errorf("html_parser: unknown resource type %q", name)
+		}
+	}
+	return types, nil
+}
+
+// preloadEnabled reports whether <link rel=preload as=as> is wanted.
+func (t ResourceTypes) preloadEnabled(as string) bool {
+	switch as {
+	case "script":
+		return t.Scripts
+	case "style":
+		return t.Stylesheets
+	case "font":
+		return t.Fonts
+	case "image":
+		return t.Images
+	}
+	return false
+}
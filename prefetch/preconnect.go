@@ -0,0 +1,95 @@
+package prefetch
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/log"
+	"github.com/zckevin/http2-mitm-proxy/common"
+)
+
+const (
+	// origins warmed up per document, the browser handshakes with the rest
+	// itself
+	maxPreconnectsPerPage = 8
+	// an origin isn't warmed up again for this long, its conn stays pooled
+	preconnectTTL = time.Minute
+)
+
+// Preconnecter pools conns to origins ahead of their requests, e.g.
+// common.AutoFallbackClient.
+type Preconnecter interface {
+	Preconnect(ctx context.Context, origin string) error
+}
+
+// preconnector warms up the conns to the third party origins of a tunnel
+// conn's documents, so the browser's first request to a CDN or font host
+// doesn't wait for the server's DNS, TCP and TLS handshakes.
+type preconnector struct {
+	logger log.ContextLogger
+	p      Preconnecter
+	recent *common.TTLCache
+}
+
+// newPreconnector returns nil if p is, a nil *preconnector does nothing.
+func newPreconnector(p Preconnecter) *preconnector {
+	if p == nil {
+		return nil
+	}
+	return &preconnector{
+		logger: common.NewLogger("preconnector"),
+		p:      p,
+		recent: common.NewTTLCache(preconnectTTL, time.Minute),
+	}
+}
+
+func originOf(rawUrl string) (string, bool) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	return u.Scheme + "://" + u.Host, true
+}
+
+// forDocument returns a func warming up the origin of each url given,
+// preconnect hints and subresources alike, except docUrl's own which is
+// connected already.
+func (pc *preconnector) forDocument(ctx context.Context, docUrl *url.URL) (preconnect func(url string)) {
+	if pc == nil {
+		return func(string) {}
+	}
+	docOrigin := docUrl.Scheme + "://" + docUrl.Host
+	var (
+		mu   sync.Mutex
+		seen = make(map[string]bool)
+	)
+	return func(rawUrl string) {
+		origin, ok := originOf(rawUrl)
+		if !ok || origin == docOrigin {
+			return
+		}
+		mu.Lock()
+		if seen[origin] || len(seen) >= maxPreconnectsPerPage {
+			mu.Unlock()
+			return
+		}
+		seen[origin] = true
+		mu.Unlock()
+
+		if _, ok := pc.recent.Get(origin); ok {
+			return
+		}
+		pc.recent.Set(origin, struct{}{})
+		go func() {
+			if err := pc.p.Preconnect(ctx, origin); err != nil {
+				// e.g. a hint for an origin that's gone, it may be retried
+				pc.recent.Delete(origin)
+				pc.logger.Debug("preconnect ", origin, " err: ", err)
+				return
+			}
+			common.Preconnects.Add(1)
+		}()
+	}
+}
@@ -0,0 +1,68 @@
+package prefetch
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type fakePreconnecter struct {
+	mu      sync.Mutex
+	origins []string
+}
+
+func (f *fakePreconnecter) Preconnect(_ context.Context, origin string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.origins = append(f.origins, origin)
+	return nil
+}
+
+func (f *fakePreconnecter) preconnected() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.origins...)
+}
+
+var _ = Describe("Preconnector", func() {
+	docUrl, _ := url.Parse("https://example.com/index.html")
+
+	It("should preconnect distinct third party origins once", func() {
+		f := &fakePreconnecter{}
+		pc := newPreconnector(f)
+		preconnect := pc.forDocument(context.Background(), docUrl)
+		for _, u := range []string{
+			"https://example.com/app.js",
+			"https://cdn.example.net",
+			"https://cdn.example.net/a.js",
+			"https://fonts.example.org/inter.woff2",
+			"data:text/plain,hi",
+		} {
+			preconnect(u)
+		}
+		Eventually(f.preconnected).Should(ConsistOf("https://cdn.example.net", "https://fonts.example.org"))
+
+		// recently warmed up by another document
+		pc.forDocument(context.Background(), docUrl)("https://cdn.example.net/b.js")
+		Consistently(f.preconnected).Should(HaveLen(2))
+	})
+
+	It("should cap preconnects per document", func() {
+		f := &fakePreconnecter{}
+		preconnect := newPreconnector(f).forDocument(context.Background(), docUrl)
+		for i := 0; i < maxPreconnectsPerPage*2; i++ {
+			preconnect("https://cdn" + string(rune('a'+i)) + ".example.net/a.js")
+		}
+		Eventually(f.preconnected).Should(HaveLen(maxPreconnectsPerPage))
+		Consistently(f.preconnected).Should(HaveLen(maxPreconnectsPerPage))
+	})
+
+	It("should do nothing when disabled", func() {
+		var pc *preconnector
+		pc.forDocument(context.Background(), docUrl)("https://cdn.example.net/a.js")
+		Expect(newPreconnector(nil)).To(BeNil())
+	})
+})
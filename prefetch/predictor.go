@@ -0,0 +1,335 @@
+package prefetch
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/log"
+	"github.com/zckevin/http2-mitm-proxy/common"
+)
+
+// The predictor learns what documents load beyond what their HTML says,
+// scripts injected by scripts, CSS imports and such: the browser's
+// cacheable requests following a document are counted against the
+// document's URL pattern, and resources requested often enough on earlier
+// visits are prefetched on the next one.
+
+type PredictorOptions struct {
+	// JSON file the history is loaded from and saved to
+	StorePath string
+	// requests up to this long after a document count as its subresources
+	Window time.Duration
+	// share of a pattern's visits a resource must have been requested in
+	MinConfidence float64
+	// visits of a pattern before it's predicted at all
+	MinVisits int
+}
+
+const (
+	DefaultPredictionWindow     = 10 * time.Second
+	DefaultPredictionConfidence = 0.5
+	DefaultPredictionMinVisits  = 2
+
+	maxPredictedPatterns = 10000
+	// per pattern, the least requested are evicted
+	maxPredictedResources = 128
+	// visits are halved past this, so old habits fade
+	maxPredictionVisits = 64
+
+	predictorSaveInterval = time.Minute
+)
+
+var (
+	// path segments unique to a document, e.g. ids, hashes and uuids
+	uniquePathSegment = regexp.MustCompile(`^(\d{3,}|[0-9a-fA-F]{16,}|[0-9a-fA-F-]{36}|.*\d{5,}.*)$`)
+)
+
+type patternHistory struct {
+	Visits    int            `json:"visits"`
+	Resources map[string]int `json:"resources"`
+	// resources requested as ES modules
+	Modules map[string]bool `json:"modules,omitempty"`
+}
+
+func (h *patternHistory) forget(resource string) {
+	delete(h.Resources, resource)
+	delete(h.Modules, resource)
+}
+
+// Predictor is the subresource history shared by all tunnel conns, a nil
+// *Predictor predicts nothing.
+type Predictor struct {
+	opts   PredictorOptions
+	logger log.ContextLogger
+
+	mu       sync.Mutex
+	patterns map[string]*patternHistory
+	dirty    bool
+}
+
+// NewPredictor loads the history at opts.StorePath and saves it there
+// periodically, it returns nil if the path is empty.
+func NewPredictor(opts PredictorOptions) (*Predictor, error) {
+	if opts.StorePath == "" {
+		return nil, nil
+	}
+	if opts.Window <= 0 {
+		opts.Window = DefaultPredictionWindow
+	}
+	if opts.MinVisits <= 0 {
+		opts.MinVisits = 1
+	}
+	p := &Predictor{
+		opts:     opts,
+		logger:   common.NewLogger("Predictor"),
+		patterns: make(map[string]*patternHistory),
+	}
+	buf, err := os.ReadFile(opts.StorePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(buf) > 0 {
+		if err := json.Unmarshal(buf, &p.patterns); err != nil {
+			return nil, err
+		}
+	}
+	go p.saveLoop()
+	return p, nil
+}
+
+// documentPattern groups documents sharing a template, e.g.
+// https://example.com/item/12345?ref=a as example.com/item/*.
+func documentPattern(u *url.URL) string {
+	segments := strings.Split(u.EscapedPath(), "/")
+	for i, s := range segments {
+		if uniquePathSegment.MatchString(s) {
+			segments[i] = "*"
+		}
+	}
+	return u.Host + strings.Join(segments, "/")
+}
+
+func (p *Predictor) historyOf(pattern string) *patternHistory {
+	h, ok := p.patterns[pattern]
+	if !ok {
+		if len(p.patterns) >= maxPredictedPatterns {
+			return nil
+		}
+		h = &patternHistory{Resources: make(map[string]int)}
+		p.patterns[pattern] = h
+	}
+	return h
+}
+
+// visit counts a visit of a document of pattern.
+func (p *Predictor) visit(pattern string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.historyOf(pattern)
+	if h == nil {
+		return
+	}
+	h.Visits++
+	if h.Visits > maxPredictionVisits {
+		h.Visits /= 2
+		for res, n := range h.Resources {
+			if n /= 2; n == 0 {
+				h.forget(res)
+			} else {
+				h.Resources[res] = n
+			}
+		}
+	}
+	p.dirty = true
+}
+
+// record counts resource requested by a visit of a document of pattern,
+// once per visit.
+func (p *Predictor) record(pattern, resource string, module bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.historyOf(pattern)
+	if h == nil {
+		return
+	}
+	if _, ok := h.Resources[resource]; !ok && len(h.Resources) >= maxPredictedResources {
+		var least string
+		for res, n := range h.Resources {
+			if least == "" || n < h.Resources[least] {
+				least = res
+			}
+		}
+		h.forget(least)
+	}
+	if module {
+		if h.Modules == nil {
+			h.Modules = make(map[string]bool)
+		}
+		h.Modules[resource] = true
+	}
+	if h.Resources[resource] < h.Visits {
+		h.Resources[resource]++
+	}
+	p.dirty = true
+}
+
+// Predict returns the resources documents like docUrl requested often
+// enough, most confident first.
+func (p *Predictor) Predict(docUrl *url.URL) []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.patterns[documentPattern(docUrl)]
+	if !ok || h.Visits < p.opts.MinVisits {
+		return nil
+	}
+	var resources []string
+	for res, n := range h.Resources {
+		if float64(n)/float64(h.Visits) >= p.opts.MinConfidence {
+			resources = append(resources, res)
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		ni, nj := h.Resources[resources[i]], h.Resources[resources[j]]
+		return ni > nj || ni == nj && resources[i] < resources[j]
+	})
+	return resources
+}
+
+// isModule reports whether documents like docUrl requested resource as an
+// ES module.
+func (p *Predictor) isModule(docUrl *url.URL, resource string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.patterns[documentPattern(docUrl)]
+	return ok && h.Modules[resource]
+}
+
+func (p *Predictor) saveLoop() {
+	ticker := time.NewTicker(predictorSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.Save(); err != nil {
+			p.logger.Error("save prediction history: ", err)
+		}
+	}
+}
+
+// Save writes the history to the store if it changed.
+func (p *Predictor) Save() error {
+	p.mu.Lock()
+	if !p.dirty {
+		p.mu.Unlock()
+		return nil
+	}
+	buf, err := json.Marshal(p.patterns)
+	p.dirty = false
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// replaced atomically, a crash leaves the previous history
+	tmp, err := os.CreateTemp(filepath.Dir(p.opts.StorePath), filepath.Base(p.opts.StorePath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.opts.StorePath)
+}
+
+type documentVisit struct {
+	url     string
+	pattern string
+	at      time.Time
+	// requests recorded so far, each counts once per visit
+	seen map[string]bool
+}
+
+// predictionSession attributes the requests of one tunnel conn to the
+// documents they follow.
+type predictionSession struct {
+	p *Predictor
+
+	mu sync.Mutex
+	// within the window, oldest first
+	visits []*documentVisit
+}
+
+func newPredictionSession(p *Predictor) *predictionSession {
+	return &predictionSession{p: p}
+}
+
+func (s *predictionSession) expire(now time.Time) {
+	i := 0
+	for i < len(s.visits) && now.Sub(s.visits[i].at) > s.p.opts.Window {
+		i++
+	}
+	s.visits = s.visits[i:]
+}
+
+func (s *predictionSession) documentVisited(docUrl *url.URL) {
+	if s.p == nil {
+		return
+	}
+	pattern := documentPattern(docUrl)
+	s.p.visit(pattern)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.expire(now)
+	s.visits = append(s.visits, &documentVisit{
+		url:     docUrl.String(),
+		pattern: pattern,
+		at:      now,
+		seen:    make(map[string]bool),
+	})
+}
+
+// requested records resource, an ES module if module, against the
+// document named by referrer if it's recent, or else the latest one.
+func (s *predictionSession) requested(resource, referrer string, module bool) {
+	if s.p == nil {
+		return
+	}
+	s.mu.Lock()
+	s.expire(time.Now())
+	if len(s.visits) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	visit := s.visits[len(s.visits)-1]
+	for _, v := range s.visits {
+		if v.url == referrer {
+			visit = v
+		}
+	}
+	if visit.seen[resource] {
+		s.mu.Unlock()
+		return
+	}
+	visit.seen[resource] = true
+	s.mu.Unlock()
+	s.p.record(visit.pattern, resource, module)
+}
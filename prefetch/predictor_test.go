@@ -0,0 +1,141 @@
+package prefetch
+
+import (
+	"net/url"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Predictor", func() {
+	mustParse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		Expect(err).To(BeNil())
+		return u
+	}
+
+	newPredictor := func() *Predictor {
+		p, err := NewPredictor(PredictorOptions{
+			StorePath:     filepath.Join(GinkgoT().TempDir(), "history.json"),
+			Window:        time.Second,
+			MinConfidence: 0.5,
+			MinVisits:     2,
+		})
+		Expect(err).To(BeNil())
+		return p
+	}
+
+	It("should group documents by pattern", func() {
+		for _, c := range []struct{ url, pattern string }{
+			{"https://example.com/item/12345?ref=a", "example.com/item/*"},
+			{"https://example.com/item/67890", "example.com/item/*"},
+			{"https://example.com/u/3f2504e0-4f89-11d3-9a0c-0305e82c3301/posts", "example.com/u/*/posts"},
+			{"https://example.com/blog/hello-world", "example.com/blog/hello-world"},
+		} {
+			Expect(documentPattern(mustParse(c.url))).To(Equal(c.pattern))
+		}
+	})
+
+	It("should predict resources requested often enough", func() {
+		p := newPredictor()
+		s := newPredictionSession(p)
+		for i, doc := range []string{"https://example.com/item/111", "https://example.com/item/222", "https://example.com/item/333"} {
+			s.documentVisited(mustParse(doc))
+			s.requested("https://example.com/app.js", doc, false)
+			s.requested("https://example.com/app.js", doc, false)
+			if i == 0 {
+				s.requested("https://example.com/once.js", doc, false)
+			}
+		}
+		// app.js 3/3, once.js 1/3
+		Expect(p.Predict(mustParse("https://example.com/item/444"))).To(Equal([]string{"https://example.com/app.js"}))
+		Expect(p.Predict(mustParse("https://example.com/other"))).To(BeEmpty())
+	})
+
+	It("should not predict before enough visits", func() {
+		p := newPredictor()
+		s := newPredictionSession(p)
+		s.documentVisited(mustParse("https://example.com/a"))
+		s.requested("https://example.com/app.js", "", false)
+		Expect(p.Predict(mustParse("https://example.com/a"))).To(BeEmpty())
+	})
+
+	It("should attribute requests by referrer, within the window", func() {
+		p := newPredictor()
+		s := newPredictionSession(p)
+		s.documentVisited(mustParse("https://example.com/a"))
+		s.documentVisited(mustParse("https://example.com/b"))
+		s.requested("https://example.com/a.js", "https://example.com/a", false)
+		s.requested("https://example.com/b.js", "", false)
+		Expect(p.patterns["example.com/a"].Resources).To(HaveKey("https://example.com/a.js"))
+		Expect(p.patterns["example.com/b"].Resources).To(HaveKey("https://example.com/b.js"))
+
+		s.visits[0].at = time.Now().Add(-2 * time.Second)
+		s.visits[1].at = time.Now().Add(-2 * time.Second)
+		s.requested("https://example.com/late.js", "https://example.com/a", false)
+		Expect(p.patterns["example.com/a"].Resources).NotTo(HaveKey("https://example.com/late.js"))
+	})
+
+	It("should persist history", func() {
+		p := newPredictor()
+		s := newPredictionSession(p)
+		for i := 0; i < 2; i++ {
+			s.documentVisited(mustParse("https://example.com/a"))
+			s.requested("https://example.com/app.js", "", false)
+		}
+		Expect(p.Save()).To(BeNil())
+
+		loaded, err := NewPredictor(p.opts)
+		Expect(err).To(BeNil())
+		Expect(loaded.Predict(mustParse("https://example.com/a"))).To(Equal([]string{"https://example.com/app.js"}))
+	})
+
+	It("should fade old habits", func() {
+		p := newPredictor()
+		s := newPredictionSession(p)
+		for i := 0; i < maxPredictionVisits; i++ {
+			s.documentVisited(mustParse("https://example.com/a"))
+			s.requested("https://example.com/old.js", "", false)
+			s.visits = nil
+		}
+		for i := 0; i < maxPredictionVisits; i++ {
+			s.documentVisited(mustParse("https://example.com/a"))
+			s.requested("https://example.com/new.js", "", false)
+			s.visits = nil
+		}
+		Expect(p.Predict(mustParse("https://example.com/a"))).To(Equal([]string{"https://example.com/new.js"}))
+	})
+
+	It("should predict nothing when disabled", func() {
+		p, err := NewPredictor(PredictorOptions{})
+		Expect(err).To(BeNil())
+		Expect(p).To(BeNil())
+		s := newPredictionSession(p)
+		s.documentVisited(mustParse("https://example.com/a"))
+		s.requested("https://example.com/app.js", "", false)
+		Expect(p.Predict(mustParse("https://example.com/a"))).To(BeEmpty())
+	})
+
+	It("should let predicted resources nobody requests fade", func() {
+		p := newPredictor()
+		ps := &PrefetchServer{predictor: p, session: newPredictionSession(p)}
+		for _, doc := range []string{"https://example.com/item/111", "https://example.com/item/222"} {
+			ps.visitDocument(mustParse(doc))
+			ps.session.requested("https://example.com/used.js", doc, false)
+			ps.session.requested("https://example.com/stale.js", doc, false)
+		}
+		Expect(ps.visitDocument(mustParse("https://example.com/item/333"))).To(ConsistOf(
+			"https://example.com/used.js", "https://example.com/stale.js"))
+		ps.session.requested("https://example.com/used.js", "https://example.com/item/333", false)
+
+		// the pages dropped stale.js, its pushes aren't requested
+		Expect(ps.visitDocument(mustParse("https://example.com/item/444"))).To(ConsistOf(
+			"https://example.com/used.js", "https://example.com/stale.js"))
+		ps.session.requested("https://example.com/used.js", "https://example.com/item/444", false)
+		// 2/5 visits
+		Expect(ps.visitDocument(mustParse("https://example.com/item/555"))).To(Equal([]string{
+			"https://example.com/used.js"}))
+	})
+})
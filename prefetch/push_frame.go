@@ -0,0 +1,206 @@
+package prefetch
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	kbinary "github.com/kelindar/binary"
+)
+
+// A push stream is
+//
+//	stream type byte
+//	PushResponseHeader
+//	body chunks: uvarint length, data, ..., a zero length chunk
+//	PushResponseTrailer
+//
+// The body is chunked so the end of a push is explicit, a stream closed
+// before the trailer is a failed push, not a shorter body.
+
+const (
+	pushFrameVersion = 1
+
+	maxPushChunkSize = 1 << 20
+	// the client holds a push in memory until it's verified
+	maxPushBodySize = 32 << 20
+)
+
+// first byte of each stream on the push channel
+const (
+	// carries the header table's insertions, see push_header_codec.go
+	pushStreamControl byte = iota + 1
+	pushStreamResponse
+)
+
+// sent back by the client on a response stream it doesn't want, after the
+// header
+const pushReject byte = 1
+
+var (
+	errPushChunkTooLarge = errors.New("push frame: chunk too large")
+	errPushBodyTooLarge  = errors.New("push frame: body too large")
+	ErrCorruptPush       = errors.New("push frame: body doesn't match trailer")
+	ErrPushRejected      = errors.New("push frame: rejected by client")
+)
+
+type PushResponseHeader struct {
+	Version       uint8
+	UrlString     string
+	StatusCode    int
+	ContentLength int64
+	// encoded against the push channel's header table
+	HeaderBlock []byte
+}
+
+type PushResponseTrailer struct {
+	// encoded against the push channel's header table
+	TrailerBlock []byte
+	BodyLength   int64
+	// sha256 of the body
+	BodyHash []byte
+}
+
+func readPushResponseHeader(r io.Reader) (*PushResponseHeader, error) {
+	var hdr PushResponseHeader
+	if err := kbinary.NewDecoder(r).Decode(&hdr); err != nil {
+		return nil, fmt.Errorf("failed to decode PushResponseHeader: %w", err)
+	}
+	if hdr.Version != pushFrameVersion {
+		return nil, fmt.Errorf("unsupported push frame version: %d", hdr.Version)
+	}
+	return &hdr, nil
+}
+
+// pushBodyWriter chunks a pushed body and hashes it for the trailer.
+type pushBodyWriter struct {
+	w    io.Writer
+	buf  []byte
+	n    int64
+	hash hash.Hash
+}
+
+func newPushBodyWriter(w io.Writer) *pushBodyWriter {
+	return &pushBodyWriter{
+		w:    w,
+		hash: sha256.New(),
+	}
+}
+
+func (bw *pushBodyWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(p) > maxPushChunkSize {
+		p = p[:maxPushChunkSize]
+	}
+	// one write per chunk, so smux doesn't send a frame for the prefix
+	bw.buf = binary.AppendUvarint(bw.buf[:0], uint64(len(p)))
+	bw.buf = append(bw.buf, p...)
+	if _, err := bw.w.Write(bw.buf); err != nil {
+		return 0, err
+	}
+	bw.hash.Write(p)
+	bw.n += int64(len(p))
+	return len(p), nil
+}
+
+// Close ends the body with trailerBlock and what was written.
+func (bw *pushBodyWriter) Close(trailerBlock []byte) error {
+	if _, err := bw.w.Write(binary.AppendUvarint(nil, 0)); err != nil {
+		return err
+	}
+	return kbinary.MarshalTo(&PushResponseTrailer{
+		TrailerBlock: trailerBlock,
+		BodyLength:   bw.n,
+		BodyHash:     bw.hash.Sum(nil),
+	}, bw.w)
+}
+
+// pushBodyReader reads a chunked pushed body and verifies it against the
+// trailer, onTrailer is called with it before EOF is returned.
+type pushBodyReader struct {
+	r         *bufio.Reader
+	remaining uint64
+	err       error
+	onTrailer func(*PushResponseTrailer) error
+
+	n    int64
+	hash hash.Hash
+}
+
+func newPushBodyReader(r *bufio.Reader, onTrailer func(*PushResponseTrailer) error) *pushBodyReader {
+	return &pushBodyReader{
+		r:         r,
+		onTrailer: onTrailer,
+		hash:      sha256.New(),
+	}
+}
+
+func (br *pushBodyReader) Read(p []byte) (int, error) {
+	if br.err != nil {
+		return 0, br.err
+	}
+	if br.remaining == 0 {
+		n, err := binary.ReadUvarint(br.r)
+		if err != nil {
+			br.err = truncated(err)
+			return 0, br.err
+		}
+		if n > maxPushChunkSize {
+			br.err = errPushChunkTooLarge
+			return 0, br.err
+		}
+		if n == 0 {
+			br.err = br.readTrailer()
+			return 0, br.err
+		}
+		br.remaining = n
+	}
+	if uint64(len(p)) > br.remaining {
+		p = p[:br.remaining]
+	}
+	n, err := br.r.Read(p)
+	br.remaining -= uint64(n)
+	br.n += int64(n)
+	br.hash.Write(p[:n])
+	if err != nil {
+		br.err = truncated(err)
+		// hand out what was read, the error comes next time
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return n, br.err
+}
+
+func (br *pushBodyReader) readTrailer() error {
+	var trailer PushResponseTrailer
+	if err := kbinary.NewDecoder(br.r).Decode(&trailer); err != nil {
+		return truncated(fmt.Errorf("failed to decode PushResponseTrailer: %w", err))
+	}
+	if trailer.BodyLength != br.n {
+		return fmt.Errorf("%w: length %d, trailer says %d", ErrCorruptPush, br.n, trailer.BodyLength)
+	}
+	if !bytes.Equal(trailer.BodyHash, br.hash.Sum(nil)) {
+		return fmt.Errorf("%w: sha256 mismatch", ErrCorruptPush)
+	}
+	if err := br.onTrailer(&trailer); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// truncated turns EOF in the middle of a push into an error, only the
+// trailer ends a body.
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package prefetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing/iotest"
+
+	kbinary "github.com/kelindar/binary"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/zckevin/http2-mitm-proxy/common"
+)
+
+var _ = Describe("PushFrame", func() {
+	body := strings.Repeat("console.log('hello');\n", 4096)
+
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Trailer", "X-Checksum")
+		// no Content-Length, chunked on h1
+		half := len(body) / 2
+		io.WriteString(w, body[:half])
+		w.(http.Flusher).Flush()
+		io.WriteString(w, body[half:])
+		w.Header().Set("X-Checksum", "abc")
+	})
+
+	push := func(resp *http.Response) *http.Response {
+		cc, sc := net.Pipe()
+		pushRespCh := make(chan *http.Response, 1)
+		client := NewPushChannelClient(func(s string) (net.Conn, error) {
+			return cc, nil
+		}, pushRespCh, nil)
+		server := NewPushChannelServer(sc, nil)
+		DeferCleanup(client.Close)
+		DeferCleanup(server.Close)
+
+		go server.Push(context.Background(), resp)
+		return <-pushRespCh
+	}
+
+	expectRoundTrip := func(resp *http.Response) {
+		header := resp.Header.Clone()
+		pushed := push(resp)
+		Expect(pushed.StatusCode).To(Equal(http.StatusOK))
+		Expect(pushed.Header).To(Equal(header))
+		Expect(pushed.Header.Values("Set-Cookie")).To(Equal([]string{"a=1", "b=2"}))
+		Expect(pushed.ContentLength).To(Equal(int64(-1)))
+
+		buf, err := io.ReadAll(pushed.Body)
+		Expect(err).To(BeNil())
+		Expect(string(buf)).To(Equal(body))
+		Expect(pushed.Trailer.Get("X-Checksum")).To(Equal("abc"))
+	}
+
+	It("should round trip h1 origin responses", func() {
+		srv := httptest.NewServer(origin)
+		defer srv.Close()
+		resp, err := srv.Client().Get(srv.URL + "/a.js")
+		Expect(err).To(BeNil())
+		Expect(resp.ProtoMajor).To(Equal(1))
+		Expect(resp.TransferEncoding).To(Equal([]string{"chunked"}))
+		expectRoundTrip(resp)
+	})
+
+	It("should round trip h2 origin responses", func() {
+		srv := httptest.NewUnstartedServer(origin)
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		defer srv.Close()
+		resp, err := srv.Client().Get(srv.URL + "/a.js")
+		Expect(err).To(BeNil())
+		Expect(resp.ProtoMajor).To(Equal(2))
+		expectRoundTrip(resp)
+	})
+
+	It("should carry body length and hash in the trailer", func() {
+		buf := &bytes.Buffer{}
+		bw := newPushBodyWriter(buf)
+		io.Copy(bw, strings.NewReader(body))
+		Expect(bw.Close(nil)).To(BeNil())
+
+		var trailer *PushResponseTrailer
+		br := newPushBodyReader(bufio.NewReader(buf), func(t *PushResponseTrailer) error {
+			trailer = t
+			return nil
+		})
+		got, err := io.ReadAll(br)
+		Expect(err).To(BeNil())
+		Expect(string(got)).To(Equal(body))
+		sum := sha256.Sum256([]byte(body))
+		Expect(trailer.BodyLength).To(Equal(int64(len(body))))
+		Expect(trailer.BodyHash).To(Equal(sum[:]))
+	})
+
+	It("should fail bodies cut before the trailer", func() {
+		buf := &bytes.Buffer{}
+		bw := newPushBodyWriter(buf)
+		io.Copy(bw, strings.NewReader(body))
+		br := newPushBodyReader(bufio.NewReader(buf), func(t *PushResponseTrailer) error {
+			return nil
+		})
+		_, err := io.ReadAll(br)
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+	})
+
+	It("should fail bodies not matching the trailer", func() {
+		buf := &bytes.Buffer{}
+		buf.Write([]byte{5})
+		buf.WriteString("hello")
+		buf.Write([]byte{0})
+		kbinary.MarshalTo(&PushResponseTrailer{BodyLength: 5, BodyHash: make([]byte, sha256.Size)}, buf)
+		br := newPushBodyReader(bufio.NewReader(buf), func(t *PushResponseTrailer) error {
+			return nil
+		})
+		_, err := io.ReadAll(br)
+		Expect(errors.Is(err, ErrCorruptPush)).To(BeTrue())
+	})
+
+	It("should discard pushes failing mid-stream", func() {
+		cc, sc := net.Pipe()
+		pushRespCh := make(chan *http.Response, 2)
+		client := NewPushChannelClient(func(s string) (net.Conn, error) {
+			return cc, nil
+		}, pushRespCh, nil)
+		server := NewPushChannelServer(sc, nil)
+		defer client.Close()
+		defer server.Close()
+
+		newResponse := func(url string, r io.Reader) *http.Response {
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        make(http.Header),
+				Body:          io.NopCloser(r),
+				ContentLength: int64(len(body)),
+				Request:       req,
+			}
+		}
+		discarded := common.DiscardedPushes.Value()
+		broken := io.MultiReader(strings.NewReader(body[:100]), iotest.ErrReader(errors.New("origin reset")))
+		Expect(server.Push(context.Background(), newResponse("https://example.com/broken.js", broken))).NotTo(BeNil())
+		Eventually(common.DiscardedPushes.Value).Should(Equal(discarded + 1))
+
+		Expect(server.Push(context.Background(), newResponse("https://example.com/ok.js", strings.NewReader(body)))).To(BeNil())
+		pushed := <-pushRespCh
+		Expect(pushed.Request.URL.String()).To(Equal("https://example.com/ok.js"))
+		Expect(pushRespCh).To(BeEmpty())
+	})
+
+	It("should abort pushes the client rejects", func() {
+		cc, sc := net.Pipe()
+		pushRespCh := make(chan *http.Response, 1)
+		client := NewPushChannelClient(func(s string) (net.Conn, error) {
+			return cc, nil
+		}, pushRespCh, func(url string, header http.Header) bool {
+			return header.Get("Etag") != `"cached"`
+		})
+		server := NewPushChannelServer(sc, nil)
+		defer client.Close()
+		defer server.Close()
+
+		// an origin that never finishes the body
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go pw.Write([]byte(body[:100]))
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/cached.js", nil)
+		resp := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{"Etag": {`"cached"`}},
+			Body:          pr,
+			ContentLength: -1,
+			Request:       req,
+		}
+		rejected := common.RejectedPushes.Value()
+		aborted := common.AbortedPushes.Value()
+		Expect(server.Push(context.Background(), resp)).To(Equal(ErrPushRejected))
+		Expect(common.RejectedPushes.Value()).To(Equal(rejected + 1))
+		Expect(common.AbortedPushes.Value()).To(Equal(aborted + 1))
+		Expect(pushRespCh).To(BeEmpty())
+		// the origin body was closed
+		_, err := pw.Write([]byte("more"))
+		Expect(err).To(Equal(io.ErrClosedPipe))
+	})
+
+	It("should reject unknown versions", func() {
+		buf, err := kbinary.Marshal(&PushResponseHeader{Version: pushFrameVersion + 1})
+		Expect(err).To(BeNil())
+		_, err = readPushResponseHeader(bytes.NewReader(buf))
+		Expect(err).NotTo(BeNil())
+	})
+})
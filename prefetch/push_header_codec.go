@@ -0,0 +1,408 @@
+package prefetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// Pushed response headers are encoded QPACK style against a dynamic table
+// shared by the push channel. HPACK's table needs header blocks decoded in
+// the order they were encoded, but pushes travel on concurrent mux streams,
+// so insertions go over one control stream in order instead and each header
+// block starts with how many insertions it needs, the decoder waits for
+// them before decoding.
+//
+// The table is append-only and stops growing when full, so neither side
+// has to agree on evictions, a new push channel starts a new table.
+
+const (
+	maxDynamicTableEntries = 1024
+	maxDynamicTableSize    = 64 << 10
+	// long values are rarely repeated verbatim
+	maxIndexedValueLen = 256
+	maxHeaderStringLen = 64 << 10
+
+	// how long a header block waits for its insertions on the control stream
+	dynamicTableWaitTimeout = 10 * time.Second
+)
+
+// field representations, in header blocks and, except fieldIndexed, as
+// insertions on the control stream
+const (
+	// a dynamic table entry
+	fieldIndexed byte = iota
+	// a static table name with a literal value
+	fieldStaticName
+	// a dynamic table entry's name with a literal value
+	fieldDynamicName
+	// literal name and value
+	fieldLiteral
+)
+
+var (
+	// the response headers origins send most, in http.Header's canonical form
+	staticHeaderNames = []string{
+		"Accept-Ranges",
+		"Access-Control-Allow-Credentials",
+		"Access-Control-Allow-Headers",
+		"Access-Control-Allow-Methods",
+		"Access-Control-Allow-Origin",
+		"Access-Control-Expose-Headers",
+		"Age",
+		"Alt-Svc",
+		"Cache-Control",
+		"Content-Disposition",
+		"Content-Encoding",
+		"Content-Language",
+		"Content-Length",
+		"Content-Security-Policy",
+		"Content-Type",
+		"Cross-Origin-Resource-Policy",
+		"Date",
+		"Etag",
+		"Expires",
+		"Last-Modified",
+		"Link",
+		"Location",
+		"Referrer-Policy",
+		"Server",
+		"Set-Cookie",
+		"Strict-Transport-Security",
+		"Timing-Allow-Origin",
+		"Vary",
+		"Via",
+		"X-Cache",
+		"X-Content-Type-Options",
+		"X-Frame-Options",
+		"X-Xss-Protection",
+	}
+	staticHeaderIndex = func() map[string]uint64 {
+		m := make(map[string]uint64, len(staticHeaderNames))
+		for i, name := range staticHeaderNames {
+			m[name] = uint64(i)
+		}
+		return m
+	}()
+
+	// values unique to each response, inserting them only wastes the table
+	unindexedHeaders = map[string]bool{
+		"Age":            true,
+		"Content-Length": true,
+		"Content-Md5":    true,
+		"Date":           true,
+		"Etag":           true,
+		"Expires":        true,
+		"Last-Modified":  true,
+		"Set-Cookie":     true,
+	}
+
+	errDynamicTableFull     = errors.New("push header: dynamic table full")
+	errDynamicTableTimeout  = errors.New("push header: timeout waiting for dynamic table insertions")
+	errInvalidFieldRef      = errors.New("push header: invalid field reference")
+	errHeaderStringTooLarge = errors.New("push header: string too large")
+)
+
+type headerField struct {
+	name, value string
+}
+
+func (f headerField) size() int {
+	// same accounting as HPACK
+	return len(f.name) + len(f.value) + 32
+}
+
+// appendString appends s length prefixed, Huffman coded if that's shorter.
+func appendString(dst []byte, s string) []byte {
+	if n := hpack.HuffmanEncodeLength(s); n < uint64(len(s)) {
+		dst = binary.AppendUvarint(dst, n<<1|1)
+		return hpack.AppendHuffmanString(dst, s)
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(s))<<1)
+	return append(dst, s...)
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readString(r byteReader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	huffman, length := n&1 == 1, n>>1
+	if length > maxHeaderStringLen {
+		return "", errHeaderStringTooLarge
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	if huffman {
+		return hpack.HuffmanDecodeToString(buf)
+	}
+	return string(buf), nil
+}
+
+// headerEncoder is the server side of a push channel's header table.
+type headerEncoder struct {
+	mu sync.Mutex
+	// insertions are written here in table order, nil once it failed and
+	// then nothing more is inserted
+	control io.Writer
+
+	entries map[headerField]uint64
+	// the latest entry of each name, for fieldDynamicName
+	names map[string]uint64
+	count uint64
+	size  int
+}
+
+func newHeaderEncoder(control io.Writer) *headerEncoder {
+	return &headerEncoder{
+		control: control,
+		entries: make(map[headerField]uint64),
+		names:   make(map[string]uint64),
+	}
+}
+
+// appendLiteral appends f with its name referenced if possible, required
+// is raised to cover the reference.
+func (e *headerEncoder) appendLiteral(dst []byte, f headerField, required *uint64) []byte {
+	if i, ok := staticHeaderIndex[f.name]; ok {
+		dst = append(dst, fieldStaticName)
+		dst = binary.AppendUvarint(dst, i)
+	} else if i, ok := e.names[f.name]; ok {
+		dst = append(dst, fieldDynamicName)
+		dst = binary.AppendUvarint(dst, i)
+		if i+1 > *required {
+			*required = i + 1
+		}
+	} else {
+		dst = append(dst, fieldLiteral)
+		dst = appendString(dst, f.name)
+	}
+	return appendString(dst, f.value)
+}
+
+func (e *headerEncoder) insertable(f headerField) bool {
+	return e.control != nil &&
+		!unindexedHeaders[f.name] &&
+		len(f.value) <= maxIndexedValueLen
+}
+
+// insert writes f to the control stream and returns its index.
+func (e *headerEncoder) insert(f headerField) (uint64, error) {
+	if e.count >= maxDynamicTableEntries || e.size+f.size() > maxDynamicTableSize {
+		return 0, errDynamicTableFull
+	}
+	// instructions only reference earlier entries, nothing to wait for
+	var required uint64
+	if _, err := e.control.Write(e.appendLiteral(nil, f, &required)); err != nil {
+		e.control = nil
+		return 0, err
+	}
+	i := e.count
+	e.entries[f] = i
+	e.names[f.name] = i
+	e.count++
+	e.size += f.size()
+	return i, nil
+}
+
+// encode returns the header block of h, inserting its new fields into the
+// dynamic table first.
+func (e *headerEncoder) encode(h http.Header) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		fields   []byte
+		required uint64
+	)
+	for _, name := range names {
+		for _, value := range h[name] {
+			f := headerField{name, value}
+			i, ok := e.entries[f]
+			if !ok && e.insertable(f) {
+				var err error
+				i, err = e.insert(f)
+				ok = err == nil
+			}
+			if ok {
+				fields = append(fields, fieldIndexed)
+				fields = binary.AppendUvarint(fields, i)
+				if i+1 > required {
+					required = i + 1
+				}
+				continue
+			}
+			fields = e.appendLiteral(fields, f, &required)
+		}
+	}
+	block := binary.AppendUvarint(nil, required)
+	return append(block, fields...)
+}
+
+// headerDecoder is the client side of a push channel's header table.
+type headerDecoder struct {
+	mu      sync.Mutex
+	entries []headerField
+	size    int
+	changed chan struct{}
+}
+
+func newHeaderDecoder() *headerDecoder {
+	return &headerDecoder{
+		changed: make(chan struct{}),
+	}
+}
+
+func (d *headerDecoder) readField(r byteReader, entries []headerField, op byte) (f headerField, err error) {
+	ref := func() (uint64, error) {
+		i, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, err
+		}
+		if i >= uint64(len(entries)) {
+			return 0, errInvalidFieldRef
+		}
+		return i, nil
+	}
+
+	switch op {
+	case fieldIndexed:
+		i, err := ref()
+		if err != nil {
+			return f, err
+		}
+		return entries[i], nil
+	case fieldStaticName:
+		i, err := binary.ReadUvarint(r)
+		if err != nil {
+			return f, err
+		}
+		if i >= uint64(len(staticHeaderNames)) {
+			return f, errInvalidFieldRef
+		}
+		f.name = staticHeaderNames[i]
+	case fieldDynamicName:
+		i, err := ref()
+		if err != nil {
+			return f, err
+		}
+		f.name = entries[i].name
+	case fieldLiteral:
+		if f.name, err = readString(r); err != nil {
+			return f, err
+		}
+	default:
+		return f, fmt.Errorf("push header: unknown field representation %d", op)
+	}
+	f.value, err = readString(r)
+	return f, err
+}
+
+// readControl applies the insertions read from the control stream until
+// it's closed.
+func (d *headerDecoder) readControl(control io.Reader) error {
+	r := bufio.NewReader(control)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if op == fieldIndexed {
+			return errInvalidFieldRef
+		}
+		d.mu.Lock()
+		entries := d.entries
+		d.mu.Unlock()
+		f, err := d.readField(r, entries, op)
+		if err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		if len(d.entries) >= maxDynamicTableEntries || d.size+f.size() > maxDynamicTableSize {
+			d.mu.Unlock()
+			return errDynamicTableFull
+		}
+		d.entries = append(d.entries, f)
+		d.size += f.size()
+		close(d.changed)
+		d.changed = make(chan struct{})
+		d.mu.Unlock()
+	}
+}
+
+// waitFor returns the table once it has at least n entries.
+func (d *headerDecoder) waitFor(ctx context.Context, n uint64) ([]headerField, error) {
+	timer := time.NewTimer(dynamicTableWaitTimeout)
+	defer timer.Stop()
+	for {
+		d.mu.Lock()
+		entries, changed := d.entries, d.changed
+		d.mu.Unlock()
+		if uint64(len(entries)) >= n {
+			return entries, nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, errDynamicTableTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// decode decodes a header block once the insertions it needs arrived.
+func (d *headerDecoder) decode(ctx context.Context, block []byte) (http.Header, error) {
+	r := bytes.NewReader(block)
+	required, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if required > maxDynamicTableEntries {
+		return nil, errInvalidFieldRef
+	}
+	entries, err := d.waitFor(ctx, required)
+	if err != nil {
+		return nil, err
+	}
+
+	h := make(http.Header)
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return h, nil
+		}
+		f, err := d.readField(r, entries, op)
+		if err != nil {
+			return nil, err
+		}
+		h[f.name] = append(h[f.name], f.value)
+	}
+}
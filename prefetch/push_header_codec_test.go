@@ -0,0 +1,100 @@
+package prefetch
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PushHeaderCodec", func() {
+	newHeader := func(date string) http.Header {
+		h := make(http.Header)
+		h.Set("Content-Type", "application/javascript; charset=utf-8")
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		h.Set("X-Custom-Origin", "edge-17")
+		h.Set("Date", date)
+		h.Add("Vary", "Accept-Encoding")
+		h.Add("Vary", "Origin")
+		return h
+	}
+
+	It("should round trip and shrink repeated headers", func() {
+		control := &bytes.Buffer{}
+		enc := newHeaderEncoder(control)
+		dec := newHeaderDecoder()
+
+		h1 := newHeader("Mon, 02 Jan 2006 15:04:05 GMT")
+		h2 := newHeader("Mon, 02 Jan 2006 15:04:06 GMT")
+		block1 := enc.encode(h1)
+		block2 := enc.encode(h2)
+		literal := newHeaderEncoder(nil).encode(h2)
+		Expect(len(block2)).To(BeNumerically("<", len(literal)/2))
+
+		Expect(dec.readControl(control)).To(BeNil())
+		for _, c := range []struct {
+			block []byte
+			h     http.Header
+		}{{block1, h1}, {block2, h2}} {
+			decoded, err := dec.decode(context.Background(), c.block)
+			Expect(err).To(BeNil())
+			Expect(decoded).To(Equal(c.h))
+		}
+		// unique values aren't inserted
+		Expect(dec.entries).To(HaveLen(5))
+	})
+
+	It("should wait for insertions arriving after the header block", func() {
+		pr, pw := io.Pipe()
+		control := &bytes.Buffer{}
+		enc := newHeaderEncoder(control)
+		dec := newHeaderDecoder()
+
+		// the control stream lags behind the header block
+		h := newHeader("Mon, 02 Jan 2006 15:04:05 GMT")
+		block := enc.encode(h)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			pw.Write(control.Bytes())
+			pw.Close()
+		}()
+		go dec.readControl(pr)
+
+		decoded, err := dec.decode(context.Background(), block)
+		Expect(err).To(BeNil())
+		Expect(decoded).To(Equal(h))
+	})
+
+	It("should give up waiting when canceled", func() {
+		enc := newHeaderEncoder(&bytes.Buffer{})
+		dec := newHeaderDecoder()
+		block := enc.encode(newHeader("Mon, 02 Jan 2006 15:04:05 GMT"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := dec.decode(ctx, block)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("should send literals without a control stream", func() {
+		enc := newHeaderEncoder(nil)
+		dec := newHeaderDecoder()
+		h := newHeader("Mon, 02 Jan 2006 15:04:05 GMT")
+		decoded, err := dec.decode(context.Background(), enc.encode(h))
+		Expect(err).To(BeNil())
+		Expect(decoded).To(Equal(h))
+	})
+
+	It("should reject references beyond the table", func() {
+		enc := newHeaderEncoder(&bytes.Buffer{})
+		enc.encode(newHeader("Mon, 02 Jan 2006 15:04:05 GMT"))
+		dec := newHeaderDecoder()
+		// claims to need no insertions but references entry 0
+		_, err := dec.decode(context.Background(), []byte{0, fieldIndexed, 0})
+		Expect(err).To(Equal(errInvalidFieldRef))
+	})
+})
@@ -0,0 +1,262 @@
+package prefetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/zckevin/http2-mitm-proxy/common"
+	htmlparser "github.com/zckevin/http2-mitm-proxy/prefetch/html_parser"
+)
+
+// PushBudget bounds what a tunnel conn's pushes may take of the link, zero
+// fields are unlimited.
+type PushBudget struct {
+	// pushes in progress, fetching or sending
+	MaxPushes        int
+	MaxPushesPerPage int
+	// response bytes of the pushes in progress, unknown lengths count as
+	// maxPushChunkSize until they're sent
+	MaxBytesInFlight int64
+	// bytes a document's pushes may send in total, the rest is skipped
+	MaxBytesPerPage int64
+}
+
+var DefaultPushBudget = PushBudget{
+	MaxPushes:        6,
+	MaxPushesPerPage: 4,
+	MaxBytesInFlight: 4 << 20,
+	MaxBytesPerPage:  8 << 20,
+}
+
+const (
+	// a push waits at most this long for foreground requests to get their
+	// response headers before it starts, and as long in total while sending,
+	// so a long-poll or stream doesn't stall prefetching for good. Once the
+	// foreground responses are sent, the gate orders the writes.
+	maxPushPreemption = 500 * time.Millisecond
+)
+
+var (
+	ErrPushBudgetExceeded = errors.New("prefetch: page push budget exceeded")
+)
+
+// pushScheduler admits the pushes of a tunnel conn, each document's
+// pushes share a pushPage.
+type pushScheduler struct {
+	budget PushBudget
+	// pushes yield to requests of the browser in progress
+	gate *common.PriorityGate
+
+	mu            sync.Mutex
+	pushes        int
+	bytesInFlight int64
+	changed       chan struct{}
+}
+
+func newPushScheduler(budget PushBudget, gate *common.PriorityGate) *pushScheduler {
+	return &pushScheduler{
+		budget:  budget,
+		gate:    gate,
+		changed: make(chan struct{}),
+	}
+}
+
+// notify wakes up all waiters, must be called with s.mu held.
+func (s *pushScheduler) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until ok, called with s.mu held, holds it again on return.
+func (s *pushScheduler) wait(ctx context.Context, ok func() bool) error {
+	for !ok() {
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+			s.mu.Lock()
+		case <-ctx.Done():
+			s.mu.Lock()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *pushScheduler) newPage() *pushPage {
+	return &pushPage{s: s, claimed: make(map[string]bool), modules: make(map[string]bool)}
+}
+
+type pushPage struct {
+	s *pushScheduler
+	// guarded by s.mu
+	pushes  int
+	spent   int64
+	claimed map[string]bool
+	// urls known to be ES modules, the source bytes of those parsed for
+	// imports, and the document's import map
+	modules     map[string]bool
+	moduleBytes int64
+	importMap   *htmlparser.ImportMap
+}
+
+func (p *pushPage) markModule(url string) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	p.modules[url] = true
+}
+
+func (p *pushPage) isModule(url string) bool {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	return p.modules[url]
+}
+
+func (p *pushPage) setImportMap(m *htmlparser.ImportMap) {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	// browsers only take the first one
+	if p.importMap == nil {
+		p.importMap = m
+	}
+}
+
+func (p *pushPage) getImportMap() *htmlparser.ImportMap {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	return p.importMap
+}
+
+// chargeModule adds n parsed bytes to the page's module graph, it reports
+// whether the graph is still within limit and its imports may be followed.
+func (p *pushPage) chargeModule(n int, limit int64) bool {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	p.moduleBytes += int64(n)
+	return limit <= 0 || p.moduleBytes <= limit
+}
+
+// claim reports whether url is new to the page, e.g. not imported by two
+// stylesheets or by itself.
+func (p *pushPage) claim(url string) bool {
+	p.s.mu.Lock()
+	defer p.s.mu.Unlock()
+	if p.claimed[url] {
+		return false
+	}
+	p.claimed[url] = true
+	return true
+}
+
+func (p *pushPage) overBudget() bool {
+	return p.s.budget.MaxBytesPerPage > 0 && p.spent >= p.s.budget.MaxBytesPerPage
+}
+
+// acquire waits for a push slot of the page, call release when the push is
+// done.
+func (p *pushPage) acquire(ctx context.Context) (release func(), err error) {
+	s := p.s
+	if err := s.gate.WaitIdle(ctx, common.UrgencyBackground, maxPushPreemption); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.wait(ctx, func() bool {
+		return p.overBudget() ||
+			(s.budget.MaxPushes <= 0 || s.pushes < s.budget.MaxPushes) &&
+				(s.budget.MaxPushesPerPage <= 0 || p.pushes < s.budget.MaxPushesPerPage)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.overBudget() {
+		common.PushesOverBudget.Add(1)
+		return nil, ErrPushBudgetExceeded
+	}
+	s.pushes++
+	p.pushes++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.pushes--
+		p.pushes--
+		s.notify()
+	}, nil
+}
+
+// body wraps a fetched response body for pushing: it waits for bytes in
+// flight to fit, stops at the page's byte budget and yields to foreground
+// requests before reads, up to maxPushPreemption in total.
+func (p *pushPage) body(ctx context.Context, body io.ReadCloser, contentLength int64) (io.ReadCloser, error) {
+	s := p.s
+	reserved := contentLength
+	if reserved < 0 {
+		reserved = maxPushChunkSize
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// a push larger than the whole budget goes alone
+	err := s.wait(ctx, func() bool {
+		return s.budget.MaxBytesInFlight <= 0 || s.bytesInFlight == 0 ||
+			s.bytesInFlight+reserved <= s.budget.MaxBytesInFlight
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p.overBudget() {
+		common.PushesOverBudget.Add(1)
+		return nil, ErrPushBudgetExceeded
+	}
+	s.bytesInFlight += reserved
+	return &scheduledBody{ReadCloser: body, ctx: ctx, page: p, reserved: reserved}, nil
+}
+
+type scheduledBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	page *pushPage
+
+	closeOnce sync.Once
+	reserved  int64
+	// time spent yielding to foreground requests so far
+	preempted time.Duration
+}
+
+func (b *scheduledBody) Read(p []byte) (int, error) {
+	s := b.page.s
+	// preempted while the browser waits on something
+	if b.preempted < maxPushPreemption {
+		start := time.Now()
+		err := s.gate.WaitIdle(b.ctx, common.UrgencyBackground, maxPushPreemption-b.preempted)
+		b.preempted += time.Since(start)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b.page.spent += int64(n)
+	if limit := s.budget.MaxBytesPerPage; err == nil && limit > 0 && b.page.spent > limit {
+		common.PushesOverBudget.Add(1)
+		err = ErrPushBudgetExceeded
+	}
+	return n, err
+}
+
+func (b *scheduledBody) Close() error {
+	b.closeOnce.Do(func() {
+		s := b.page.s
+		s.mu.Lock()
+		s.bytesInFlight -= b.reserved
+		s.notify()
+		s.mu.Unlock()
+	})
+	return b.ReadCloser.Close()
+}
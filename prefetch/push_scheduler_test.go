@@ -0,0 +1,145 @@
+package prefetch
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/zckevin/http2-mitm-proxy/common"
+)
+
+var _ = Describe("PushScheduler", func() {
+	ctx := context.Background()
+
+	blocked := func(f func()) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			f()
+		}()
+		return done
+	}
+
+	It("should bound pushes per page and in total", func() {
+		s := newPushScheduler(PushBudget{MaxPushes: 3, MaxPushesPerPage: 2}, nil)
+		page1, page2 := s.newPage(), s.newPage()
+
+		release1, err := page1.acquire(ctx)
+		Expect(err).To(BeNil())
+		_, err = page1.acquire(ctx)
+		Expect(err).To(BeNil())
+		// page1 is at its limit, page2 isn't
+		done := blocked(func() { page1.acquire(ctx) })
+		Consistently(done).ShouldNot(BeClosed())
+		_, err = page2.acquire(ctx)
+		Expect(err).To(BeNil())
+
+		// and now everyone is at the global one
+		done2 := blocked(func() { page2.acquire(ctx) })
+		release1()
+		Eventually(func() int {
+			n := 0
+			for _, d := range []chan struct{}{done, done2} {
+				select {
+				case <-d:
+					n++
+				default:
+				}
+			}
+			return n
+		}).Should(Equal(1))
+	})
+
+	It("should give up waiting when canceled", func() {
+		s := newPushScheduler(PushBudget{MaxPushes: 1}, nil)
+		page := s.newPage()
+		_, err := page.acquire(ctx)
+		Expect(err).To(BeNil())
+
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+		_, err = page.acquire(ctx)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+
+	It("should cut pushes at the page's byte budget", func() {
+		s := newPushScheduler(PushBudget{MaxBytesPerPage: 100}, nil)
+		page := s.newPage()
+		over := common.PushesOverBudget.Value()
+
+		body, err := page.body(ctx, io.NopCloser(strings.NewReader(strings.Repeat("a", 60))), 60)
+		Expect(err).To(BeNil())
+		_, err = io.ReadAll(body)
+		Expect(err).To(BeNil())
+
+		body, err = page.body(ctx, io.NopCloser(strings.NewReader(strings.Repeat("a", 60))), 60)
+		Expect(err).To(BeNil())
+		_, err = io.ReadAll(body)
+		Expect(err).To(Equal(ErrPushBudgetExceeded))
+
+		// nothing more for the page
+		_, err = page.acquire(ctx)
+		Expect(err).To(Equal(ErrPushBudgetExceeded))
+		Expect(common.PushesOverBudget.Value()).To(Equal(over + 2))
+		// other pages are fine
+		_, err = s.newPage().acquire(ctx)
+		Expect(err).To(BeNil())
+	})
+
+	It("should bound bytes in flight", func() {
+		s := newPushScheduler(PushBudget{MaxBytesInFlight: 100}, nil)
+		page := s.newPage()
+
+		// larger than the budget, but alone
+		body1, err := page.body(ctx, io.NopCloser(strings.NewReader("")), 150)
+		Expect(err).To(BeNil())
+		done := blocked(func() {
+			page.body(ctx, io.NopCloser(strings.NewReader("")), 10)
+		})
+		Consistently(done).ShouldNot(BeClosed())
+		body1.Close()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should hold pushes back while foreground requests are in progress", func() {
+		gate := common.NewPriorityGate()
+		s := newPushScheduler(PushBudget{}, gate)
+		end := gate.Begin(common.UrgencyHighest)
+
+		done := blocked(func() { s.newPage().acquire(ctx) })
+		Consistently(done, maxPushPreemption/2).ShouldNot(BeClosed())
+		end()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should bound preemption of a push by a long-lived request", func() {
+		gate := common.NewPriorityGate()
+		s := newPushScheduler(PushBudget{}, gate)
+		// e.g. a long-poll or an event stream that never ends
+		defer gate.Begin(common.UrgencyHighest)()
+
+		const size = 1 << 20
+		start := time.Now()
+		body, err := s.newPage().body(ctx, io.NopCloser(strings.NewReader(strings.Repeat("a", size))), size)
+		Expect(err).To(BeNil())
+		buf := make([]byte, 16<<10)
+		read := 0
+		for {
+			n, err := body.Read(buf)
+			read += n
+			if err == io.EOF {
+				break
+			}
+			Expect(err).To(BeNil())
+		}
+		Expect(read).To(Equal(size))
+		// 64 reads, each waiting for the request would take 32s
+		Expect(time.Since(start)).To(And(
+			BeNumerically(">=", maxPushPreemption),
+			BeNumerically("<", 2*maxPushPreemption),
+		))
+	})
+})
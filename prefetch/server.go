@@ -2,10 +2,15 @@ package prefetch
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gregjones/httpcache"
@@ -18,6 +23,19 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	// upper bound of how long prefetches of a document may run
+	prefetchTimeout = 30 * time.Second
+	// stylesheets imported by stylesheets are followed this deep, the
+	// document's own are depth 0
+	maxStylesheetDepth = 3
+)
+
+const (
+	DefaultModuleDepth              = 4
+	DefaultModuleBytesPerPage int64 = 4 << 20
+)
+
 var (
 	defaultPrefetchRequestHeaders http.Header
 )
@@ -36,20 +54,70 @@ func init() {
 	}
 }
 
+type PrefetchServerOptions struct {
+	Budget PushBudget
+	// learns subresources to prefetch from browsing history, nil disables
+	Predictor *Predictor
+	// what documents' resources are prefetched
+	ResourceTypes htmlparser.ResourceTypes
+	// how deep ES module imports are followed, the document's modules are
+	// depth 0, 0 disables
+	ModuleDepth int
+	// source bytes of a document's modules parsed for imports, past it
+	// their imports are left to the browser, 0 for unlimited
+	ModuleBytesPerPage int64
+	// send documents' predicted subresources and those of the latest
+	// document of their pattern as 103 Early Hints
+	EarlyHints bool
+	// warm up conns to the other origins documents hint at or use
+	Preconnect bool
+}
+
 type PrefetchServer struct {
 	logger     log.ContextLogger
 	ttlHistory *common.TTLCache
 	// only one push channel is allowed for now
 	channel *PushChannelServer
+	gate    *common.PriorityGate
+	// admits prefetches within the push budget
+	scheduler *pushScheduler
+	// learns the subresources of this tunnel conn's documents
+	predictor *Predictor
+	session   *predictionSession
+	types     htmlparser.ResourceTypes
+	// bounds of the module graphs followed
+	moduleDepth        int
+	moduleBytesPerPage int64
+	earlyHints         bool
+	// preload links of the resources found in the latest document of each
+	// pattern
+	scannedHints *common.TTLCache
+	// nil if disabled or the upstream client can't
+	preconnector *preconnector
+	// the client's latest cache digest, nil until it sent one
+	cacheDigest atomic.Pointer[CacheDigest]
 
 	rfc7234HttpCache httpcache.Cache
 	httpClient       common.HTTPRequestDoer
 }
 
-func NewPrefetchServer(baseHttpClient http.RoundTripper) *PrefetchServer {
+func NewPrefetchServer(baseHttpClient http.RoundTripper, gate *common.PriorityGate, opts PrefetchServerOptions) *PrefetchServer {
 	ps := &PrefetchServer{
 		logger:     common.NewLogger("PrefetchServer"),
 		ttlHistory: common.NewTTLCache(time.Second*5, time.Minute),
+		gate:       gate,
+		scheduler:  newPushScheduler(opts.Budget, gate),
+		predictor:  opts.Predictor,
+		session:    newPredictionSession(opts.Predictor),
+		types:      opts.ResourceTypes,
+
+		moduleDepth:        opts.ModuleDepth,
+		moduleBytesPerPage: opts.ModuleBytesPerPage,
+		earlyHints:         opts.EarlyHints,
+		scannedHints:       common.NewTTLCache(scannedHintsTTL, time.Minute),
+	}
+	if p, ok := baseHttpClient.(Preconnecter); ok && opts.Preconnect {
+		ps.preconnector = newPreconnector(p)
 	}
 	ps.createHTTPClient(baseHttpClient)
 	return ps
@@ -70,7 +138,52 @@ func (ps *PrefetchServer) CreatePushChannel(conn net.Conn) {
 	if ps.channel != nil {
 		ps.channel.Close()
 	}
-	ps.channel = NewPushChannelServer(conn)
+	ps.channel = NewPushChannelServer(conn, ps.gate)
+}
+
+// ReceiveCacheDigest reads a cache digest the client sent on r, it replaces
+// the previous one.
+func (ps *PrefetchServer) ReceiveCacheDigest(r io.Reader) error {
+	digest, err := ReadCacheDigest(r)
+	if err != nil {
+		return err
+	}
+	ps.cacheDigest.Store(digest)
+	return nil
+}
+
+// ReceiveCacheHits reads the requests the client's cache answered from r
+// and credits them like those the server sees.
+func (ps *PrefetchServer) ReceiveCacheHits(r io.Reader) error {
+	msg, err := ReadCacheHits(r)
+	if err != nil {
+		return err
+	}
+	for _, hit := range msg.Hits {
+		ps.session.requested(hit.Url, hit.Referer, hit.Module)
+	}
+	return nil
+}
+
+// isModuleRequest reports whether r is likely for an ES module: browsers
+// fetch those with CORS, classic scripts without.
+func isModuleRequest(r *http.Request) bool {
+	if r.Header.Get("Sec-Fetch-Dest") == "script" {
+		return r.Header.Get("Sec-Fetch-Mode") == "cors"
+	}
+	return strings.ToLower(path.Ext(r.URL.Path)) == ".mjs"
+}
+
+// ObserveRequest lets the predictor learn from a request of the browser.
+func (ps *PrefetchServer) ObserveRequest(r *http.Request) {
+	if common.IsRequestCachable(r) {
+		ps.session.requested(r.URL.String(), r.Header.Get("Referer"), isModuleRequest(r))
+	}
+}
+
+func isImageUrl(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	return err == nil && common.IsImagePath(u.Path)
 }
 
 func filterPrefetchableDocumentResponse(resp *http.Response) bool {
@@ -90,11 +203,27 @@ var (
 	ErrThrottled                    = fmt.Errorf("prefetch: throttled")
 	ErrNoPushChannel                = fmt.Errorf("prefetch: no push channel")
 	ErrResourceExistsInRFC7234Cache = fmt.Errorf("prefetch: resource exists in rfc7234 cache")
+	ErrResourceInClientCache        = fmt.Errorf("prefetch: resource in client's cache digest")
 )
 
-func (ps *PrefetchServer) TryPrefetch(ctx context.Context, resp *http.Response) (err error) {
+func noopCancel() {}
+
+// visitDocument counts a visit of docUrl and returns its predicted
+// resources. They're only credited once the browser requests them, from
+// the server or, pushed, from the client's cache which reports its hits.
+// So those the pages dropped fade below MinConfidence.
+func (ps *PrefetchServer) visitDocument(docUrl *url.URL) []string {
+	ps.session.documentVisited(docUrl)
+	return ps.predictor.Predict(docUrl)
+}
+
+// TryPrefetch prefetches and pushes the resources of document resp. The
+// prefetches outlive the document's response, call cancel to stop them,
+// e.g. when the browser aborted the navigation.
+func (ps *PrefetchServer) TryPrefetch(ctx context.Context, resp *http.Response) (cancel context.CancelFunc, err error) {
+	cancel = noopCancel
 	if !filterPrefetchableDocumentResponse(resp) {
-		return
+		return cancel, ErrPrefetchNotDocument
 	}
 	ctx, span := tracing.GetTracer(ctx, "prefetch").Start(ctx, "TryPrefetch")
 	defer span.End()
@@ -102,49 +231,180 @@ func (ps *PrefetchServer) TryPrefetch(ctx context.Context, resp *http.Response)
 	docUrl := resp.Request.URL.String()
 	span.SetAttributes(attribute.String("url", docUrl))
 	if _, ok := ps.ttlHistory.Get(docUrl); ok {
-		return ErrThrottled
+		return cancel, ErrThrottled
 	} else {
 		ps.ttlHistory.Set(docUrl, struct{}{})
 	}
 
-	urls, err := htmlparser.ExtractResourcesInHead(ctx, resp)
-	if err != nil {
-		ps.logger.Error(err)
-		return err
+	predicted := ps.visitDocument(resp.Request.URL)
+
+	// the browser's ClientHello hints are for the document's origin, not
+	// for what it's prefetched and preconnected to
+	ctx, cancel = context.WithTimeout(common.WithoutClientHelloHints(common.DetachContext(ctx)), prefetchTimeout)
+	page := ps.scheduler.newPage()
+	preconnect := ps.preconnector.forDocument(ctx, resp.Request.URL)
+	prefetch := func(url string) context.Context {
+		preconnect(url)
+		// a push the client doesn't cache only costs bandwidth
+		if !common.IsRequestCachable(buildRequest(ctx, url)) {
+			return nil
+		}
+		if !page.claim(url) || ps.clientHasFresh(url) {
+			return nil
+		}
+		ctx, pspan := tracing.GetTracer(ctx, "prefetch").Start(ctx, url)
+		go ps.prefetchResource(ctx, pspan, url, page, 0)
+		return ctx
 	}
-	ps.logger.Info(fmt.Sprintln("prefetch doc: ", docUrl, ", resources: ", urls))
 
+	// only the spans of urls known before the response header is sent
+	// make it to the client
 	propagator := tracing.NewKeyValueSpansPropagator("")
-	for _, url := range urls {
-		ctx, pspan := tracing.GetTracer(ctx, "prefetch").Start(ctx, url)
-		go ps.prefetchResource(ctx, pspan, url, resp)
-		if tracing.Enabled {
+	for _, url := range predicted {
+		if !ps.types.Images && isImageUrl(url) {
+			continue
+		}
+		if ps.predictor.isModule(resp.Request.URL, url) {
+			page.markModule(url)
+		}
+		if ctx := prefetch(url); ctx != nil && tracing.Enabled {
 			propagator.Inject(ctx, url)
 		}
 	}
 	resp.Header.Set("x-otel-spans-map", propagator.Serialize())
-	return nil
+
+	// the rest is prefetched as the document arrives
+	hint, hinted := ps.scannedHintsRecorder(resp.Request.URL)
+	done := htmlparser.ScanResources(ctx, resp, ps.types, func(r htmlparser.Resource) {
+		if r.Preconnect {
+			preconnect(r.URL)
+			return
+		}
+		if r.Module {
+			page.markModule(r.URL)
+		}
+		hint(r)
+		prefetch(r.URL)
+	}, page.setImportMap)
+	go func() {
+		err := <-done
+		hinted()
+		if err != nil && ctx.Err() == nil {
+			ps.logger.Error(fmt.Sprintln("scan doc: ", docUrl, ", err: ", err))
+		}
+	}()
+	return cancel, nil
+}
+
+// clientHasFresh reports whether the client's cache digest has a fresh
+// copy of url.
+func (ps *PrefetchServer) clientHasFresh(url string) bool {
+	if ps.cacheDigest.Load().HasFresh(url) {
+		common.SkippedByCacheDigest.Add(1)
+		return true
+	}
+	return false
+}
+
+// prefetchStylesheetDeps prefetches what stylesheet resp imports, its fonts
+// and the images of its rules if those are wanted, the browser would only
+// find them once it has parsed it. The stylesheet is parsed while it's
+// pushed, done gets the error.
+func (ps *PrefetchServer) prefetchStylesheetDeps(ctx context.Context, resp *http.Response, page *pushPage, depth int) (done <-chan error) {
+	return htmlparser.ScanStylesheet(ctx, resp, ps.types, func(url string) {
+		if !common.IsRequestCachable(buildRequest(ctx, url)) {
+			return
+		}
+		if !page.claim(url) || ps.clientHasFresh(url) {
+			return
+		}
+		ctx, span := tracing.GetTracer(ctx, "prefetch").Start(ctx, url)
+		go ps.prefetchResource(ctx, span, url, page, depth+1)
+	})
 }
 
-func (ps *PrefetchServer) prefetchResource(ctx context.Context, span trace.Span, targetUrlStr string, resp *http.Response) (err error) {
+// prefetchModuleDeps prefetches the modules ES module resp imports, the
+// browser would only find them once it has fetched and parsed it, then
+// theirs and so on. The module is parsed while it's pushed, done gets the
+// error.
+func (ps *PrefetchServer) prefetchModuleDeps(ctx context.Context, resp *http.Response, page *pushPage, depth int) (done <-chan error) {
+	return htmlparser.ScanModuleImports(ctx, resp, page.getImportMap(), func(urls []string, size int) {
+		if !page.chargeModule(size, ps.moduleBytesPerPage) {
+			common.ModuleGraphsOverBudget.Add(1)
+			return
+		}
+		for _, url := range urls {
+			if !common.IsRequestCachable(buildRequest(ctx, url)) {
+				continue
+			}
+			page.markModule(url)
+			if !page.claim(url) || ps.clientHasFresh(url) {
+				continue
+			}
+			ctx, span := tracing.GetTracer(ctx, "prefetch").Start(ctx, url)
+			go ps.prefetchResource(ctx, span, url, page, depth+1)
+		}
+	})
+}
+
+func (ps *PrefetchServer) prefetchResource(ctx context.Context, span trace.Span, targetUrlStr string, page *pushPage, depth int) (err error) {
 	defer func() {
 		if err != nil {
+			if errors.Is(ctx.Err(), context.Canceled) {
+				common.CanceledPrefetches.Add(1)
+			}
 			span.RecordError(err)
 		}
 		span.End()
 	}()
 
+	release, err := page.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	req := buildRequest(ctx, targetUrlStr)
 	// if _, ok := ps.rfc7234HttpCache.Get(common.GetCacheKey(req)); ok {
 	// 	return ErrResourceExistsInRFC7234Cache
 	// }
 
-	if resp, err = ps.httpClient.Do(req); err != nil {
+	resp, err := ps.httpClient.Do(req)
+	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	// stale in the client's cache but unchanged, its revalidation is a 304
+	if ps.cacheDigest.Load().HasValidator(targetUrlStr, resp.Header.Get("Etag")) {
+		common.SkippedByCacheDigest.Add(1)
+		return ErrResourceInClientCache
+	}
+	if depth < maxStylesheetDepth && htmlparser.IsStylesheet(resp) {
+		done := ps.prefetchStylesheetDeps(ctx, resp, page, depth)
+		go func() {
+			if err := <-done; err != nil && ctx.Err() == nil {
+				ps.logger.Error(fmt.Sprintln("scan stylesheet: ", targetUrlStr, ", err: ", err))
+			}
+		}()
+	}
+	if depth < ps.moduleDepth && page.isModule(targetUrlStr) && htmlparser.IsJavaScript(resp) {
+		done := ps.prefetchModuleDeps(ctx, resp, page, depth)
+		go func() {
+			if err := <-done; err != nil && ctx.Err() == nil {
+				ps.logger.Error(fmt.Sprintln("scan module: ", targetUrlStr, ", err: ", err))
+			}
+		}()
+	}
+
 	if ps.channel != nil {
+		body, err := page.body(ctx, resp.Body, resp.ContentLength)
+		if err != nil {
+			return err
+		}
+		// releases the bytes in flight, resp.Body's deferred Close doesn't
+		defer body.Close()
+		resp.Body = body
 		if err = ps.channel.Push(ctx, resp); err != nil {
 			return fmt.Errorf("failed to push resp: %w", err)
 		}
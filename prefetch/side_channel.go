@@ -9,8 +9,7 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"regexp"
+	"sync"
 	"time"
 
 	ctxio "github.com/dolmen-go/contextio"
@@ -18,25 +17,29 @@ import (
 	mux "github.com/sagernet/sing-mux"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
-	eofsignal "github.com/zckevin/go-libs/eof_signal"
 	"github.com/zckevin/http2-mitm-proxy/common"
 	"github.com/zckevin/http2-mitm-proxy/tracing"
-)
-
-var (
-	remove_transfer_encoding_regex = regexp.MustCompile(`(?mi)transfer-encoding: chunked\r\n`)
+	"golang.org/x/exp/maps"
 )
 
 type PushChannelClient struct {
 	dialFn     func(string) (net.Conn, error)
 	cancel     context.CancelFunc
 	pushRespCh chan *http.Response
+	// reports whether a push is wanted by its url and headers, nil accepts
+	// all
+	accept func(url string, header http.Header) bool
 }
 
-func NewPushChannelClient(dialFn func(string) (net.Conn, error), pushRespCh chan *http.Response) *PushChannelClient {
+func NewPushChannelClient(
+	dialFn func(string) (net.Conn, error),
+	pushRespCh chan *http.Response,
+	accept func(url string, header http.Header) bool,
+) *PushChannelClient {
 	pc := &PushChannelClient{
 		dialFn:     dialFn,
 		pushRespCh: pushRespCh,
+		accept:     accept,
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	pc.cancel = cancel
@@ -44,52 +47,78 @@ func NewPushChannelClient(dialFn func(string) (net.Conn, error), pushRespCh chan
 	return pc
 }
 
-// Chunked encoding is handled by net/http(or http2 ?) and it's already de-chunked
-// recv it on client side, so we just have to remove it in resp header blob.
-func handleHttp1ChunkedEncoding(hdr *PushResponseHeader, stream net.Conn) (io.Reader, error) {
-	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewBuffer(hdr.ResponseWithoutBody)), nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
-	}
-
-	// remove chunked encoding in resp header bytes blob
-	if resp.TransferEncoding != nil && resp.TransferEncoding[0] == "chunked" {
-		hdr.ResponseWithoutBody = remove_transfer_encoding_regex.ReplaceAll(hdr.ResponseWithoutBody, nil)
-	}
-	return stream, nil
-}
-
 // serve server initiated push stream
-func (pc *PushChannelClient) servePushStream(ctx context.Context, stream net.Conn, metadata M.Metadata) (err error) {
+func (pc *PushChannelClient) servePushStream(ctx context.Context, stream net.Conn, metadata M.Metadata, table *headerDecoder) (err error) {
 	defer func() {
 		if err != nil {
 			fmt.Println("servePushStream error: ", err)
 		}
 	}()
 
-	var hdr PushResponseHeader
-	dec := binary.NewDecoder(stream)
-	if err := dec.Decode(&hdr); err != nil {
-		return fmt.Errorf("failed to decode PushResponseHeader: %w", err)
+	var streamType [1]byte
+	if _, err := io.ReadFull(stream, streamType[:]); err != nil {
+		return fmt.Errorf("failed to read push stream type: %w", err)
 	}
-	r, err := handleHttp1ChunkedEncoding(&hdr, stream)
+	switch streamType[0] {
+	case pushStreamControl:
+		return table.readControl(stream)
+	case pushStreamResponse:
+	default:
+		return fmt.Errorf("unknown push stream type: %d", streamType[0])
+	}
+
+	r := bufio.NewReader(ctxio.NewReader(ctx, stream))
+	hdr, err := readPushResponseHeader(r)
 	if err != nil {
 		return err
 	}
-	mr := io.MultiReader(bytes.NewBuffer(hdr.ResponseWithoutBody), ctxio.NewReader(ctx, r))
-	req := buildRequest(context.Background(), hdr.UrlString)
-	resp, err := http.ReadResponse(bufio.NewReader(mr), req)
+	header, err := table.decode(ctx, hdr.HeaderBlock)
 	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
+		return fmt.Errorf("failed to decode push headers: %w", err)
 	}
-	// smux stream handler would close stream after return, so we have to wait for body EOF
-	waitForBodyEof := make(chan error, 1)
-	resp.Body = eofsignal.NewBodyEOFSignal(resp.Body, func(err error) error {
-		waitForBodyEof <- stream.Close()
-		return err
+	if pc.accept != nil && !pc.accept(hdr.UrlString, header) {
+		common.RejectedPushes.Add(1)
+		// the server stops sending once it reads this, the body so far is
+		// dropped with the stream
+		stream.Write([]byte{pushReject})
+		return stream.Close()
+	}
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", hdr.StatusCode, http.StatusText(hdr.StatusCode)),
+		StatusCode:    hdr.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: hdr.ContentLength,
+		Trailer:       make(http.Header),
+		Request:       buildRequest(context.Background(), hdr.UrlString),
+	}
+	body := newPushBodyReader(r, func(t *PushResponseTrailer) error {
+		if hdr.ContentLength != -1 && t.BodyLength != hdr.ContentLength {
+			return fmt.Errorf("%w: content length %d, body %d", ErrCorruptPush, hdr.ContentLength, t.BodyLength)
+		}
+		trailer, err := table.decode(ctx, t.TrailerBlock)
+		if err != nil {
+			return fmt.Errorf("failed to decode push trailers: %w", err)
+		}
+		maps.Copy(resp.Trailer, trailer)
+		return nil
 	})
+
+	// the whole body has to check out against the trailer before the
+	// cache sees it, a truncated push must not be served as the resource
+	buf, err := io.ReadAll(io.LimitReader(body, maxPushBodySize+1))
+	if err == nil && len(buf) > maxPushBodySize {
+		err = errPushBodyTooLarge
+	}
+	if err != nil {
+		common.DiscardedPushes.Add(1)
+		return fmt.Errorf("discarded push %s: %w", hdr.UrlString, err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
 	pc.pushRespCh <- resp
-	return <-waitForBodyEof
+	return nil
 }
 
 func (pc *PushChannelClient) run(ctx context.Context) error {
@@ -101,7 +130,11 @@ func (pc *PushChannelClient) run(ctx context.Context) error {
 			continue
 		}
 		logger := common.NewLogger("pushChannelClient")
-		handler := &pushStreamHandler{pc.servePushStream}
+		// each push channel conn has its own header table
+		table := newHeaderDecoder()
+		handler := &pushStreamHandler{func(ctx context.Context, stream net.Conn, metadata M.Metadata) error {
+			return pc.servePushStream(ctx, stream, metadata, table)
+		}}
 		err = mux.HandleConnection(ctx, handler, logger, conn, M.Metadata{})
 		if err != nil && errors.Is(err, io.EOF) {
 			logger.Error("pushChannelClient stop, err: ", err)
@@ -120,9 +153,15 @@ func (pc *PushChannelClient) Close() error {
 
 type PushChannelServer struct {
 	muxClient *mux.Client
+	// pushes yield to the responses the browser is waiting for
+	gate *common.PriorityGate
+
+	headersOnce sync.Once
+	headers     *headerEncoder
+	control     net.Conn
 }
 
-func NewPushChannelServer(conn net.Conn) *PushChannelServer {
+func NewPushChannelServer(conn net.Conn, gate *common.PriorityGate) *PushChannelServer {
 	muxClient, err := mux.NewClient(mux.Options{
 		Dialer:         &singleConnDialer{conn: conn},
 		Protocol:       "smux",
@@ -133,6 +172,7 @@ func NewPushChannelServer(conn net.Conn) *PushChannelServer {
 	}
 	ps := &PushChannelServer{
 		muxClient: muxClient,
+		gate:      gate,
 	}
 	return ps
 }
@@ -141,6 +181,24 @@ var (
 	dummyAddr = M.ParseSocksaddr("localhost")
 )
 
+// headerEncoder opens the control stream of the channel's header table on
+// the first push, headers are sent literally if that fails.
+func (ps *PushChannelServer) headerEncoder() *headerEncoder {
+	ps.headersOnce.Do(func() {
+		var control io.Writer
+		st, err := ps.muxClient.DialContext(context.Background(), N.NetworkTCP, dummyAddr)
+		if err == nil {
+			if _, err = st.Write([]byte{pushStreamControl}); err == nil {
+				control, ps.control = st, st
+			} else {
+				st.Close()
+			}
+		}
+		ps.headers = newHeaderEncoder(control)
+	})
+	return ps.headers
+}
+
 func (ps *PushChannelServer) Push(ctx context.Context, resp *http.Response) error {
 	ctx, span := tracing.GetTracer(ctx, "prefetch").Start(ctx, "push")
 	defer span.End()
@@ -151,24 +209,60 @@ func (ps *PushChannelServer) Push(ctx context.Context, resp *http.Response) erro
 	}
 	defer st.Close()
 
-	dumped, _ := httputil.DumpResponse(resp, false)
+	// the client may reject the push once it read the header
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go func() {
+		var reply [1]byte
+		if _, err := io.ReadFull(st, reply[:]); err == nil && reply[0] == pushReject {
+			cancel(ErrPushRejected)
+			// aborts the origin transfer, and the copy blocked reading it
+			resp.Body.Close()
+		}
+	}()
+
 	hdr := &PushResponseHeader{
-		UrlString:           resp.Request.URL.String(),
-		ResponseWithoutBody: dumped,
+		Version:       pushFrameVersion,
+		UrlString:     resp.Request.URL.String(),
+		StatusCode:    resp.StatusCode,
+		ContentLength: resp.ContentLength,
+		HeaderBlock:   ps.headerEncoder().encode(resp.Header),
 	}
-	if err := binary.MarshalTo(hdr, st); err != nil {
+	// the header yields to urgent responses like the body does
+	var hdrBuf bytes.Buffer
+	hdrBuf.WriteByte(pushStreamResponse)
+	if err := binary.MarshalTo(hdr, &hdrBuf); err != nil {
 		return fmt.Errorf("failed to marshal PushResponseHeader: %w", err)
 	}
-	if n, err := io.Copy(st, resp.Body); err != nil {
+	if _, err := ps.gate.Writer(st, common.UrgencyBackground).Write(hdrBuf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write PushResponseHeader: %w", err)
+	}
+	// bailing out before the trailer tells the client the push failed
+	bw := newPushBodyWriter(st)
+	if n, err := io.Copy(ps.gate.Writer(bw, common.UrgencyBackground), ctxio.NewReader(ctx, resp.Body)); err != nil {
+		if ctx.Err() != nil {
+			common.AddBytesSavedByCancel(resp.ContentLength, n)
+		}
+		if cause := context.Cause(ctx); errors.Is(cause, ErrPushRejected) {
+			common.AbortedPushes.Add(1)
+			return cause
+		}
 		return fmt.Errorf("failed to copy body: %w", err)
 	} else {
 		if resp.ContentLength != -1 && n != resp.ContentLength {
 			return fmt.Errorf("content length mismatch, expect %d, got %d", resp.ContentLength, n)
 		}
 	}
+	// resp.Trailer is complete once the body is read
+	if err := bw.Close(ps.headerEncoder().encode(resp.Trailer)); err != nil {
+		return fmt.Errorf("failed to write push trailer: %w", err)
+	}
 	return nil
 }
 
 func (ps *PushChannelServer) Close() error {
+	if ps.control != nil {
+		ps.control.Close()
+	}
 	return ps.muxClient.Close()
 }
@@ -9,12 +9,6 @@ import (
 	"github.com/sagernet/sing/common/network"
 )
 
-type PushResponseHeader struct {
-	UrlString string
-	// TODO: compression?
-	ResponseWithoutBody []byte
-}
-
 type pushStreamHandler struct {
 	handleStream func(context.Context, net.Conn, M.Metadata) error
 }
@@ -81,8 +81,8 @@ var _ = Describe("PushChannel", func() {
 
 			client := NewPushChannelClient(func(s string) (net.Conn, error) {
 				return cc, nil
-			}, pushRespCh)
-			server := NewPushChannelServer(sc)
+			}, pushRespCh, nil)
+			server := NewPushChannelServer(sc, nil)
 			defer client.Close()
 			defer server.Close()
 
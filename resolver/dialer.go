@@ -0,0 +1,118 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	// RFC 8305 recommends 250ms before trying the other address family
+	fallbackDelay = 250 * time.Millisecond
+	dialTimeout   = 30 * time.Second
+)
+
+var (
+	dialer = &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+)
+
+// DialContext resolves addr with the resolver and dials it with happy
+// eyeballs, it can be used as http.Transport.DialContext.
+func (r *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first address decides which family goes first
+	primaries, fallbacks := splitByFamily(addrs, addrs[0].Is6())
+	if len(fallbacks) == 0 {
+		return dialSerial(ctx, network, primaries, port)
+	}
+	return dialParallel(ctx, network, primaries, fallbacks, port)
+}
+
+func dialSerial(ctx context.Context, network string, addrs []netip.Addr, port string) (conn net.Conn, err error) {
+	for _, addr := range addrs {
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// dialParallel races the two address families, giving primaries a head
+// start of fallbackDelay.
+func dialParallel(ctx context.Context, network string, primaries, fallbacks []netip.Addr, port string) (net.Conn, error) {
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, 2)
+	race := func(primary bool, addrs []netip.Addr) {
+		conn, err := dialSerial(ctx, network, addrs, port)
+		results <- result{conn, err, primary}
+	}
+	go race(true, primaries)
+
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var (
+		firstErr error
+		pending  = 1
+		started  = false
+	)
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !started {
+				started = true
+				pending++
+				go race(false, fallbacks)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// close the loser if it also made it
+				go func(pending int) {
+					for i := 0; i < pending; i++ {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !started {
+				// primaries failed fast, don't wait for the timer
+				started = true
+				pending++
+				go race(false, fallbacks)
+				continue
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/log"
+	"github.com/zckevin/http2-mitm-proxy/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+
+	// TTL for answers of the system resolver, which doesn't tell us one
+	defaultTTL = time.Minute
+	// keep NXDOMAIN and empty answers for a short while
+	negativeTTL = 10 * time.Second
+	minTTL      = 5 * time.Second
+	maxTTL      = time.Hour
+)
+
+var (
+	ErrNoAddress = errors.New("resolver: no address")
+)
+
+type Options struct {
+	// comma separated upstreams, e.g. "https://1.1.1.1/dns-query,tls://8.8.8.8,9.9.9.9",
+	// the system resolver is used if empty
+	Upstreams string
+	// comma separated "host=ip" overrides, e.g. "example.com=127.0.0.1,*.lan=10.0.0.1"
+	Hosts string
+	// PreferIPv4, PreferIPv6 or empty for the order the upstream returned
+	Prefer string
+}
+
+// Resolver resolves origin hostnames for all the server's upstream dials,
+// caching answers for their TTLs.
+type Resolver struct {
+	logger log.ContextLogger
+
+	upstreams []upstream
+	hosts     *common.HostRules[netip.Addr]
+	prefer    string
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	addrs    []netip.Addr
+	err      error
+	expireAt time.Time
+}
+
+func New(opts Options) (*Resolver, error) {
+	hosts, err := common.ParseHostRules(opts.Hosts, netip.ParseAddr)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Prefer != "" && opts.Prefer != PreferIPv4 && opts.Prefer != PreferIPv6 {
+		return nil, fmt.Errorf("resolver: unknown ip preference: %s", opts.Prefer)
+	}
+	r := &Resolver{
+		logger: common.NewLogger("Resolver"),
+		hosts:  hosts,
+		prefer: opts.Prefer,
+		cache:  make(map[string]*cacheEntry),
+	}
+	for _, s := range strings.Split(opts.Upstreams, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		u, err := parseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+// LookupNetIP returns host's addresses, ordered by the ip preference.
+func (r *Resolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	if addr, ok := r.hosts.Lookup(host); ok {
+		return []netip.Addr{addr}, nil
+	}
+
+	host = strings.ToLower(host)
+	if addrs, err, ok := r.getCached(host); ok {
+		return addrs, err
+	}
+	addrs, ttl, err := r.lookup(ctx, host)
+	if err != nil && ctx.Err() != nil {
+		// don't cache our own cancellation
+		return nil, err
+	}
+	if err == nil && len(addrs) == 0 {
+		err = fmt.Errorf("%w: %s", ErrNoAddress, host)
+	}
+	if err != nil {
+		ttl = negativeTTL
+	}
+	addrs = r.sortByPreference(addrs)
+	r.setCached(host, addrs, err, ttl)
+	return addrs, err
+}
+
+func (r *Resolver) getCached(host string) ([]netip.Addr, error, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cache[host]
+	if !ok {
+		return nil, nil, false
+	}
+	if time.Now().After(e.expireAt) {
+		delete(r.cache, host)
+		return nil, nil, false
+	}
+	return e.addrs, e.err, true
+}
+
+func (r *Resolver) setCached(host string, addrs []netip.Addr, err error, ttl time.Duration) {
+	if ttl < minTTL {
+		ttl = minTTL
+	} else if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[host] = &cacheEntry{
+		addrs:    addrs,
+		err:      err,
+		expireAt: time.Now().Add(ttl),
+	}
+}
+
+func (r *Resolver) lookup(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if len(r.upstreams) == 0 {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		for i := range addrs {
+			addrs[i] = addrs[i].Unmap()
+		}
+		return addrs, defaultTTL, err
+	}
+
+	var lastErr error
+	for _, u := range r.upstreams {
+		addrs, ttl, err := r.lookupUpstream(ctx, u, host)
+		if err == nil {
+			return addrs, ttl, nil
+		}
+		r.logger.Debug("lookup ", host, " via ", u, " failed: ", err)
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+// lookupUpstream queries A and AAAA in parallel.
+func (r *Resolver) lookupUpstream(ctx context.Context, u upstream, host string) ([]netip.Addr, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, exchangeTimeout)
+	defer cancel()
+
+	type result struct {
+		addrs []netip.Addr
+		ttl   time.Duration
+		err   error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make(chan result, len(qtypes))
+	for _, qtype := range qtypes {
+		go func(qtype dnsmessage.Type) {
+			query, id, err := buildQuery(host, qtype)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			answer, err := u.exchange(ctx, query)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			addrs, ttl, err := parseAnswer(answer, id)
+			results <- result{addrs, ttl, err}
+		}(qtype)
+	}
+
+	var (
+		addrs []netip.Addr
+		ttl   time.Duration
+		errs  []error
+	)
+	for range qtypes {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		addrs = append(addrs, res.addrs...)
+		if len(res.addrs) > 0 && (ttl == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+	}
+	if len(errs) == len(qtypes) {
+		return nil, 0, errors.Join(errs...)
+	}
+	return addrs, ttl, nil
+}
+
+// sortByPreference puts the preferred family first, keeping the order
+// within each family.
+func (r *Resolver) sortByPreference(addrs []netip.Addr) []netip.Addr {
+	if r.prefer == "" || len(addrs) < 2 {
+		return addrs
+	}
+	preferred, others := splitByFamily(addrs, r.prefer == PreferIPv6)
+	return append(preferred, others...)
+}
+
+func splitByFamily(addrs []netip.Addr, v6 bool) (matched, others []netip.Addr) {
+	for _, addr := range addrs {
+		if addr.Is6() == v6 {
+			matched = append(matched, addr)
+		} else {
+			others = append(others, addr)
+		}
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeAnswer answers an A query with 1.2.3.4 and AAAA with ::1234, a
+// truncated one carries no records.
+func fakeAnswer(query []byte, truncated bool) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	hdr.Response = true
+	hdr.Truncated = truncated
+	b := dnsmessage.NewBuilder(nil, hdr)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 300}
+	switch {
+	case truncated:
+	case q.Type == dnsmessage.TypeA:
+		b.AResource(rh, dnsmessage.AResource{A: [4]byte{1, 2, 3, 4}})
+	case q.Type == dnsmessage.TypeAAAA:
+		b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("::1234").As16()})
+	}
+	msg, _ := b.Finish()
+	return msg
+}
+
+// serveFakeDNS answers every query with fakeAnswer over udp, truncated ones
+// if truncated is set.
+func serveFakeDNS(queries *atomic.Int32, truncated bool) (addr string, stop func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).To(BeNil())
+	go func() {
+		buf := make([]byte, maxDNSMessageSize)
+		for {
+			n, raddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			if msg := fakeAnswer(buf[:n], truncated); msg != nil {
+				pc.WriteTo(msg, raddr)
+			}
+		}
+	}()
+	return pc.LocalAddr().String(), func() { pc.Close() }
+}
+
+// serveFakeDNSOverTCP answers every query with fakeAnswer over tcp at addr.
+func serveFakeDNSOverTCP(addr string, queries *atomic.Int32) (stop func()) {
+	l, err := net.Listen("tcp", addr)
+	Expect(err).To(BeNil())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length uint16
+				if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+					return
+				}
+				query := make([]byte, length)
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				queries.Add(1)
+				msg := fakeAnswer(query, false)
+				binary.Write(conn, binary.BigEndian, uint16(len(msg)))
+				conn.Write(msg)
+			}()
+		}
+	}()
+	return func() { l.Close() }
+}
+
+var _ = Describe("Resolver", func() {
+	var (
+		queries  atomic.Int32
+		upstream string
+		stop     func()
+	)
+
+	BeforeEach(func() {
+		queries.Store(0)
+		upstream, stop = serveFakeDNS(&queries, false)
+	})
+
+	AfterEach(func() {
+		stop()
+	})
+
+	It("should resolve via upstream and cache by TTL", func() {
+		r, err := New(Options{Upstreams: "udp://" + upstream})
+		Expect(err).To(BeNil())
+
+		for i := 0; i < 3; i++ {
+			addrs, err := r.LookupNetIP(context.Background(), "example.com")
+			Expect(err).To(BeNil())
+			Expect(addrs).To(ConsistOf(netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("::1234")))
+		}
+		// one A and one AAAA query
+		Expect(queries.Load()).To(Equal(int32(2)))
+	})
+
+	It("should order addresses by preference", func() {
+		for _, prefer := range []string{PreferIPv4, PreferIPv6} {
+			r, err := New(Options{Upstreams: upstream, Prefer: prefer})
+			Expect(err).To(BeNil())
+			addrs, err := r.LookupNetIP(context.Background(), "example.com")
+			Expect(err).To(BeNil())
+			Expect(addrs[0].Is6()).To(Equal(prefer == PreferIPv6))
+		}
+	})
+
+	It("should use static hosts without querying", func() {
+		r, err := New(Options{
+			Upstreams: upstream,
+			Hosts:     "example.com=127.0.0.1,*.lan=10.0.0.1",
+		})
+		Expect(err).To(BeNil())
+
+		addrs, err := r.LookupNetIP(context.Background(), "example.com")
+		Expect(err).To(BeNil())
+		Expect(addrs).To(Equal([]netip.Addr{netip.MustParseAddr("127.0.0.1")}))
+		addrs, err = r.LookupNetIP(context.Background(), "nas.lan")
+		Expect(err).To(BeNil())
+		Expect(addrs).To(Equal([]netip.Addr{netip.MustParseAddr("10.0.0.1")}))
+		Expect(queries.Load()).To(Equal(int32(0)))
+	})
+
+	It("should dial through overrides", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		defer l.Close()
+		go func() {
+			if conn, err := l.Accept(); err == nil {
+				conn.Close()
+			}
+		}()
+
+		r, err := New(Options{Hosts: "example.com=127.0.0.1"})
+		Expect(err).To(BeNil())
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		conn, err := r.DialContext(context.Background(), "tcp", net.JoinHostPort("example.com", port))
+		Expect(err).To(BeNil())
+		conn.Close()
+	})
+
+	It("should retry truncated answers over tcp", func() {
+		var udpQueries, tcpQueries atomic.Int32
+		addr, stopUDP := serveFakeDNS(&udpQueries, true)
+		defer stopUDP()
+		defer serveFakeDNSOverTCP(addr, &tcpQueries)()
+
+		r, err := New(Options{Upstreams: "udp://" + addr})
+		Expect(err).To(BeNil())
+		addrs, err := r.LookupNetIP(context.Background(), "example.com")
+		Expect(err).To(BeNil())
+		Expect(addrs).To(ConsistOf(netip.MustParseAddr("1.2.3.4"), netip.MustParseAddr("::1234")))
+		Expect(udpQueries.Load()).To(Equal(int32(2)))
+		Expect(tcpQueries.Load()).To(Equal(int32(2)))
+	})
+
+	It("should reject unknown upstream schemes", func() {
+		_, err := New(Options{Upstreams: "quic://1.1.1.1"})
+		Expect(err).NotTo(BeNil())
+	})
+})
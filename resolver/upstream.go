@@ -0,0 +1,277 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+	maxDNSMessageSize     = 65535
+	exchangeTimeout       = 5 * time.Second
+)
+
+// upstream sends a wire format DNS query and returns the wire format answer.
+type upstream interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// parseUpstream accepts "udp://1.1.1.1:53", "tls://1.1.1.1:853" and
+// "https://1.1.1.1/dns-query", a bare "1.1.1.1" means plain udp.
+func parseUpstream(s string) (upstream, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return &udpUpstream{addr: withDefaultPort(s, "53")}, nil
+	}
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: withDefaultPort(u.Host, "53")}, nil
+	case "tls":
+		return newDoTUpstream(withDefaultPort(u.Host, "853")), nil
+	case "https":
+		return newDoHUpstream(u.String()), nil
+	default:
+		return nil, fmt.Errorf("resolver: unknown upstream scheme: %s", s)
+	}
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) String() string { return "udp://" + u.addr }
+
+func (u *udpUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	var p dnsmessage.Parser
+	if hdr, err := p.Start(buf[:n]); err == nil && hdr.Truncated {
+		// the answer didn't fit a datagram, RFC 7766 says ask again over tcp
+		return u.exchangeTCP(ctx, query)
+	}
+	return buf[:n], nil
+}
+
+func (u *udpUpstream) exchangeTCP(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return exchangeStream(conn, query)
+}
+
+// exchangeStream sends query over a stream conn with TCP framing, a 2 bytes
+// length prefix, and reads the answer.
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, length)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dotUpstream is DNS over TLS (RFC 7858), one conn per query for simplicity,
+// cached answers make it rare enough.
+type dotUpstream struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func newDoTUpstream(addr string) *dotUpstream {
+	host, _, _ := net.SplitHostPort(addr)
+	return &dotUpstream{
+		addr:      addr,
+		tlsConfig: &tls.Config{ServerName: host},
+	}
+}
+
+func (u *dotUpstream) String() string { return "tls://" + u.addr }
+
+func (u *dotUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	d := tls.Dialer{Config: u.tlsConfig}
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return exchangeStream(conn, query)
+}
+
+// dohUpstream is DNS over HTTPS (RFC 8484), it keeps its own h2 conn.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(url string) *dohUpstream {
+	return &dohUpstream{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+			},
+		},
+	}
+}
+
+func (u *dohUpstream) String() string { return u.url }
+
+func (u *dohUpstream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver: doh %s returned %s", u.url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+}
+
+func buildQuery(host string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, 0, err
+	}
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBuf[:])
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  name,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, 0, err
+	}
+	msg, err := b.Finish()
+	return msg, id, err
+}
+
+// parseAnswer returns the A/AAAA records in msg and the smallest TTL among them.
+func parseAnswer(msg []byte, id uint16) ([]netip.Addr, time.Duration, error) {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	if hdr.ID != id {
+		return nil, 0, fmt.Errorf("resolver: answer id mismatch")
+	}
+	if hdr.RCode != dnsmessage.RCodeSuccess && hdr.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("resolver: answer rcode %s", hdr.RCode)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		addrs []netip.Addr
+		ttl   uint32
+	)
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+		default:
+			// e.g. CNAME, we only care about the final addresses
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if ttl == 0 || rh.TTL < ttl {
+			ttl = rh.TTL
+		}
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
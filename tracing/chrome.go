@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -26,35 +27,38 @@ func newChromeSession(ctx context.Context) *chromeSession {
 	}
 }
 
+// GetChromeTracingContext returns req's context with the span of its chrome
+// tab attached, so it's still canceled when the browser aborts req.
 func GetChromeTracingContext(req *http.Request) context.Context {
 	if !Enabled {
-		return context.Background()
+		return req.Context()
 	}
 	mu.Lock()
 	defer mu.Unlock()
 
 	traceId := req.Header.Get(chromeTabTraceIDHeader)
 	if traceId == "" {
-		return context.WithValue(context.Background(), contextIsIgnoredKey, struct{}{})
+		return context.WithValue(req.Context(), contextIsIgnoredKey, struct{}{})
 	}
 	if sess, ok := chromeSessions[traceId]; ok {
 		// try inherit context from server prefetch request
 		for _, p := range sess.propergators {
-			if childCtx, err := p.Extract(context.Background(), req.URL.String()); err == nil {
+			if childCtx, err := p.Extract(req.Context(), req.URL.String()); err == nil {
 				return childCtx
 			}
 		}
 		// if failed, return the original context
-		return sess.ctx
+		return trace.ContextWithSpan(req.Context(), trace.SpanFromContext(sess.ctx))
 	}
 
+	// the session outlives this request, don't let req cancel it
 	ctx, span := otel.Tracer("chrome_session").Start(context.Background(), fmt.Sprintf("%s:%s", traceId, req.URL.Host))
 	// we don't know how long this web session will last, so we set a timeout
 	time.AfterFunc(time.Second*5, func() {
 		span.End()
 	})
 	chromeSessions[traceId] = newChromeSession(ctx)
-	return ctx
+	return trace.ContextWithSpan(req.Context(), span)
 }
 
 func AddSpansFromResponse(req *http.Request, resp *http.Response) {